@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/gudtech/scamp-go/scamp"
+	"github.com/gudtech/scamp-go/scamp/cachemanager"
+)
+
+// cacheManager listens to discovery announcements and writes the cache file services
+// read, until interrupted
+func cacheManager(args []string) (err error) {
+	flags := flag.NewFlagSet("cache-manager", flag.ContinueOnError)
+	configPath := flags.String("config", scamp.DefaultConfigPath, "soa.conf to read the multicast group and discovery.cache_path from")
+	out := flags.String("out", "", "cache file to write (defaults to discovery.cache_path)")
+	expireAfter := flags.Int("expire-after", cachemanager.DefaultExpireAfter, "number of announce intervals an instance may miss before it is dropped")
+	writeInterval := flags.Duration("write-interval", cachemanager.DefaultWriteInterval, "how often to write the cache file when it changed")
+	err = flags.Parse(args)
+	if err != nil {
+		return
+	}
+
+	conf := scamp.NewConfig()
+	err = conf.Load(*configPath)
+	if err != nil {
+		return
+	}
+	path := *out
+	if len(path) == 0 {
+		path, _ = conf.Get("discovery.cache_path")
+	}
+	if len(path) == 0 {
+		return errors.New("-out is required when discovery.cache_path is not set")
+	}
+	if *expireAfter <= 0 || *writeInterval <= 0 {
+		return errors.New("-expire-after and -write-interval must be positive")
+	}
+
+	listener, err := scamp.ListenDiscovery(conf)
+	if err != nil {
+		return
+	}
+	defer listener.Close()
+
+	manager := cachemanager.New(path)
+	manager.ExpireAfter = *expireAfter
+	manager.WriteInterval = *writeInterval
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err = manager.Run(ctx, listener)
+	if err == context.Canceled {
+		err = nil
+	}
+	return
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/x509/pkix"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gudtech/scamp-go/scamp"
+)
+
+// genCert writes <out>/<name>.crt and <out>/<name>.key, the paths NewService looks for
+func genCert(args []string) (err error) {
+	flags := flag.NewFlagSet("gen-cert", flag.ContinueOnError)
+	name := flags.String("name", "", "service name (required), used for the file names and default common name")
+	out := flags.String("out", ".", "directory to write <name>.crt and <name>.key to")
+	days := flags.Int("days", int(scamp.DefaultCertValidity/(24*time.Hour)), "number of days the certificate is valid for")
+	keyType := flags.String("key-type", scamp.KeyTypeRSA, "key type: "+scamp.KeyTypeRSA+", "+scamp.KeyTypeECDSA+" or "+scamp.KeyTypeEd25519)
+	bits := flags.Int("bits", scamp.DefaultCertKeyBits, "RSA key size")
+	cn := flags.String("cn", "", "subject common name (defaults to -name)")
+	org := flags.String("org", "", "subject organization")
+	hosts := flags.String("hosts", "", "comma separated DNS names and IPs to add as subject alternative names")
+	force := flags.Bool("force", false, "overwrite existing files")
+	err = flags.Parse(args)
+	if err != nil {
+		return
+	}
+
+	if len(*name) == 0 {
+		flags.Usage()
+		return errors.New("-name is required")
+	}
+	if *days <= 0 {
+		return fmt.Errorf("-days must be positive, got %d", *days)
+	}
+
+	opts := scamp.CertOptions{
+		Subject:  pkix.Name{CommonName: *cn},
+		ValidFor: time.Duration(*days) * 24 * time.Hour,
+		KeyType:  *keyType,
+		KeyBits:  *bits,
+	}
+	if len(*org) > 0 {
+		opts.Subject.Organization = []string{*org}
+	}
+	if len(*hosts) > 0 {
+		opts.Hosts = strings.Split(*hosts, ",")
+	}
+
+	certPath := filepath.Join(*out, *name+".crt")
+	keyPath := filepath.Join(*out, *name+".key")
+	if !*force {
+		for _, path := range []string{certPath, keyPath} {
+			if _, statErr := os.Stat(path); statErr == nil {
+				return fmt.Errorf("`%s` already exists (use -force to overwrite)", path)
+			}
+		}
+	}
+
+	cert, err := scamp.GenerateServiceCert(*name, opts)
+	if err != nil {
+		return
+	}
+
+	err = ioutil.WriteFile(keyPath, cert.PEMKey, 0600)
+	if err != nil {
+		return
+	}
+	err = ioutil.WriteFile(certPath, cert.PEMCert, 0644)
+	if err != nil {
+		return
+	}
+
+	fmt.Printf("wrote %s and %s\nfingerprint: %s\nsha256 fingerprint: %s\n", certPath, keyPath,
+		scamp.GetSHA1FingerPrint(cert.Keypair.Leaf), scamp.GetSHA256FingerPrint(cert.Keypair.Leaf))
+
+	return
+}
@@ -0,0 +1,54 @@
+// Command scamp bundles SCAMP development and operations tools as subcommands:
+//
+//	scamp gen-cert -name logger -out /etc/GT_private/services
+//	scamp cache-manager -config /etc/SCAMP/soa.conf
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+type command struct {
+	summary string
+	run     func(args []string) error
+}
+
+var commands = map[string]command{
+	"gen-cert":      {"generate a self-signed service certificate and key", genCert},
+	"cache-manager": {"write the discovery cache file from multicast announcements", cacheManager},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: scamp <command> [flags]\n\ncommands:\n")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-14s %s\n", name, commands[name].summary)
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command `%s`\n\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+
+	err := cmd.run(os.Args[2:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "scamp %s: %s\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
@@ -4,11 +4,13 @@ package scamp
 import "errors"
 import "bufio"
 import "bytes"
+import "os"
+import "strings"
 
 // AuthorizedServiceSpec contains service's fingerprint and registered actions
 type AuthorizedServiceSpec struct {
 	Fingerprint []byte
-	Actions     []serviceProxyClass
+	Actions     []InstanceClass
 }
 
 // AuthorizedServicesCache contains array of service's AuthorizedServiceSpec
@@ -16,10 +18,15 @@ type AuthorizedServicesCache struct {
 	services []AuthorizedServiceSpec
 }
 
+// Algorithm is FingerprintSHA1 or FingerprintSHA256, depending on the spec's fingerprint
+func (spec AuthorizedServiceSpec) Algorithm() string {
+	return FingerprintAlgorithm(string(spec.Fingerprint))
+}
+
 // NewAuthorizedServicesCache Initializes amd returns a pointesr to a new AuthorizedServicesCache
 func NewAuthorizedServicesCache() (cache *AuthorizedServicesCache) {
 	cache = new(AuthorizedServicesCache)
-	cache.services = make([]AuthorizedServiceSpec, 100)
+	cache.services = make([]AuthorizedServiceSpec, 0, 100)
 
 	return
 }
@@ -39,17 +46,90 @@ func (cache *AuthorizedServicesCache) LoadAuthorizedServices(s *bufio.Scanner) (
 			continue
 		}
 
-		_, err = NewAuthorizedServicesSpec(s.Bytes())
-		if err != nil {
+		spec, specErr := NewAuthorizedServicesSpec(s.Bytes())
+		if specErr != nil {
 			// Trace.Printf("Error creating AuthorizedServicesCache: %s", err)
+			continue
 		}
+		cache.services = append(cache.services, *spec)
 
 		count = count + 1
 	}
 
+	err = s.Err()
 	return
 }
 
+// LoadAuthorizedServicesFile reads an authorized_services file, e.g. the one configured
+// as `bus.authorized_services` in soa.conf
+func LoadAuthorizedServicesFile(path string) (cache *AuthorizedServicesCache, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	cache = NewAuthorizedServicesCache()
+	err = cache.LoadAuthorizedServices(bufio.NewScanner(file))
+	if err != nil {
+		cache = nil
+		return
+	}
+
+	return
+}
+
+// AuthorizedClient reports whether the certificate presented by client is authorized
+// for action in sector, by either its SHA1 or its SHA256 fingerprint
+func (cache *AuthorizedServicesCache) AuthorizedClient(client *Client, sector, action string) bool {
+	return cache.Authorized(client.Fingerprint(), sector, action) ||
+		cache.Authorized(client.FingerprintSHA256(), sector, action)
+}
+
+// Authorized reports whether the service with the given certificate fingerprint may
+// handle (or call) action in sector. Each PREFIX of the fingerprint's line grants the
+// actions whose name starts with it, matched without regard for case. A PREFIX without
+// a `sector:` part applies to the `main` sector, and `sector:ALL` grants every action
+// of sector. fingerprint is only compared with entries of the same algorithm, so a
+// certificate may be listed by its SHA1 or its SHA256 fingerprint.
+func (cache *AuthorizedServicesCache) Authorized(fingerprint, sector, action string) bool {
+	if len(fingerprint) == 0 {
+		return false
+	}
+
+	for _, spec := range cache.services {
+		if !fingerprintsEqual(string(spec.Fingerprint), fingerprint) {
+			continue
+		}
+
+		for _, class := range spec.Actions {
+			if authorizedPrefixMatches(class.className, sector, action) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func authorizedPrefixMatches(prefix, sector, action string) bool {
+	prefixSector := "main"
+	if colon := strings.Index(prefix, ":"); colon != -1 {
+		prefixSector = prefix[:colon]
+		prefix = prefix[colon+1:]
+	}
+	if !strings.EqualFold(prefixSector, sector) {
+		return false
+	}
+	if prefix == "ALL" {
+		return true
+	}
+
+	prefix = strings.ToLower(prefix)
+	action = strings.ToLower(action)
+	return action == prefix || strings.HasPrefix(action, prefix+".")
+}
+
 // NewAuthorizedServicesSpec returns a pointer to an AuthorizedServiceSpec which contains the service's fingerprint and svailable actions
 func NewAuthorizedServicesSpec(line []byte) (spec *AuthorizedServiceSpec, err error) {
 	s := bufio.NewScanner(bytes.NewReader(line))
@@ -61,12 +141,17 @@ func NewAuthorizedServicesSpec(line []byte) (spec *AuthorizedServiceSpec, err er
 		return
 	}
 
+	if len(FingerprintAlgorithm(s.Text())) == 0 {
+		err = errors.New("fingerprint must be a SHA1 or SHA256 fingerprint")
+		return
+	}
+
 	spec = new(AuthorizedServiceSpec)
 	spec.Fingerprint = make([]byte, len(s.Bytes()))
 	copy(spec.Fingerprint, s.Bytes())
-	spec.Actions = make([]serviceProxyClass, 100) //TODO: do a better job allocating here
+	spec.Actions = make([]InstanceClass, 0)
 
-	index := 0
+	// PREFIXes are separated by commas and/or whitespace
 	var read bool
 	for {
 		read = s.Scan()
@@ -74,9 +159,12 @@ func NewAuthorizedServicesSpec(line []byte) (spec *AuthorizedServiceSpec, err er
 			break
 		}
 
-		// spec.Actions[index].className = make([]byte, len(s.Bytes()))
-		spec.Actions[index].className = string(s.Bytes())
-		index = index + 1
+		for _, prefix := range strings.Split(s.Text(), ",") {
+			if len(prefix) == 0 {
+				continue
+			}
+			spec.Actions = append(spec.Actions, InstanceClass{className: prefix})
+		}
 	}
 
 	return
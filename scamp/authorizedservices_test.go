@@ -3,6 +3,7 @@ package scamp
 import "testing"
 import "bytes"
 import "bufio"
+import "strings"
 
 func TestAuthorizedServiceSpec(t *testing.T) {
 	Initialize("/etc/SCAMP/soa.conf")
@@ -41,6 +42,11 @@ func TestBadeAuthorizedServicesSpec(t *testing.T) {
 	if err == nil {
 		t.Errorf("should not have been parsed")
 	}
+
+	_, err = NewAuthorizedServicesSpec([]byte(`06:28:FF main`))
+	if err == nil {
+		t.Errorf("truncated fingerprints should not have been parsed")
+	}
 }
 
 var testAuthorizedServices = []byte(`
@@ -49,4 +55,39 @@ var testAuthorizedServices = []byte(`
 # a PREFIX may, but need not, contain dots; it must not be empty; it is matched without regard for case
 06:28:FF:2D:85:4D:27:7F:30:39:4D:D1:3C:5A:28:C3:22:2A:85:BD config, constant, feed, device, inventory, media, nav, notes, po, product, receive, user, customer, utility, fulfillment, index, api, web:ALL, reporting, vendor, secproxy, bgdispatcher
 F9:08:C3:66:74:C4:26:76:09:15:A5:0C:CC:25:FF:63:E6:FA:F2:AC auth, user, background:ALL,  compute:ALL, soapoffload:ALL, channelmodule:ALL
+81:0F:03:3C:34:62:2F:CC:32:21:B3:B0:3C:20:75:24:63:60:5C:BE:CA:D7:9B:54:4F:CA:05:3E:60:A0:26:C6 ticket
 `)
+
+func TestAuthorizedServicesAuthorized(t *testing.T) {
+	cache := NewAuthorizedServicesCache()
+	err := cache.LoadAuthorizedServices(bufio.NewScanner(bytes.NewReader(testAuthorizedServices)))
+	if err != nil {
+		t.Fatalf("err loading auth'd services: `%s`", err)
+	}
+
+	first := "06:28:FF:2D:85:4D:27:7F:30:39:4D:D1:3C:5A:28:C3:22:2A:85:BD"
+	second := "F9:08:C3:66:74:C4:26:76:09:15:A5:0C:CC:25:FF:63:E6:FA:F2:AC"
+	third := "81:0F:03:3C:34:62:2F:CC:32:21:B3:B0:3C:20:75:24:63:60:5C:BE:CA:D7:9B:54:4F:CA:05:3E:60:A0:26:C6"
+	cases := []struct {
+		fingerprint, sector, action string
+		authorized                  bool
+	}{
+		{first, "main", "Product.fetch", true},
+		{first, "main", "productivity.fetch", false},
+		{first, "web", "Anything.goes", true},
+		{first, "background", "Product.fetch", false},
+		{second, "background", "Anything.goes", true},
+		{second, "main", "Product.fetch", false},
+		{second, "main", "user", true},
+		{"00:11", "main", "Product.fetch", false},
+		{"", "main", "Product.fetch", false},
+		{third, "main", "Ticket.verify", true},
+		{strings.ToLower(third), "main", "Ticket.verify", true},
+		{first, "main", "Ticket.verify", false},
+	}
+	for _, c := range cases {
+		if cache.Authorized(c.fingerprint, c.sector, c.action) != c.authorized {
+			t.Fatalf("expected %s to be authorized=%t for %s:%s", c.fingerprint, c.authorized, c.sector, c.action)
+		}
+	}
+}
@@ -0,0 +1,555 @@
+package scamp
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// binaryWriter is implemented by the self-describing binary envelopes (msgpack, cbor).
+// encodeBinaryValue walks Go values with the same rules as encoding/json (field names,
+// `json` tags, omitempty, string map keys) and emits them through these primitives.
+type binaryWriter interface {
+	writeNil()
+	writeBool(b bool)
+	writeInt(i int64)
+	writeUint(u uint64)
+	writeFloat(f float64)
+	writeString(s string)
+	writeBytes(b []byte)
+	writeArrayHeader(n int)
+	writeMapHeader(n int)
+}
+
+var jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+var jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+func encodeBinaryValue(w binaryWriter, rv reflect.Value) (err error) {
+	if !rv.IsValid() {
+		w.writeNil()
+		return
+	}
+
+	if rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			w.writeNil()
+			return
+		}
+	}
+
+	// Types with their own JSON encoding (time.Time, json.RawMessage, ...) are encoded from
+	// the generic value of that JSON so they mean the same thing in every envelope.
+	if rv.Type().Implements(jsonMarshalerType) {
+		return encodeViaJSON(w, rv.Interface())
+	} else if rv.Kind() != reflect.Ptr && rv.CanAddr() && reflect.PtrTo(rv.Type()).Implements(jsonMarshalerType) {
+		return encodeViaJSON(w, rv.Addr().Interface())
+	} else if rv.Type().Implements(textMarshalerType) {
+		text, err := rv.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return err
+		}
+		w.writeString(string(text))
+		return nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return encodeBinaryValue(w, rv.Elem())
+	case reflect.Bool:
+		w.writeBool(rv.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		w.writeInt(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		w.writeUint(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		w.writeFloat(rv.Float())
+	case reflect.String:
+		w.writeString(rv.String())
+	case reflect.Slice:
+		if rv.IsNil() {
+			w.writeNil()
+			return
+		}
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			w.writeBytes(rv.Bytes())
+			return
+		}
+		fallthrough
+	case reflect.Array:
+		w.writeArrayHeader(rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			err = encodeBinaryValue(w, rv.Index(i))
+			if err != nil {
+				return
+			}
+		}
+	case reflect.Map:
+		if rv.IsNil() {
+			w.writeNil()
+			return
+		}
+		return encodeBinaryMap(w, rv)
+	case reflect.Struct:
+		return encodeBinaryStruct(w, rv)
+	default:
+		err = fmt.Errorf("cannot encode value of type %s", rv.Type())
+	}
+
+	return
+}
+
+func encodeViaJSON(w binaryWriter, v interface{}) (err error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+
+	var generic interface{}
+	err = json.Unmarshal(raw, &generic)
+	if err != nil {
+		return
+	}
+
+	return encodeBinaryValue(w, reflect.ValueOf(generic))
+}
+
+func binaryMapKey(key reflect.Value) (name string, err error) {
+	if key.Kind() == reflect.String {
+		return key.String(), nil
+	}
+	if key.Type().Implements(textMarshalerType) {
+		text, err := key.Interface().(encoding.TextMarshaler).MarshalText()
+		return string(text), err
+	}
+
+	switch key.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(key.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(key.Uint(), 10), nil
+	}
+
+	err = fmt.Errorf("unsupported map key type %s", key.Type())
+	return
+}
+
+func encodeBinaryMap(w binaryWriter, rv reflect.Value) (err error) {
+	keys := rv.MapKeys()
+	names := make([]string, len(keys))
+	for i, key := range keys {
+		names[i], err = binaryMapKey(key)
+		if err != nil {
+			return
+		}
+	}
+
+	// Sort keys so equal maps always encode to equal bytes
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool { return names[order[a]] < names[order[b]] })
+
+	w.writeMapHeader(len(keys))
+	for _, i := range order {
+		w.writeString(names[i])
+		err = encodeBinaryValue(w, rv.MapIndex(keys[i]))
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func encodeBinaryStruct(w binaryWriter, rv reflect.Value) (err error) {
+	fields := cachedBinaryFields(rv.Type())
+
+	present := make([]reflect.Value, len(fields))
+	count := 0
+	for i, field := range fields {
+		fv, ok := binaryFieldValue(rv, field.index)
+		if !ok || (field.omitEmpty && isEmptyBinaryValue(fv)) {
+			continue
+		}
+		present[i] = fv
+		count++
+	}
+
+	w.writeMapHeader(count)
+	for i, field := range fields {
+		if !present[i].IsValid() {
+			continue
+		}
+		w.writeString(field.name)
+		err = encodeBinaryValue(w, present[i])
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// binaryFieldValue follows an embedded field path, reporting false if it crosses a nil pointer
+func binaryFieldValue(rv reflect.Value, index []int) (fv reflect.Value, ok bool) {
+	fv = rv
+	for _, i := range index {
+		if fv.Kind() == reflect.Ptr {
+			if fv.IsNil() {
+				return fv, false
+			}
+			fv = fv.Elem()
+		}
+		fv = fv.Field(i)
+	}
+	return fv, true
+}
+
+func isEmptyBinaryValue(rv reflect.Value) bool {
+	switch rv.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return rv.Len() == 0
+	case reflect.Bool:
+		return !rv.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return rv.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return rv.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return rv.IsNil()
+	}
+	return false
+}
+
+type binaryField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+var binaryFieldsCache sync.Map
+
+// cachedBinaryFields lists the encoded fields of a struct type following encoding/json's
+// naming rules. Fields of embedded structs are promoted unless shadowed.
+func cachedBinaryFields(t reflect.Type) []binaryField {
+	if cached, ok := binaryFieldsCache.Load(t); ok {
+		return cached.([]binaryField)
+	}
+
+	fields := make([]binaryField, 0, t.NumField())
+	seen := make(map[string]bool)
+	var embedded []binaryField
+
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		name := sf.Name
+		omitEmpty := false
+		if len(tag) > 0 {
+			parts := strings.Split(tag, ",")
+			if len(parts[0]) > 0 {
+				name = parts[0]
+			}
+			for _, opt := range parts[1:] {
+				if opt == "omitempty" {
+					omitEmpty = true
+				}
+			}
+		}
+
+		ft := sf.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if sf.Anonymous && len(tag) == 0 && ft.Kind() == reflect.Struct {
+			for _, inner := range cachedBinaryFields(ft) {
+				inner.index = append([]int{i}, inner.index...)
+				embedded = append(embedded, inner)
+			}
+			continue
+		}
+		if len(sf.PkgPath) > 0 {
+			continue // unexported
+		}
+
+		fields = append(fields, binaryField{name: name, index: []int{i}, omitEmpty: omitEmpty})
+		seen[name] = true
+	}
+
+	for _, field := range embedded {
+		if !seen[field.name] {
+			fields = append(fields, field)
+			seen[field.name] = true
+		}
+	}
+
+	binaryFieldsCache.Store(t, fields)
+	return fields
+}
+
+// assignBinaryValue stores a decoded generic value (nil, bool, int64, uint64, float64, string,
+// []byte, []interface{} or map[string]interface{}) into rv.
+func assignBinaryValue(rv reflect.Value, x interface{}) (err error) {
+	if rv.CanAddr() && rv.Kind() != reflect.Interface {
+		ptr := rv.Addr()
+		if ptr.Type().Implements(jsonUnmarshalerType) {
+			raw, err := json.Marshal(x)
+			if err != nil {
+				return err
+			}
+			return ptr.Interface().(json.Unmarshaler).UnmarshalJSON(raw)
+		}
+		if s, ok := x.(string); ok && ptr.Type().Implements(textUnmarshalerType) {
+			return ptr.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+		}
+	}
+
+	if x == nil {
+		switch rv.Kind() {
+		case reflect.Interface, reflect.Ptr, reflect.Map, reflect.Slice:
+			rv.Set(reflect.Zero(rv.Type()))
+		}
+		return
+	}
+
+	switch rv.Kind() {
+	case reflect.Interface:
+		if rv.NumMethod() != 0 {
+			return fmt.Errorf("cannot decode into non-empty interface %s", rv.Type())
+		}
+		rv.Set(reflect.ValueOf(x))
+	case reflect.Ptr:
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		return assignBinaryValue(rv.Elem(), x)
+	case reflect.Bool:
+		b, ok := x.(bool)
+		if !ok {
+			return binaryTypeError(x, rv)
+		}
+		rv.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		switch n := x.(type) {
+		case int64:
+			i = n
+		case uint64:
+			if n > math.MaxInt64 {
+				return binaryTypeError(x, rv)
+			}
+			i = int64(n)
+		case float64:
+			if n != math.Trunc(n) {
+				return binaryTypeError(x, rv)
+			}
+			i = int64(n)
+		default:
+			return binaryTypeError(x, rv)
+		}
+		if rv.OverflowInt(i) {
+			return binaryTypeError(x, rv)
+		}
+		rv.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		var u uint64
+		switch n := x.(type) {
+		case uint64:
+			u = n
+		case int64:
+			if n < 0 {
+				return binaryTypeError(x, rv)
+			}
+			u = uint64(n)
+		case float64:
+			if n < 0 || n != math.Trunc(n) {
+				return binaryTypeError(x, rv)
+			}
+			u = uint64(n)
+		default:
+			return binaryTypeError(x, rv)
+		}
+		if rv.OverflowUint(u) {
+			return binaryTypeError(x, rv)
+		}
+		rv.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		switch n := x.(type) {
+		case float64:
+			rv.SetFloat(n)
+		case int64:
+			rv.SetFloat(float64(n))
+		case uint64:
+			rv.SetFloat(float64(n))
+		default:
+			return binaryTypeError(x, rv)
+		}
+	case reflect.String:
+		switch s := x.(type) {
+		case string:
+			rv.SetString(s)
+		case []byte:
+			rv.SetString(string(s))
+		default:
+			return binaryTypeError(x, rv)
+		}
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			switch b := x.(type) {
+			case []byte:
+				rv.SetBytes(append([]byte(nil), b...))
+				return
+			case string:
+				rv.SetBytes([]byte(b))
+				return
+			}
+		}
+		items, ok := x.([]interface{})
+		if !ok {
+			return binaryTypeError(x, rv)
+		}
+		slice := reflect.MakeSlice(rv.Type(), len(items), len(items))
+		for i, item := range items {
+			err = assignBinaryValue(slice.Index(i), item)
+			if err != nil {
+				return
+			}
+		}
+		rv.Set(slice)
+	case reflect.Array:
+		items, ok := x.([]interface{})
+		if !ok {
+			return binaryTypeError(x, rv)
+		}
+		for i := 0; i < rv.Len(); i++ {
+			if i < len(items) {
+				err = assignBinaryValue(rv.Index(i), items[i])
+				if err != nil {
+					return
+				}
+			} else {
+				rv.Index(i).Set(reflect.Zero(rv.Type().Elem()))
+			}
+		}
+	case reflect.Map:
+		entries, ok := x.(map[string]interface{})
+		if !ok {
+			return binaryTypeError(x, rv)
+		}
+		if rv.IsNil() {
+			rv.Set(reflect.MakeMap(rv.Type()))
+		}
+		for name, entry := range entries {
+			key := reflect.New(rv.Type().Key()).Elem()
+			err = assignBinaryMapKey(key, name)
+			if err != nil {
+				return
+			}
+			value := reflect.New(rv.Type().Elem()).Elem()
+			err = assignBinaryValue(value, entry)
+			if err != nil {
+				return
+			}
+			rv.SetMapIndex(key, value)
+		}
+	case reflect.Struct:
+		entries, ok := x.(map[string]interface{})
+		if !ok {
+			return binaryTypeError(x, rv)
+		}
+		fields := cachedBinaryFields(rv.Type())
+		for name, entry := range entries {
+			field := findBinaryField(fields, name)
+			if field == nil {
+				continue
+			}
+			fv := rv
+			for _, i := range field.index {
+				if fv.Kind() == reflect.Ptr {
+					if fv.IsNil() {
+						fv.Set(reflect.New(fv.Type().Elem()))
+					}
+					fv = fv.Elem()
+				}
+				fv = fv.Field(i)
+			}
+			err = assignBinaryValue(fv, entry)
+			if err != nil {
+				return
+			}
+		}
+	default:
+		return binaryTypeError(x, rv)
+	}
+
+	return
+}
+
+func findBinaryField(fields []binaryField, name string) *binaryField {
+	for i := range fields {
+		if fields[i].name == name {
+			return &fields[i]
+		}
+	}
+	// like encoding/json, fall back to a case-insensitive match
+	for i := range fields {
+		if strings.EqualFold(fields[i].name, name) {
+			return &fields[i]
+		}
+	}
+	return nil
+}
+
+func assignBinaryMapKey(key reflect.Value, name string) (err error) {
+	if key.CanAddr() && key.Addr().Type().Implements(textUnmarshalerType) {
+		return key.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(name))
+	}
+
+	switch key.Kind() {
+	case reflect.String:
+		key.SetString(name)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(name, 10, 64)
+		if err != nil || key.OverflowInt(i) {
+			return fmt.Errorf("invalid map key `%s` for %s", name, key.Type())
+		}
+		key.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u, err := strconv.ParseUint(name, 10, 64)
+		if err != nil || key.OverflowUint(u) {
+			return fmt.Errorf("invalid map key `%s` for %s", name, key.Type())
+		}
+		key.SetUint(u)
+	default:
+		err = fmt.Errorf("unsupported map key type %s", key.Type())
+	}
+	return
+}
+
+func binaryTypeError(x interface{}, rv reflect.Value) error {
+	return fmt.Errorf("cannot decode %T into %s", x, rv.Type())
+}
+
+// decodeBinaryInto stores a decoded generic value into v, which must be a non-nil pointer
+func decodeBinaryInto(x interface{}, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("decode target must be a non-nil pointer, got %T", v)
+	}
+	return assignBinaryValue(rv.Elem(), x)
+}
@@ -0,0 +1,273 @@
+package scamp
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// CacheEventType tells what happened to an instance in a CacheEvent
+type CacheEventType int
+
+const (
+	// InstanceAdded is sent when an instance matching the filter appears
+	InstanceAdded CacheEventType = iota + 1
+	// InstanceRemoved is sent when an instance matching the filter disappears, or no
+	// longer matches it
+	InstanceRemoved
+	// InstanceUpdated is sent when an instance is announced again with a different record
+	InstanceUpdated
+)
+
+func (eventType CacheEventType) String() string {
+	switch eventType {
+	case InstanceAdded:
+		return "added"
+	case InstanceRemoved:
+		return "removed"
+	case InstanceUpdated:
+		return "updated"
+	}
+	return fmt.Sprintf("CacheEventType(%d)", int(eventType))
+}
+
+// CacheEvent describes a change to one instance of a ServiceCache
+type CacheEvent struct {
+	Type  CacheEventType
+	Ident string
+	// Instance is the new instance, or the one removed for InstanceRemoved events
+	Instance *ServiceInstance
+	// Previous is the replaced instance of InstanceUpdated events
+	Previous *ServiceInstance
+}
+
+// CacheFilter selects the instances a subscription hears about. Empty fields match
+// every instance.
+type CacheFilter struct {
+	// Sector the instances, or at least one of their actions, are in
+	Sector string
+	// Action is a `Class.action` name the instances must offer, in any version, and
+	// in Sector if it is set
+	Action string
+}
+
+func (filter CacheFilter) matches(instance *ServiceInstance) bool {
+	if instance == nil {
+		return false
+	}
+	if len(filter.Action) == 0 && (len(filter.Sector) == 0 || instance.sector == filter.Sector) {
+		return true
+	}
+
+	for _, class := range instance.classes {
+		for _, action := range class.actions {
+			if len(filter.Sector) > 0 && instance.actionSector(action) != filter.Sector {
+				continue
+			}
+			if len(filter.Action) == 0 || class.className+"."+action.actionName == filter.Action {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Subscribe returns a channel receiving an event every time an instance matching
+// filter is added to, removed from or updated in the cache, whether by a refresh of
+// the cache file or by Store, Remove and revocations. Events a slow reader has not
+// received yet are coalesced per instance, so at most one is queued for each: it sums
+// up the changes since the reader last heard of the instance (an instance added and
+// removed again in the meantime is not reported at all). Call Unsubscribe when done
+// to release the channel.
+func (cache *ServiceCache) Subscribe(filter CacheFilter) <-chan CacheEvent {
+	sub := &cacheSubscription{
+		filter: filter,
+		events: make(chan CacheEvent),
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+	}
+	go sub.deliver()
+
+	cache.cacheM.Lock()
+	cache.subscriptions = append(cache.subscriptions, sub)
+	cache.cacheM.Unlock()
+
+	return sub.events
+}
+
+// Unsubscribe stops the events of a channel returned by Subscribe and closes it.
+// Events not yet received are discarded.
+func (cache *ServiceCache) Unsubscribe(events <-chan CacheEvent) {
+	cache.cacheM.Lock()
+	defer cache.cacheM.Unlock()
+
+	for i, sub := range cache.subscriptions {
+		if sub.events == events {
+			cache.subscriptions = append(cache.subscriptions[:i:i], cache.subscriptions[i+1:]...)
+			close(sub.stop)
+			return
+		}
+	}
+}
+
+// publishNoLock makes snapshot the current one and tells subscribers what changed
+func (cache *ServiceCache) publishNoLock(snapshot *cacheSnapshot) {
+	previous := cache.snapshot.Swap(snapshot)
+	if len(cache.subscriptions) == 0 {
+		return
+	}
+
+	changes := diffSnapshots(previous, snapshot)
+	for _, sub := range cache.subscriptions {
+		var events []CacheEvent
+		for _, change := range changes {
+			event, ok := sub.filter.event(change)
+			if ok {
+				events = append(events, event)
+			}
+		}
+		if len(events) > 0 {
+			sub.push(events)
+		}
+	}
+}
+
+// diffSnapshots lists the instances that differ between two snapshots, sorted by
+// ident, as updated events carrying both the old and the new instance (either may be
+// nil). A re-announcement of an unchanged instance is no change.
+func diffSnapshots(previous, current *cacheSnapshot) (changes []CacheEvent) {
+	for ident, instance := range current.identIndex {
+		old := previous.identIndex[ident]
+		if !instance.SameAnnouncement(old) {
+			changes = append(changes, CacheEvent{Type: InstanceUpdated, Ident: ident, Instance: instance, Previous: old})
+		}
+	}
+	for ident, old := range previous.identIndex {
+		if _, ok := current.identIndex[ident]; !ok {
+			changes = append(changes, CacheEvent{Type: InstanceUpdated, Ident: ident, Previous: old})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Ident < changes[j].Ident })
+	return
+}
+
+// event turns a change found by diffSnapshots into the event seen through filter
+func (filter CacheFilter) event(change CacheEvent) (event CacheEvent, ok bool) {
+	wasMatched := filter.matches(change.Previous)
+	isMatched := filter.matches(change.Instance)
+
+	event.Ident = change.Ident
+	switch {
+	case wasMatched && isMatched:
+		event.Type = InstanceUpdated
+		event.Instance = change.Instance
+		event.Previous = change.Previous
+	case isMatched:
+		event.Type = InstanceAdded
+		event.Instance = change.Instance
+	case wasMatched:
+		event.Type = InstanceRemoved
+		event.Instance = change.Previous
+	default:
+		return
+	}
+
+	ok = true
+	return
+}
+
+// cacheSubscription queues events for one subscriber so publishing never waits on it
+type cacheSubscription struct {
+	filter CacheFilter
+	events chan CacheEvent
+	queueM sync.Mutex
+	queue  []CacheEvent
+	// queued is the position in queue of the event queued for each ident
+	queued map[string]int
+	wake   chan struct{}
+	stop   chan struct{}
+}
+
+func (sub *cacheSubscription) push(events []CacheEvent) {
+	sub.queueM.Lock()
+	if sub.queued == nil {
+		sub.queued = make(map[string]int)
+	}
+	for _, event := range events {
+		i, ok := sub.queued[event.Ident]
+		if !ok {
+			sub.queued[event.Ident] = len(sub.queue)
+			sub.queue = append(sub.queue, event)
+			continue
+		}
+		sub.queue[i] = coalesceEvents(sub.queue[i], event)
+	}
+	sub.queueM.Unlock()
+
+	select {
+	case sub.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (sub *cacheSubscription) deliver() {
+	defer close(sub.events)
+
+	for {
+		select {
+		case <-sub.stop:
+			return
+		case <-sub.wake:
+		}
+
+		sub.queueM.Lock()
+		queue := sub.queue
+		sub.queue = nil
+		sub.queued = nil
+		sub.queueM.Unlock()
+
+		for _, event := range queue {
+			if event.Type == 0 {
+				// added and removed again before it was delivered
+				continue
+			}
+			select {
+			case <-sub.stop:
+				return
+			case sub.events <- event:
+			}
+		}
+	}
+}
+
+// coalesceEvents combines a queued event with a later one for the same instance into
+// the event going from what the reader last heard of to the current instance. A zero
+// Type means there is nothing left to tell.
+func coalesceEvents(queued, later CacheEvent) (event CacheEvent) {
+	var before, after *ServiceInstance
+	switch queued.Type {
+	case InstanceRemoved:
+		before = queued.Instance
+	case InstanceUpdated:
+		before = queued.Previous
+	}
+	if later.Type != InstanceRemoved {
+		after = later.Instance
+	}
+
+	event.Ident = later.Ident
+	switch {
+	case before != nil && after != nil:
+		event.Type = InstanceUpdated
+		event.Instance = after
+		event.Previous = before
+	case after != nil:
+		event.Type = InstanceAdded
+		event.Instance = after
+	case before != nil:
+		event.Type = InstanceRemoved
+		event.Instance = before
+	}
+	return
+}
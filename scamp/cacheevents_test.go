@@ -0,0 +1,135 @@
+package scamp
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+	"time"
+)
+
+func expectEvent(t *testing.T, events <-chan CacheEvent, eventType CacheEventType, ident string) CacheEvent {
+	t.Helper()
+
+	select {
+	case event := <-events:
+		if event.Type != eventType || event.Ident != ident {
+			t.Fatalf("expected %s `%s`, got %s `%s`", eventType, ident, event.Type, event.Ident)
+		}
+		return event
+	case <-time.After(time.Second):
+		t.Fatalf("expected %s `%s`, got nothing", eventType, ident)
+	}
+	return CacheEvent{}
+}
+
+func expectNoEvent(t *testing.T, events <-chan CacheEvent) {
+	t.Helper()
+
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected %s `%s`", event.Type, event.Ident)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	initSCAMPLogger()
+
+	cache := NewMemoryServiceCache()
+	all := cache.Subscribe(CacheFilter{})
+	logger := cache.Subscribe(CacheFilter{Sector: "main", Action: "Logger.info"})
+	web := cache.Subscribe(CacheFilter{Sector: "web"})
+	defer cache.Unsubscribe(all)
+	defer cache.Unsubscribe(logger)
+	defer cache.Unsubscribe(web)
+
+	cache.StoreStatic("logger-1", "main", "beepish+tls://127.0.0.1:30100", []string{"json"}, "Logger.info", "Logger.warn")
+	expectEvent(t, all, InstanceAdded, "logger-1")
+	added := expectEvent(t, logger, InstanceAdded, "logger-1")
+	if added.Instance != cache.Retrieve("logger-1") {
+		t.Fatalf("expected the event to carry the stored instance")
+	}
+
+	// announced again without Logger.info
+	cache.StoreStatic("logger-1", "main", "beepish+tls://127.0.0.1:30100", []string{"json"}, "Logger.warn")
+	updated := expectEvent(t, all, InstanceUpdated, "logger-1")
+	if updated.Previous != added.Instance {
+		t.Fatalf("expected the update to carry the previous instance")
+	}
+	expectEvent(t, logger, InstanceRemoved, "logger-1")
+
+	cache.Remove("logger-1")
+	expectEvent(t, all, InstanceRemoved, "logger-1")
+	expectNoEvent(t, logger)
+	expectNoEvent(t, web)
+
+	// refreshes of the cache file are reported too
+	announce, ident := announceWithValidity(t, "events", time.Now(), time.Hour)
+	err := cache.DoScan(bufio.NewScanner(bytes.NewReader(announce)))
+	if err != nil {
+		t.Fatalf("could not scan: `%s`", err)
+	}
+	expectEvent(t, all, InstanceAdded, ident)
+	err = cache.DoScan(bufio.NewScanner(bytes.NewReader(announce)))
+	if err != nil {
+		t.Fatalf("could not scan: `%s`", err)
+	}
+	expectNoEvent(t, all)
+
+	cache.Unsubscribe(web)
+	if _, ok := <-web; ok {
+		t.Fatalf("expected Unsubscribe to close the channel")
+	}
+}
+
+func TestSlowSubscribersCoalesceEvents(t *testing.T) {
+	v1, v2, v3 := new(ServiceInstance), new(ServiceInstance), new(ServiceInstance)
+	gone := new(ServiceInstance)
+
+	// nobody reads: push only queues
+	sub := &cacheSubscription{wake: make(chan struct{}, 1)}
+	for i := 0; i < 1000; i++ {
+		sub.push([]CacheEvent{
+			{Type: InstanceUpdated, Ident: "bob", Instance: v2, Previous: v1},
+			{Type: InstanceUpdated, Ident: "bob", Instance: v3, Previous: v2},
+		})
+	}
+	sub.push([]CacheEvent{{Type: InstanceAdded, Ident: "alice", Instance: v1}})
+	sub.push([]CacheEvent{{Type: InstanceRemoved, Ident: "alice", Instance: v1}})
+	sub.push([]CacheEvent{{Type: InstanceRemoved, Ident: "carol", Instance: gone}})
+	sub.push([]CacheEvent{{Type: InstanceAdded, Ident: "carol", Instance: v3}})
+	sub.push([]CacheEvent{{Type: InstanceAdded, Ident: "dave", Instance: v1}})
+	sub.push([]CacheEvent{{Type: InstanceUpdated, Ident: "dave", Instance: v2, Previous: v1}})
+
+	if len(sub.queue) != 4 {
+		t.Fatalf("expected one queued event per instance, got %d", len(sub.queue))
+	}
+	expected := []CacheEvent{
+		{Type: InstanceUpdated, Ident: "bob", Instance: v3, Previous: v1},
+		// added and removed again: nothing to tell
+		{Ident: "alice"},
+		{Type: InstanceUpdated, Ident: "carol", Instance: v3, Previous: gone},
+		{Type: InstanceAdded, Ident: "dave", Instance: v2},
+	}
+	for i, event := range sub.queue {
+		if event != expected[i] {
+			t.Fatalf("event %d: expected %+v, got %+v", i, expected[i], event)
+		}
+	}
+
+	// the delivered events skip what cancelled out
+	sub.events = make(chan CacheEvent)
+	sub.stop = make(chan struct{})
+	go sub.deliver()
+	defer close(sub.stop)
+	for _, ident := range []string{"bob", "carol", "dave"} {
+		select {
+		case event := <-sub.events:
+			if event.Ident != ident {
+				t.Fatalf("expected an event for `%s`, got `%s`", ident, event.Ident)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected an event for `%s`", ident)
+		}
+	}
+}
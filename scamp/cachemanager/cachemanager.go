@@ -0,0 +1,174 @@
+// Package cachemanager writes the discovery cache file that scamp.ServiceCache reads,
+// from the announcements services multicast:
+//
+//	listener, err := scamp.ListenDiscovery(conf)
+//	manager := cachemanager.New("/var/tmp/discovery")
+//	err = manager.Run(ctx, listener)
+//
+// Announcements are verified, de-duplicated by instance, and dropped once their
+// instance stops announcing itself or goes away with weight 0.
+package cachemanager
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gudtech/scamp-go/scamp"
+)
+
+// DefaultExpireAfter is how many announce intervals an instance may miss before it is
+// dropped from the cache
+const DefaultExpireAfter = scamp.DefaultExpireAfter
+
+// DefaultWriteInterval is how often Run checks for expired instances and writes the
+// cache file, when it changed
+var DefaultWriteInterval = time.Second
+
+// Manager keeps the current announcement of every instance heard from, and writes
+// them to the cache file. Announcements are tracked by the embedded
+// scamp.MulticastProvider: see its Observe, Expire and Instances.
+type Manager struct {
+	*scamp.MulticastProvider
+
+	path string
+
+	// WriteInterval is how often Run writes the cache file
+	WriteInterval time.Duration
+
+	// written are the instances last written to the file
+	writtenM sync.Mutex
+	written  []*scamp.ServiceInstance
+	wrote    bool
+}
+
+// New creates a Manager writing the cache file at path
+func New(path string) (manager *Manager) {
+	manager = new(Manager)
+	manager.MulticastProvider = scamp.NewMulticastProvider(nil)
+	manager.path = path
+	manager.WriteInterval = DefaultWriteInterval
+	return
+}
+
+// WriteFile writes the cache file if the instances changed since it was last
+// written. The file is replaced atomically, so readers never see a partial file.
+func (manager *Manager) WriteFile() (written bool, err error) {
+	manager.writtenM.Lock()
+	defer manager.writtenM.Unlock()
+
+	instances := manager.Instances()
+	if manager.wrote && sameInstances(instances, manager.written) {
+		return
+	}
+
+	var buf bytes.Buffer
+	for _, instance := range instances {
+		var record []byte
+		record, err = instance.MarshalText()
+		if err != nil {
+			return
+		}
+		buf.WriteString("%%%\n")
+		buf.Write(record)
+	}
+
+	err = writeFileAtomic(manager.path, buf.Bytes())
+	if err != nil {
+		return
+	}
+
+	manager.written = instances
+	manager.wrote = true
+	written = true
+	return
+}
+
+// sameInstances reports whether a and b, sorted by ident, announce the same things.
+// Re-announcements that only move the timestamp don't make the file worth rewriting.
+func sameInstances(a, b []*scamp.ServiceInstance) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].SameAnnouncement(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it over
+// path once it is synced
+func writeFileAtomic(path string, data []byte) (err error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return
+	}
+
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmp.Name(), path)
+	return
+}
+
+// Run records the announcements received by listener and keeps the cache file up to
+// date, until ctx is done. It returns ctx.Err() when ctx is done, or the listener's
+// error if it fails.
+func (manager *Manager) Run(ctx context.Context, listener *scamp.DiscoveryListener) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- listener.Run(ctx, func(instance *scamp.ServiceInstance) {
+			manager.Observe(instance, time.Now())
+		})
+	}()
+
+	ticker := time.NewTicker(manager.WriteInterval)
+	defer ticker.Stop()
+	for {
+		manager.flush(time.Now())
+
+		select {
+		case err = <-listenErr:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// flush expires instances and writes the cache file, logging failures
+func (manager *Manager) flush(now time.Time) {
+	for _, ident := range manager.Expire(now) {
+		scamp.Info.Printf("instance `%s` stopped announcing", ident)
+	}
+
+	_, err := manager.WriteFile()
+	if err != nil {
+		scamp.Error.Printf("could not write `%s`: %s", manager.path, err)
+	}
+}
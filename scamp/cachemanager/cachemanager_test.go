@@ -0,0 +1,157 @@
+package cachemanager
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gudtech/scamp-go/scamp"
+)
+
+// newAnnouncingService returns a signed service and a function marshaling its current
+// announcement
+func newAnnouncingService(t *testing.T, humanName string) (*scamp.Service, func() []byte) {
+	cert, err := scamp.GenerateServiceCert(humanName, scamp.CertOptions{KeyType: scamp.KeyTypeECDSA})
+	if err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+	listener, err := scamp.NewPipeListener(t.Name() + "-" + humanName)
+	if err != nil {
+		t.Fatalf("could not listen: `%s`", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	serv, err := scamp.NewServiceWithListener("main", humanName, listener)
+	if err != nil {
+		t.Fatalf("could not create service: `%s`", err)
+	}
+	serv.SetCertificate(cert.Keypair, cert.PEMCert)
+	serv.Register("Echo.echo", func(_ *scamp.Message, _ *scamp.Client) {})
+
+	return serv, func() []byte {
+		announce, err := serv.MarshalText()
+		if err != nil {
+			t.Fatalf("could not marshal announcement: `%s`", err)
+		}
+		return announce
+	}
+}
+
+func parse(t *testing.T, announce []byte) *scamp.ServiceInstance {
+	instance, err := scamp.ParseAnnouncePacket(announce)
+	if err != nil {
+		t.Fatalf("could not parse announcement: `%s`", err)
+	}
+	return instance
+}
+
+func TestManager(t *testing.T) {
+	serv, announce := newAnnouncingService(t, "managed")
+	first := parse(t, announce())
+	path := filepath.Join(t.TempDir(), "discovery")
+
+	manager := New(path)
+	now := time.Now()
+	manager.Observe(first, now)
+	written, err := manager.WriteFile()
+	if err != nil || !written {
+		t.Fatalf("expected the cache file to be written (%v)", err)
+	}
+
+	cache, err := scamp.NewServiceCache(path)
+	if err != nil {
+		t.Fatalf("could not create cache: `%s`", err)
+	}
+	err = cache.Refresh()
+	if err != nil {
+		t.Fatalf("could not read cache file: `%s`", err)
+	}
+	if cache.Retrieve(first.Ident()) == nil {
+		t.Fatalf("expected the written announcement to verify")
+	}
+
+	// the same announcement again only postpones expiry
+	manager.Observe(first, now.Add(10*time.Second))
+	if written, _ = manager.WriteFile(); written {
+		t.Fatalf("expected an unchanged cache not to be written")
+	}
+	if expired := manager.Expire(now.Add(20 * time.Second)); len(expired) != 0 {
+		t.Fatalf("expected the re-announced instance to be kept, expired %v", expired)
+	}
+
+	// older announcements don't replace newer ones
+	time.Sleep(time.Millisecond)
+	second := parse(t, announce())
+	manager.Observe(second, now)
+	manager.Observe(first, now)
+	// and a newer one that only moves the timestamp doesn't rewrite the file
+	if written, _ = manager.WriteFile(); written {
+		t.Fatalf("expected a re-announcement not to rewrite the cache file")
+	}
+	if instances := manager.Instances(); len(instances) != 1 || instances[0] != second {
+		t.Fatalf("expected the newer announcement to be kept")
+	}
+
+	if expired := manager.Expire(now.Add(time.Minute)); len(expired) != 1 || expired[0] != first.Ident() {
+		t.Fatalf("expected the silent instance to expire, got %v", expired)
+	}
+
+	// going away with weight 0
+	manager.Observe(second, now)
+	serv.SetWeight(0)
+	manager.Observe(parse(t, announce()), now)
+	if len(manager.Instances()) != 0 {
+		t.Fatalf("expected the instance announcing weight 0 to be dropped")
+	}
+}
+
+func TestRun(t *testing.T) {
+	_, announce := newAnnouncingService(t, "listened")
+	path := filepath.Join(t.TempDir(), "discovery")
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: `%s`", err)
+	}
+	listener := scamp.NewDiscoveryListener(conn)
+
+	manager := New(path)
+	manager.WriteInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() { stopped <- manager.Run(ctx, listener) }()
+
+	sender, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("could not dial: `%s`", err)
+	}
+	defer sender.Close()
+	sender.Write([]byte("not an announcement"))
+	record := announce()
+	sender.Write(record)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		contents, _ := ioutil.ReadFile(path)
+		if bytes.Equal(contents, append([]byte("%%%\n"), record...)) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the announcement was not written: `%s`", contents)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case err = <-stopped:
+		if err != context.Canceled {
+			t.Fatalf("unexpected error: `%v`", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Run did not return after its context was done")
+	}
+}
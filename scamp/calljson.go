@@ -0,0 +1,165 @@
+package scamp
+
+import (
+	"context"
+	"fmt"
+)
+
+// defaultErrorCode is sent in the reply's `error_code` when a handler fails with a plain error
+const defaultErrorCode = "general"
+
+// ReplyError is a SCAMP error reply: the `error` and `error_code` header values of a reply message.
+// Handlers registered with RegisterJSON may return one to choose the error code sent to the caller.
+type ReplyError struct {
+	Code    string
+	Message string
+}
+
+func (replyErr *ReplyError) Error() string {
+	if len(replyErr.Code) > 0 {
+		return fmt.Sprintf("%s: %s", replyErr.Code, replyErr.Message)
+	}
+	return replyErr.Message
+}
+
+// CallJSON encodes req as JSON, sends it to sector:action~version using the default requester
+// and decodes the reply into Resp. Error replies are returned as a *ReplyError.
+func CallJSON[Req, Resp any](ctx context.Context, sector, action string, version int, req Req) (resp Resp, err error) {
+	requester, err := DefaultRequester()
+	if err != nil {
+		return
+	}
+
+	return CallJSONWith[Req, Resp](ctx, requester, sector, action, version, req)
+}
+
+// CallJSONWith is CallJSON using an explicit requester
+func CallJSONWith[Req, Resp any](ctx context.Context, requester *Requester, sector, action string, version int, req Req) (resp Resp, err error) {
+	msg := NewRequestMessage()
+	msg.SetEnvelope(EnvelopeJSON)
+	msg.SetAction(action)
+	_, err = msg.WriteEnvelope(req)
+	if err != nil {
+		err = fmt.Errorf("could not encode request: `%s`", err)
+		return
+	}
+
+	reply, err := requester.MakeJSONRequestContext(ctx, sector, action, version, msg)
+	if err != nil {
+		return
+	}
+
+	return decodeJSONReply[Resp](reply)
+}
+
+// Call sends req to sector:action~version using the default requester, encoded with the first of
+// the requester's envelopes (see Requester.SetEnvelopes) that an instance announces for the action,
+// and decodes the reply into Resp.
+func Call[Req, Resp any](ctx context.Context, sector, action string, version int, req Req) (resp Resp, err error) {
+	requester, err := DefaultRequester()
+	if err != nil {
+		return
+	}
+
+	return CallWith[Req, Resp](ctx, requester, sector, action, version, req)
+}
+
+// CallWith is Call using an explicit requester
+func CallWith[Req, Resp any](ctx context.Context, requester *Requester, sector, action string, version int, req Req) (resp Resp, err error) {
+	envelope, err := requester.NegotiateEnvelope(sector, action, version)
+	if err != nil {
+		return
+	}
+
+	msg := NewRequestMessage()
+	msg.SetEnvelope(envelope)
+	msg.SetAction(action)
+	_, err = msg.WriteEnvelope(req)
+	if err != nil {
+		err = fmt.Errorf("could not encode request: `%s`", err)
+		return
+	}
+
+	reply, err := requester.MakeJSONRequestContext(ctx, sector, action, version, msg)
+	if err != nil {
+		return
+	}
+
+	return decodeJSONReply[Resp](reply)
+}
+
+func decodeJSONReply[Resp any](reply *Message) (resp Resp, err error) {
+	if len(reply.Error) > 0 || len(reply.ErrorCode) > 0 {
+		err = &ReplyError{Code: reply.ErrorCode, Message: reply.Error}
+		return
+	}
+
+	err = reply.ReadEnvelope(&resp)
+	if _, isReplyErr := err.(*ReplyError); err != nil && !isReplyErr {
+		err = fmt.Errorf("could not decode reply: `%s`", err)
+	}
+
+	return
+}
+
+// RegisterJSON registers a typed handler for name on serv. The request body is decoded into Req,
+// fn is invoked, and its Resp is encoded as the reply body. If decoding fails or fn returns an
+// error, the reply carries it in the `error` and `error_code` headers instead.
+func RegisterJSON[Req, Resp any](serv *Service, name string, fn func(*Message, Req) (Resp, error)) (err error) {
+	return RegisterJSONEnvelopes(serv, name, []envelopeFormat{EnvelopeJSON}, fn)
+}
+
+// RegisterJSONEnvelopes is RegisterJSON for an action accepting several envelopes (e.g. json and
+// msgpack). Requests are decoded and replies encoded with the envelope the request arrived in.
+func RegisterJSONEnvelopes[Req, Resp any](serv *Service, name string, envelopes []envelopeFormat, fn func(*Message, Req) (Resp, error)) (err error) {
+	return serv.RegisterEnvelopes(name, envelopes, func(msg *Message, client *Client) {
+		reply := handleJSON(msg, fn)
+
+		_, err := client.Send(reply)
+		if err != nil {
+			Error.Printf("could not send reply to `%s`: `%s`", msg.Action, err)
+			client.Close()
+		}
+	})
+}
+
+func handleJSON[Req, Resp any](msg *Message, fn func(*Message, Req) (Resp, error)) (reply *Message) {
+	reply = NewResponseMessage()
+	reply.SetEnvelope(msg.Envelope)
+	reply.SetAction(msg.Action)
+	reply.SetRequestID(msg.RequestID)
+	reply.SetCompressionFor(msg)
+
+	var req Req
+	err := msg.ReadEnvelope(&req)
+	if err != nil {
+		setReplyError(reply, &ReplyError{Code: defaultErrorCode, Message: fmt.Sprintf("could not decode request: %s", err)})
+		return
+	}
+
+	resp, err := fn(msg, req)
+	if err != nil {
+		setReplyError(reply, err)
+		return
+	}
+
+	_, err = reply.WriteEnvelope(resp)
+	if err != nil {
+		setReplyError(reply, &ReplyError{Code: defaultErrorCode, Message: fmt.Sprintf("could not encode reply: %s", err)})
+		return
+	}
+
+	return
+}
+
+func setReplyError(reply *Message, err error) {
+	replyErr, ok := err.(*ReplyError)
+	if !ok {
+		replyErr = &ReplyError{Code: defaultErrorCode, Message: err.Error()}
+	}
+
+	reply.SetError(replyErr.Message)
+	reply.SetErrorCode(replyErr.Code)
+	reply.packets = nil
+	reply.bytesWritten = 0
+}
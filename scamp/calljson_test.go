@@ -0,0 +1,84 @@
+package scamp
+
+import (
+	"errors"
+	"testing"
+)
+
+type echoRequest struct {
+	Name string `json:"name"`
+}
+
+type echoResponse struct {
+	Greeting string `json:"greeting"`
+}
+
+func TestHandleJSON(t *testing.T) {
+	msg := NewRequestMessage()
+	msg.SetRequestID(7)
+	msg.Write([]byte(`{"name":"bob"}`))
+
+	reply := handleJSON(msg, func(_ *Message, req echoRequest) (echoResponse, error) {
+		return echoResponse{Greeting: "hello " + req.Name}, nil
+	})
+
+	if reply.MessageType != MessageTypeReply || reply.RequestID != 7 {
+		t.Fatalf("reply header not set up: type %d, request id %d", reply.MessageType, reply.RequestID)
+	}
+
+	resp, err := decodeJSONReply[echoResponse](reply)
+	if err != nil {
+		t.Fatalf("unexpected error decoding reply: `%s`", err)
+	}
+	if resp.Greeting != "hello bob" {
+		t.Fatalf("expected `hello bob`, got `%s`", resp.Greeting)
+	}
+}
+
+func TestHandleJSONError(t *testing.T) {
+	msg := NewRequestMessage()
+	msg.Write([]byte(`{"name":"bob"}`))
+
+	reply := handleJSON(msg, func(_ *Message, req echoRequest) (resp echoResponse, err error) {
+		err = &ReplyError{Code: "not_found", Message: "no such user"}
+		return
+	})
+
+	_, err := decodeJSONReply[echoResponse](reply)
+	replyErr, ok := err.(*ReplyError)
+	if !ok {
+		t.Fatalf("expected a *ReplyError, got `%v`", err)
+	}
+	if replyErr.Code != "not_found" || replyErr.Message != "no such user" {
+		t.Fatalf("wrong reply error: `%s`", replyErr)
+	}
+
+	reply = handleJSON(msg, func(_ *Message, req echoRequest) (resp echoResponse, err error) {
+		err = errors.New("boom")
+		return
+	})
+	if reply.Error != "boom" || reply.ErrorCode != defaultErrorCode {
+		t.Fatalf("expected plain errors to use the default code, got `%s`/`%s`", reply.Error, reply.ErrorCode)
+	}
+	if len(reply.Bytes()) != 0 {
+		t.Fatalf("error replies should not carry a body")
+	}
+}
+
+func TestHandleJSONBadRequest(t *testing.T) {
+	msg := NewRequestMessage()
+	msg.Write([]byte(`not json`))
+
+	called := false
+	reply := handleJSON(msg, func(_ *Message, req echoRequest) (resp echoResponse, err error) {
+		called = true
+		return
+	})
+
+	if called {
+		t.Fatalf("handler should not run when the request can't be decoded")
+	}
+	if len(reply.Error) == 0 {
+		t.Fatalf("expected an error reply")
+	}
+}
@@ -0,0 +1,347 @@
+package scamp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// cborCodec is the `cbor` envelope: the body is the CBOR (RFC 8949) encoding of the payload,
+// built with the same field rules as the `json` envelope. Errors are carried in the reply headers.
+// Decoding accepts indefinite-length items and ignores semantic tags.
+type cborCodec struct{}
+
+func (cborCodec) Encode(_ *Message, data interface{}) (body []byte, err error) {
+	return marshalCBOR(data)
+}
+
+func (cborCodec) Decode(_ *Message, body []byte, v interface{}) (err error) {
+	return unmarshalCBOR(body, v)
+}
+
+func marshalCBOR(data interface{}) (body []byte, err error) {
+	w := new(cborWriter)
+	err = encodeBinaryValue(w, reflect.ValueOf(data))
+	if err != nil {
+		return
+	}
+	return w.buf.Bytes(), nil
+}
+
+func unmarshalCBOR(body []byte, v interface{}) (err error) {
+	r := &cborReader{data: body}
+	x, err := r.readValue(0)
+	if err != nil {
+		return
+	}
+	if x == cborBreak {
+		return fmt.Errorf("cbor: unexpected break")
+	}
+	if r.pos != len(r.data) {
+		return fmt.Errorf("cbor: %d trailing bytes", len(r.data)-r.pos)
+	}
+	return decodeBinaryInto(x, v)
+}
+
+const (
+	cborMajorUint   = 0
+	cborMajorNegInt = 1
+	cborMajorBytes  = 2
+	cborMajorText   = 3
+	cborMajorArray  = 4
+	cborMajorMap    = 5
+	cborMajorTag    = 6
+	cborMajorSimple = 7
+)
+
+type cborWriter struct {
+	buf     bytes.Buffer
+	scratch [9]byte
+}
+
+func (w *cborWriter) writeHead(major byte, n uint64) {
+	w.scratch[0] = major << 5
+	switch {
+	case n < 24:
+		w.scratch[0] |= byte(n)
+		w.buf.Write(w.scratch[:1])
+	case n <= math.MaxUint8:
+		w.scratch[0] |= 24
+		w.scratch[1] = byte(n)
+		w.buf.Write(w.scratch[:2])
+	case n <= math.MaxUint16:
+		w.scratch[0] |= 25
+		binary.BigEndian.PutUint16(w.scratch[1:], uint16(n))
+		w.buf.Write(w.scratch[:3])
+	case n <= math.MaxUint32:
+		w.scratch[0] |= 26
+		binary.BigEndian.PutUint32(w.scratch[1:], uint32(n))
+		w.buf.Write(w.scratch[:5])
+	default:
+		w.scratch[0] |= 27
+		binary.BigEndian.PutUint64(w.scratch[1:], n)
+		w.buf.Write(w.scratch[:9])
+	}
+}
+
+func (w *cborWriter) writeNil() {
+	w.buf.WriteByte(0xf6)
+}
+
+func (w *cborWriter) writeBool(b bool) {
+	if b {
+		w.buf.WriteByte(0xf5)
+	} else {
+		w.buf.WriteByte(0xf4)
+	}
+}
+
+func (w *cborWriter) writeInt(i int64) {
+	if i >= 0 {
+		w.writeHead(cborMajorUint, uint64(i))
+	} else {
+		w.writeHead(cborMajorNegInt, uint64(-1-i))
+	}
+}
+
+func (w *cborWriter) writeUint(u uint64) {
+	w.writeHead(cborMajorUint, u)
+}
+
+func (w *cborWriter) writeFloat(f float64) {
+	w.scratch[0] = 0xfb
+	binary.BigEndian.PutUint64(w.scratch[1:], math.Float64bits(f))
+	w.buf.Write(w.scratch[:9])
+}
+
+func (w *cborWriter) writeString(s string) {
+	w.writeHead(cborMajorText, uint64(len(s)))
+	w.buf.WriteString(s)
+}
+
+func (w *cborWriter) writeBytes(b []byte) {
+	w.writeHead(cborMajorBytes, uint64(len(b)))
+	w.buf.Write(b)
+}
+
+func (w *cborWriter) writeArrayHeader(n int) {
+	w.writeHead(cborMajorArray, uint64(n))
+}
+
+func (w *cborWriter) writeMapHeader(n int) {
+	w.writeHead(cborMajorMap, uint64(n))
+}
+
+type cborBreakMarker struct{}
+
+// cborBreak is returned by readValue for the 0xff stop code of indefinite-length items
+var cborBreak = cborBreakMarker{}
+
+type cborReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *cborReader) next(n int) (b []byte, err error) {
+	if n < 0 || len(r.data)-r.pos < n {
+		return nil, errBinaryTruncated
+	}
+	b = r.data[r.pos : r.pos+n]
+	r.pos += n
+	return
+}
+
+// readHead reads an initial byte and its argument. indefinite is set for additional info 31.
+func (r *cborReader) readHead() (major byte, info byte, n uint64, indefinite bool, err error) {
+	b, err := r.next(1)
+	if err != nil {
+		return
+	}
+	major = b[0] >> 5
+	info = b[0] & 0x1f
+
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info == 24:
+		b, err = r.next(1)
+		if err == nil {
+			n = uint64(b[0])
+		}
+	case info == 25:
+		b, err = r.next(2)
+		if err == nil {
+			n = uint64(binary.BigEndian.Uint16(b))
+		}
+	case info == 26:
+		b, err = r.next(4)
+		if err == nil {
+			n = uint64(binary.BigEndian.Uint32(b))
+		}
+	case info == 27:
+		b, err = r.next(8)
+		if err == nil {
+			n = binary.BigEndian.Uint64(b)
+		}
+	case info == 31:
+		indefinite = true
+	default:
+		err = fmt.Errorf("cbor: reserved additional info %d", info)
+	}
+	return
+}
+
+func (r *cborReader) readValue(depth int) (x interface{}, err error) {
+	if depth > maxBinaryDepth {
+		return nil, fmt.Errorf("cbor: nesting too deep")
+	}
+
+	major, info, n, indefinite, err := r.readHead()
+	if err != nil {
+		return
+	}
+
+	switch major {
+	case cborMajorUint:
+		if indefinite {
+			break
+		}
+		return n, nil
+	case cborMajorNegInt:
+		if indefinite {
+			break
+		}
+		if n > math.MaxInt64 {
+			return float64(-1) - float64(n), nil
+		}
+		return -1 - int64(n), nil
+	case cborMajorBytes, cborMajorText:
+		var raw []byte
+		if indefinite {
+			raw, err = r.readChunks(major)
+		} else {
+			var b []byte
+			b, err = r.next(int(n))
+			raw = append([]byte(nil), b...)
+		}
+		if err != nil {
+			return
+		}
+		if major == cborMajorText {
+			return string(raw), nil
+		}
+		return raw, nil
+	case cborMajorArray:
+		items := make([]interface{}, 0)
+		for i := uint64(0); indefinite || i < n; i++ {
+			item, err := r.readValue(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if item == cborBreak {
+				if !indefinite {
+					return nil, fmt.Errorf("cbor: unexpected break")
+				}
+				break
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	case cborMajorMap:
+		entries := make(map[string]interface{})
+		for i := uint64(0); indefinite || i < n; i++ {
+			key, err := r.readValue(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if key == cborBreak {
+				if !indefinite {
+					return nil, fmt.Errorf("cbor: unexpected break")
+				}
+				break
+			}
+			value, err := r.readValue(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if value == cborBreak {
+				return nil, fmt.Errorf("cbor: unexpected break")
+			}
+			entries[binaryKeyString(key)] = value
+		}
+		return entries, nil
+	case cborMajorTag:
+		if indefinite {
+			break
+		}
+		return r.readValue(depth + 1)
+	case cborMajorSimple:
+		switch info {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22, 23:
+			return nil, nil
+		case 25:
+			return halfToFloat64(uint16(n)), nil
+		case 26:
+			return float64(math.Float32frombits(uint32(n))), nil
+		case 27:
+			return math.Float64frombits(n), nil
+		case 31:
+			return cborBreak, nil
+		}
+		return nil, fmt.Errorf("cbor: unsupported simple value %d", n)
+	}
+
+	return nil, fmt.Errorf("cbor: unexpected indefinite length for major type %d", major)
+}
+
+// readChunks joins the definite-length chunks of an indefinite-length byte or text string
+func (r *cborReader) readChunks(major byte) (raw []byte, err error) {
+	raw = make([]byte, 0)
+	for {
+		chunkMajor, info, n, indefinite, err := r.readHead()
+		if err != nil {
+			return nil, err
+		}
+		if chunkMajor == cborMajorSimple && info == 31 {
+			return raw, nil
+		}
+		if chunkMajor != major || indefinite {
+			return nil, fmt.Errorf("cbor: bad chunk in indefinite-length string")
+		}
+		b, err := r.next(int(n))
+		if err != nil {
+			return nil, err
+		}
+		raw = append(raw, b...)
+	}
+}
+
+func halfToFloat64(half uint16) float64 {
+	exp := int(half>>10) & 0x1f
+	mant := float64(half & 0x3ff)
+
+	var val float64
+	switch exp {
+	case 0:
+		val = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			val = math.Inf(1)
+		} else {
+			val = math.NaN()
+		}
+	default:
+		val = math.Ldexp(mant+1024, exp-25)
+	}
+
+	if half&0x8000 != 0 {
+		return -val
+	}
+	return val
+}
@@ -0,0 +1,65 @@
+package scamp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCBOREncoding(t *testing.T) {
+	body, err := marshalCBOR(map[string]interface{}{"a": 1, "b": []interface{}{true, nil, "x"}, "c": -500})
+	if err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+
+	expected := []byte{0xa3, 0x61, 'a', 0x01, 0x61, 'b', 0x83, 0xf5, 0xf6, 0x61, 'x', 0x61, 'c', 0x39, 0x01, 0xf3}
+	if !bytes.Equal(body, expected) {
+		t.Fatalf("expected `% x`, got `% x`", expected, body)
+	}
+}
+
+func TestCBORRoundTrip(t *testing.T) {
+	in := binaryPayload{
+		Name:   "orders",
+		Count:  -1,
+		Ratio:  1.5,
+		Tags:   []string{},
+		Attrs:  map[string]int{"y": 1 << 20},
+		Raw:    []byte("raw"),
+		Nested: &binaryPayload{Name: "child"},
+	}
+
+	body, err := marshalCBOR(in)
+	if err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+
+	var out binaryPayload
+	err = unmarshalCBOR(body, &out)
+	if err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+
+	if out.Name != in.Name || out.Count != in.Count || out.Ratio != in.Ratio ||
+		out.Attrs["y"] != 1<<20 || !bytes.Equal(out.Raw, in.Raw) || out.Nested == nil || out.Nested.Name != "child" {
+		t.Fatalf("round trip mismatch: %+v", out)
+	}
+}
+
+func TestCBORDecodesIndefiniteAndHalfFloats(t *testing.T) {
+	// {_ "a": [_ 1, 2], "b": 1.5 (half float), "c": (_ "ab" "c")}
+	body := []byte{0xbf, 0x61, 'a', 0x9f, 0x01, 0x02, 0xff, 0x61, 'b', 0xf9, 0x3e, 0x00,
+		0x61, 'c', 0x7f, 0x62, 'a', 'b', 0x61, 'c', 0xff, 0xff}
+
+	var out struct {
+		A []int   `json:"a"`
+		B float64 `json:"b"`
+		C string  `json:"c"`
+	}
+	err := unmarshalCBOR(body, &out)
+	if err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+	if len(out.A) != 2 || out.A[1] != 2 || out.B != 1.5 || out.C != "abc" {
+		t.Fatalf("decoded wrong values: %+v", out)
+	}
+}
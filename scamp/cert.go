@@ -4,28 +4,84 @@ import "encoding/hex"
 import "strings"
 
 import "crypto/sha1"
+import "crypto/sha256"
 import "crypto/x509"
 
+// Fingerprint algorithms, told apart by the length of the fingerprint
+const (
+	FingerprintSHA1   = "sha1"
+	FingerprintSHA256 = "sha256"
+)
+
 // GetSHA1FingerPrint returns a sha1 hash fingerprint of the service's x509 certitifate
 func GetSHA1FingerPrint(cert *x509.Certificate) (hexSha1 string) {
 	return sha1FingerPrint(cert)
 }
 
+// GetSHA256FingerPrint returns a sha256 hash fingerprint of the service's x509 certificate,
+// in the same colon separated uppercase format as GetSHA1FingerPrint
+func GetSHA256FingerPrint(cert *x509.Certificate) (hexSha256 string) {
+	return sha256FingerPrint(cert)
+}
+
 func sha1FingerPrint(cert *x509.Certificate) (hexSha1 string) {
 	h := sha1.New()
 	h.Write(cert.Raw)
-	val := h.Sum(nil)
-	rawHexEncoded := hex.EncodeToString(val)
-	upperCased := strings.ToUpper(rawHexEncoded)
-	upperCasedLen := len(upperCased)
-	hexSha1 = ""
-
-	for i, rune := range upperCased {
-		hexSha1 = hexSha1 + string(rune)
-		if i > 0 && i != upperCasedLen-1 && (i+1)%2 == 0 {
-			hexSha1 = hexSha1 + ":"
+	return formatFingerprint(h.Sum(nil))
+}
+
+func sha256FingerPrint(cert *x509.Certificate) (hexSha256 string) {
+	h := sha256.New()
+	h.Write(cert.Raw)
+	return formatFingerprint(h.Sum(nil))
+}
+
+// formatFingerprint renders a digest as uppercase hex bytes separated by colons,
+// like `openssl x509 -fingerprint`
+func formatFingerprint(digest []byte) string {
+	upperCased := strings.ToUpper(hex.EncodeToString(digest))
+
+	var b strings.Builder
+	for i := 0; i < len(upperCased); i += 2 {
+		if i > 0 {
+			b.WriteByte(':')
 		}
+		b.WriteString(upperCased[i : i+2])
 	}
 
-	return
+	return b.String()
+}
+
+// FingerprintAlgorithm returns FingerprintSHA1 or FingerprintSHA256 depending on the
+// length of fingerprint, or an empty string if it is neither. Colons and case are ignored.
+func FingerprintAlgorithm(fingerprint string) string {
+	digest, err := hex.DecodeString(strings.Replace(fingerprint, ":", "", -1))
+	if err != nil {
+		return ""
+	}
+
+	switch len(digest) {
+	case sha1.Size:
+		return FingerprintSHA1
+	case sha256.Size:
+		return FingerprintSHA256
+	}
+	return ""
+}
+
+// canonicalFingerprint is fingerprint in the colon separated uppercase format, or an
+// empty string if it is not a SHA1 or SHA256 fingerprint
+func canonicalFingerprint(fingerprint string) string {
+	digest, err := hex.DecodeString(strings.Replace(fingerprint, ":", "", -1))
+	if err != nil || (len(digest) != sha1.Size && len(digest) != sha256.Size) {
+		return ""
+	}
+	return formatFingerprint(digest)
+}
+
+// fingerprintsEqual compares two fingerprints of the same algorithm. Fingerprints of
+// different algorithms never match, even when they are of the same certificate.
+func fingerprintsEqual(a, b string) bool {
+	canonicalA := canonicalFingerprint(a)
+	return len(canonicalA) > 0 && canonicalA == canonicalFingerprint(b)
 }
@@ -61,4 +61,31 @@ vTK9LN2g3yixLZdO8GeH/AjpNn3a10lGoC67ETOJsfozHxJXE2gs/qiUeoqEgg==
 		t.Errorf("cert fingerprints did not match")
 		t.FailNow()
 	}
+
+	expectedSHA256 := "81:0F:03:3C:34:62:2F:CC:32:21:B3:B0:3C:20:75:24:63:60:5C:BE:CA:D7:9B:54:4F:CA:05:3E:60:A0:26:C6"
+	if sha256FingerPrint(cert) != expectedSHA256 {
+		t.Fatalf("expected sha256 fingerprint `%s`, got `%s`", expectedSHA256, sha256FingerPrint(cert))
+	}
+}
+
+func TestFingerprintAlgorithms(t *testing.T) {
+	sha1 := "3B:1C:53:11:78:8B:70:71:07:00:FE:29:2F:AA:22:82:57:26:4A:09"
+	sha256 := "81:0F:03:3C:34:62:2F:CC:32:21:B3:B0:3C:20:75:24:63:60:5C:BE:CA:D7:9B:54:4F:CA:05:3E:60:A0:26:C6"
+
+	if FingerprintAlgorithm(sha1) != FingerprintSHA1 || FingerprintAlgorithm(sha256) != FingerprintSHA256 {
+		t.Fatalf("misdetected fingerprint algorithms")
+	}
+	if FingerprintAlgorithm("3B:1C") != "" || FingerprintAlgorithm("not a fingerprint") != "" {
+		t.Fatalf("expected malformed fingerprints to have no algorithm")
+	}
+
+	if !fingerprintsEqual(sha1, "3b1c5311788b70710700fe292faa228257264a09") {
+		t.Fatalf("expected comparison to ignore case and colons")
+	}
+	if fingerprintsEqual(sha1, sha256) || fingerprintsEqual(sha1[:len(sha1)-3], sha256[:len(sha1)-3]) {
+		t.Fatalf("fingerprints of different algorithms must not match")
+	}
+	if fingerprintsEqual("", "") {
+		t.Fatalf("empty fingerprints must not match")
+	}
 }
@@ -0,0 +1,161 @@
+package scamp
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// CertExpiryPolicy is what a ServiceCache does with announcements whose certificate is
+// expired or not yet valid
+type CertExpiryPolicy int
+
+const (
+	// CertExpiryWarn keeps the announcement and logs a warning once per certificate
+	CertExpiryWarn CertExpiryPolicy = iota
+	// CertExpiryReject drops the announcement as if its signature did not verify
+	CertExpiryReject
+	// CertExpiryIgnore keeps the announcement silently
+	CertExpiryIgnore
+)
+
+// ParseCertExpiryPolicy reads the `discovery.cert_expiry` soa.conf values `warn`,
+// `reject` and `ignore`
+func ParseCertExpiryPolicy(value string) (policy CertExpiryPolicy, err error) {
+	switch value {
+	case "warn":
+		policy = CertExpiryWarn
+	case "reject":
+		policy = CertExpiryReject
+	case "ignore":
+		policy = CertExpiryIgnore
+	default:
+		err = fmt.Errorf("unknown cert expiry policy `%s` (expected warn, reject or ignore)", value)
+	}
+	return
+}
+
+func (policy CertExpiryPolicy) String() string {
+	switch policy {
+	case CertExpiryWarn:
+		return "warn"
+	case CertExpiryReject:
+		return "reject"
+	case CertExpiryIgnore:
+		return "ignore"
+	}
+	return fmt.Sprintf("CertExpiryPolicy(%d)", int(policy))
+}
+
+// SetCertExpiryPolicy chooses what DoScan does with announcements whose certificate is
+// outside of its validity period. The default is CertExpiryWarn. It only applies while
+// record verification is enabled.
+func (cache *ServiceCache) SetCertExpiryPolicy(policy CertExpiryPolicy) {
+	cache.cacheM.Lock()
+	defer cache.cacheM.Unlock()
+
+	cache.expiryPolicy = policy
+}
+
+// ExpiringCertificates lists the instances whose certificate expires within the given
+// duration, soonest first. Instances that are already expired are included. Instances
+// without a certificate, like those added with StoreStatic, are left out.
+func (cache *ServiceCache) ExpiringCertificates(within time.Duration) (proxies []*ServiceInstance) {
+	deadline := cache.now().Add(within)
+	for _, proxy := range cache.load().identIndex {
+		cert, err := proxy.certificate()
+		if err != nil {
+			continue
+		}
+		if cert.NotAfter.Before(deadline) {
+			proxies = append(proxies, proxy)
+		}
+	}
+
+	sort.Slice(proxies, func(i, j int) bool {
+		return proxies[i].cert.NotAfter.Before(proxies[j].cert.NotAfter)
+	})
+
+	return
+}
+
+// checkCertExpiry applies the cache's expiry policy to instance, returning an error if
+// it must not be stored. Must be called with cacheM held.
+func (cache *ServiceCache) checkCertExpiry(instance *ServiceInstance) (err error) {
+	if cache.expiryPolicy == CertExpiryIgnore {
+		return
+	}
+
+	cert, err := instance.certificate()
+	if err != nil {
+		return
+	}
+
+	err = checkCertValidity(cert, cache.now())
+	if err == nil || cache.expiryPolicy == CertExpiryReject {
+		return
+	}
+
+	fingerprint := sha1FingerPrint(cert)
+	if !cache.expiryWarned[fingerprint] {
+		cache.expiryWarned[fingerprint] = true
+		Warning.Printf("service `%s`: %s", instance.ident, err)
+	}
+	err = nil
+
+	return
+}
+
+// checkCertValidity returns an error if now is outside of cert's validity period
+func checkCertValidity(cert *x509.Certificate, now time.Time) (err error) {
+	if now.Before(cert.NotBefore) {
+		err = fmt.Errorf("certificate is not valid until %s", cert.NotBefore.UTC().Format(time.RFC3339))
+	} else if now.After(cert.NotAfter) {
+		err = fmt.Errorf("certificate expired at %s", cert.NotAfter.UTC().Format(time.RFC3339))
+	}
+	return
+}
+
+// certificate parses the announced certificate once and remembers it
+func (sp *ServiceInstance) certificate() (cert *x509.Certificate, err error) {
+	sp.certOnce.Do(func() {
+		decoded, _ := pem.Decode(sp.rawCert)
+		if decoded == nil {
+			sp.certErr = fmt.Errorf("could not find valid cert in `%s`", sp.rawCert)
+			return
+		}
+
+		sp.cert, sp.certErr = x509.ParseCertificate(decoded.Bytes)
+		if sp.certErr != nil {
+			sp.certErr = fmt.Errorf("failed to parse certificate: `%s`", sp.certErr)
+		}
+	})
+
+	return sp.cert, sp.certErr
+}
+
+// CertNotAfter is the end of the validity period of the instance's certificate
+func (sp *ServiceInstance) CertNotAfter() (notAfter time.Time, err error) {
+	cert, err := sp.certificate()
+	if err != nil {
+		return
+	}
+
+	notAfter = cert.NotAfter
+	return
+}
+
+// DaysUntilExpiry is the number of whole days left before the instance's certificate
+// expires. It is negative once the certificate has expired.
+func (sp *ServiceInstance) DaysUntilExpiry() (days int, err error) {
+	notAfter, err := sp.CertNotAfter()
+	if err != nil {
+		return
+	}
+
+	days = int(math.Floor(time.Until(notAfter).Hours() / 24))
+	return
+}
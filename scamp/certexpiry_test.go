@@ -0,0 +1,93 @@
+package scamp
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+	"time"
+)
+
+// announceWithValidity marshals the announcement of a service whose certificate is
+// valid from notBefore for validFor, and returns it with the service's ident
+func announceWithValidity(t *testing.T, humanName string, notBefore time.Time, validFor time.Duration) ([]byte, string) {
+	cert, err := GenerateServiceCert(humanName, CertOptions{NotBefore: notBefore, ValidFor: validFor, KeyType: KeyTypeECDSA})
+	if err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+
+	serv, err := NewServiceExplicitCert("main", "127.0.0.1:0", humanName, cert.Keypair, cert.PEMCert)
+	if err != nil {
+		t.Fatalf("could not create service: `%s`", err)
+	}
+	defer serv.Stop()
+	serv.Register("Expiry.check", func(_ *Message, _ *Client) {})
+
+	announce, err := serv.MarshalText()
+	if err != nil {
+		t.Fatalf("could not marshal announcement: `%s`", err)
+	}
+	return append([]byte("%%%\n"), announce...), serv.name
+}
+
+func TestCertExpiryPolicy(t *testing.T) {
+	initSCAMPLogger()
+
+	now := time.Now()
+	idents := make(map[string]string)
+	var announces []byte
+	for _, cert := range []struct {
+		name      string
+		notBefore time.Time
+		validFor  time.Duration
+	}{
+		{"expired", now.Add(-72 * time.Hour), 36 * time.Hour},
+		{"future", now.Add(24 * time.Hour), 24 * time.Hour},
+		{"expiring", now.Add(-time.Hour), 72 * time.Hour},
+		{"current", now.Add(-time.Hour), 30 * 24 * time.Hour},
+	} {
+		announce, ident := announceWithValidity(t, cert.name, cert.notBefore, cert.validFor)
+		announces = append(announces, announce...)
+		idents[cert.name] = ident
+	}
+
+	scan := func(policy CertExpiryPolicy) *ServiceCache {
+		cache, _ := newServiceCache("")
+		cache.SetCertExpiryPolicy(policy)
+		err := cache.DoScan(bufio.NewScanner(bytes.NewReader(announces)))
+		if err != nil {
+			t.Fatalf("%s: could not scan announcements: `%s`", policy, err)
+		}
+		return cache
+	}
+
+	cache := scan(CertExpiryReject)
+	if cache.Size() != 2 || cache.Retrieve(idents["expired"]) != nil || cache.Retrieve(idents["future"]) != nil {
+		t.Fatalf("expected only the valid certificates to be kept, got %d instances", cache.Size())
+	}
+
+	for _, policy := range []CertExpiryPolicy{CertExpiryWarn, CertExpiryIgnore} {
+		cache = scan(policy)
+		if cache.Size() != 4 {
+			t.Fatalf("%s: expected every announcement to be kept, got %d", policy, cache.Size())
+		}
+	}
+
+	expiring := cache.ExpiringCertificates(7 * 24 * time.Hour)
+	if len(expiring) != 3 || expiring[0].ident != idents["expired"] || expiring[1].ident != idents["future"] || expiring[2].ident != idents["expiring"] {
+		t.Fatalf("unexpected expiring certificates %v", expiring)
+	}
+
+	days, err := cache.Retrieve(idents["expiring"]).DaysUntilExpiry()
+	if err != nil || days != 2 {
+		t.Fatalf("expected 2 days until expiry, got %d (%v)", days, err)
+	}
+	days, _ = cache.Retrieve(idents["expired"]).DaysUntilExpiry()
+	if days != -2 {
+		t.Fatalf("expected -2 days until expiry, got %d", days)
+	}
+
+	_, err = ParseCertExpiryPolicy("sometimes")
+	if err == nil {
+		t.Fatalf("expected an error for an unknown policy")
+	}
+}
@@ -0,0 +1,186 @@
+package scamp
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+)
+
+// DefaultCertValidity is how long generated certificates are valid when CertOptions.ValidFor is zero
+var DefaultCertValidity = 365 * 24 * time.Hour
+
+// DefaultCertKeyBits is the RSA key size used when CertOptions.KeyBits is zero
+var DefaultCertKeyBits = 2048
+
+// Key types GenerateServiceCert can create
+const (
+	KeyTypeRSA     = "rsa"
+	KeyTypeECDSA   = "ecdsa-p256"
+	KeyTypeEd25519 = "ed25519"
+)
+
+// CertOptions tunes GenerateServiceCert. The zero value gives a certificate for the
+// service name, valid from now for DefaultCertValidity.
+type CertOptions struct {
+	// Subject of the certificate. CommonName defaults to the service name.
+	Subject pkix.Name
+	// NotBefore defaults to the current time
+	NotBefore time.Time
+	// ValidFor defaults to DefaultCertValidity
+	ValidFor time.Duration
+	// KeyType is one of KeyTypeRSA (the default), KeyTypeECDSA or KeyTypeEd25519
+	KeyType string
+	// KeyBits is the RSA key size. It defaults to DefaultCertKeyBits.
+	KeyBits int
+	// Hosts are added to the certificate as DNS or IP subject alternative names
+	Hosts []string
+}
+
+// ServiceCert is a generated service keypair and self-signed certificate
+type ServiceCert struct {
+	// Keypair is ready to hand to NewServiceExplicitCert
+	Keypair tls.Certificate
+	// PEMCert is the PEM encoded certificate, as found in <name>.crt
+	PEMCert []byte
+	// PEMKey is the PEM encoded private key, as found in <name>.key: PKCS#1 for RSA,
+	// SEC 1 for ECDSA and PKCS#8 for Ed25519 keys
+	PEMKey []byte
+}
+
+// GenerateServiceCert creates a keypair and self-signed certificate for the
+// service humanName, in the same format as the certificates SCAMP services load from
+// /etc/GT_private/services. It is meant for local development and tests: the
+// certificate's fingerprint still has to be listed in authorized_services for other
+// services to trust its announcements.
+func GenerateServiceCert(humanName string, opts CertOptions) (cert *ServiceCert, err error) {
+	keyBits := opts.KeyBits
+	if keyBits == 0 {
+		keyBits = DefaultCertKeyBits
+	}
+	validFor := opts.ValidFor
+	if validFor == 0 {
+		validFor = DefaultCertValidity
+	}
+	if validFor < 0 {
+		err = fmt.Errorf("certificate validity must be positive, got %s", validFor)
+		return
+	}
+	notBefore := opts.NotBefore
+	if notBefore.IsZero() {
+		notBefore = time.Now()
+	}
+	subject := opts.Subject
+	if len(subject.CommonName) == 0 {
+		subject.CommonName = humanName
+	}
+
+	key, keyPEM, err := generateKey(opts.KeyType, keyBits)
+	if err != nil {
+		return
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		err = fmt.Errorf("could not generate serial number: %s", err)
+		return
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               subject,
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(validFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	for _, host := range opts.Hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		err = fmt.Errorf("could not create certificate: %s", err)
+		return
+	}
+
+	cert = new(ServiceCert)
+	cert.PEMCert = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	cert.PEMKey = keyPEM
+
+	cert.Keypair, err = tls.X509KeyPair(cert.PEMCert, cert.PEMKey)
+	if err != nil {
+		cert = nil
+		return
+	}
+
+	return
+}
+
+func generateKey(keyType string, keyBits int) (key crypto.Signer, keyPEM []byte, err error) {
+	var block *pem.Block
+	switch keyType {
+	case "", KeyTypeRSA:
+		var rsaKey *rsa.PrivateKey
+		rsaKey, err = rsa.GenerateKey(rand.Reader, keyBits)
+		if err != nil {
+			err = fmt.Errorf("could not generate %d bit RSA key: %s", keyBits, err)
+			return
+		}
+		key = rsaKey
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}
+	case KeyTypeECDSA:
+		var ecKey *ecdsa.PrivateKey
+		ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			err = fmt.Errorf("could not generate ECDSA key: %s", err)
+			return
+		}
+		var der []byte
+		der, err = x509.MarshalECPrivateKey(ecKey)
+		if err != nil {
+			return
+		}
+		key = ecKey
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	case KeyTypeEd25519:
+		var edKey ed25519.PrivateKey
+		_, edKey, err = ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			err = fmt.Errorf("could not generate Ed25519 key: %s", err)
+			return
+		}
+		var der []byte
+		der, err = x509.MarshalPKCS8PrivateKey(edKey)
+		if err != nil {
+			return
+		}
+		key = edKey
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	default:
+		err = fmt.Errorf("unknown key type `%s`", keyType)
+		return
+	}
+
+	keyPEM = pem.EncodeToMemory(block)
+	return
+}
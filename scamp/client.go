@@ -1,6 +1,9 @@
 package scamp
 
 import (
+	"crypto/tls"
+	"fmt"
+	u "net/url"
 	"sync"
 )
 
@@ -13,19 +16,28 @@ type Client struct {
 	requests        chan *Message
 	openReplies     map[int]chan *Message
 	openRepliesLock sync.Mutex
-	isClosed        bool
+	closed          bool
 	closedM         sync.Mutex
 	sendM           sync.Mutex
 	nextRequestID   int
-	spIdent         string
+	fingerprint     string
+	fingerprint256  string
+	closeHooksM     sync.Mutex
+	closeHooks      []func(*Client)
 }
 
 // Dial calls DialConnection to establish a secure (tls) connection,
 // and uses that connection to create a client
 func Dial(connspec string) (client *Client, err error) {
+	return DialWithCert(connspec, nil)
+}
+
+// DialWithCert is Dial presenting cert (typically the caller's own service certificate)
+// to the remote service
+func DialWithCert(connspec string, cert *tls.Certificate) (client *Client, err error) {
 	// Trace.Printf("Connecting to: `%s`", connspec)
 
-	conn, err := DialConnection(connspec)
+	conn, err := DialConnectionWithCert(connspec, cert)
 	if err != nil {
 		return
 	}
@@ -34,12 +46,46 @@ func Dial(connspec string) (client *Client, err error) {
 	return
 }
 
+// dialConnspec connects a client to the instance described by connspec, picking the
+// transport from its scheme. TLS connspecs that also name a Unix socket are dialed
+// over the socket when the instance runs on this host. cert, if not nil, is presented
+// on TLS connections.
+func dialConnspec(connspec string, cert *tls.Certificate) (client *Client, err error) {
+	url, err := u.Parse(connspec)
+	if err != nil {
+		return
+	}
+
+	switch url.Scheme {
+	case PipeConnspecScheme:
+		return dialPipe(url.Host)
+	case UnixConnspecScheme:
+		if !isLocalHost(url.Hostname()) {
+			err = fmt.Errorf("cannot dial `%s`: unix socket is on another host", connspec)
+			return
+		}
+		return dialUnix(url.Path)
+	}
+
+	if socketPath := url.Query().Get("unix"); len(socketPath) > 0 && isLocalHost(url.Hostname()) {
+		client, err = dialUnix(socketPath)
+		if err == nil {
+			return
+		}
+		Warning.Printf("could not use local socket `%s`, falling back to `%s`: %s", socketPath, url.Host, err)
+	}
+
+	return DialWithCert(url.Host, cert)
+}
+
 // NewClient takes a scamp connection and creates a new scamp client
 func NewClient(conn *Connection, clientType string) (client *Client) {
 	// Trace.Printf("client allocated")
 
 	client = new(Client)
 	client.conn = conn
+	client.fingerprint = conn.Fingerprint
+	client.fingerprint256 = conn.FingerprintSHA256
 	client.requests = make(chan *Message)
 	client.openReplies = make(map[int]chan *Message)
 	// clientID++
@@ -53,11 +99,23 @@ func NewClient(conn *Connection, clientType string) (client *Client) {
 
 	// grNum++
 	// go client.splitReqsAndReps(grNum, clientID)
-	go client.splitReqsAndReps()
+	go client.splitReqsAndReps(conn.msgs)
 
 	return
 }
 
+// Fingerprint is the SHA1 fingerprint of the certificate presented by the other end of
+// the connection: the service for dialed clients, the caller for clients handed to
+// service actions. It is empty when no certificate was presented.
+func (client *Client) Fingerprint() string {
+	return client.fingerprint
+}
+
+// FingerprintSHA256 is the SHA256 fingerprint of the same certificate as Fingerprint
+func (client *Client) FingerprintSHA256() string {
+	return client.fingerprint256
+}
+
 // SetService assigns a *Service to client.serv
 func (client *Client) SetService(serv *Service) {
 	client.serv = serv
@@ -72,40 +130,66 @@ func (client *Client) Send(msg *Message) (responseChan chan *Message, err error)
 
 	client.nextRequestID++
 	msg.RequestID = client.nextRequestID
-	err = client.conn.Send(msg)
-	if err != nil {
-		// Trace.Printf("SCAMP send error: %s", err)
-		return
-	}
 
+	// Register for the reply before sending so a fast reply can't beat us to the map
 	if msg.MessageType == MessageTypeRequest {
 		// Trace.Printf("sending request so waiting for reply")
-		responseChan = make(chan *Message)
+		// buffered so a reply nobody waits for anymore can't block splitReqsAndReps
+		responseChan = make(chan *Message, 1)
 		client.openRepliesLock.Lock()
 		client.openReplies[msg.RequestID] = responseChan
 		client.openRepliesLock.Unlock()
-	} else {
-		// Trace.Printf("sending reply so done with this message")
+	}
+
+	err = client.conn.Send(msg)
+	if err != nil {
+		// Trace.Printf("SCAMP send error: %s", err)
+		if responseChan != nil {
+			client.openRepliesLock.Lock()
+			delete(client.openReplies, msg.RequestID)
+			client.openRepliesLock.Unlock()
+			responseChan = nil
+		}
+		return
 	}
 
 	return
 }
 
-// Close unlocks a client mutex and closes the connection
-func (client *Client) Close() {
-	if len(client.spIdent) > 0 {
-		sp := DefaultCache.Retrieve(client.spIdent)
-		if sp != nil {
-			sp.client = nil
-		}
+// abandonReply forgets the reply channel of a request the caller stopped waiting for,
+// so a late reply is dropped
+func (client *Client) abandonReply(requestID int) {
+	client.openRepliesLock.Lock()
+	delete(client.openReplies, requestID)
+	client.openRepliesLock.Unlock()
+}
+
+// OnClose registers a hook run once when the client closes. Whatever owns the client
+// (a pool, a service proxy) uses it to forget the client. If the client is already
+// closed the hook runs immediately.
+func (client *Client) OnClose(hook func(*Client)) {
+	client.closeHooksM.Lock()
+	closed := client.isClosed()
+	if !closed {
+		client.closeHooks = append(client.closeHooks, hook)
+	}
+	client.closeHooksM.Unlock()
+
+	if closed {
+		hook(client)
 	}
+}
 
+// Close unlocks a client mutex and closes the connection
+func (client *Client) Close() {
 	client.closedM.Lock()
-	defer client.closedM.Unlock()
-	if client.isClosed {
+	if client.closed {
 		// Trace.Printf("client already closed. skipping shutdown.")
+		client.closedM.Unlock()
 		return
 	}
+	defer client.runCloseHooks()
+	defer client.closedM.Unlock()
 
 	// Trace.Printf("closing client...")
 	// Trace.Printf("closing client conn...")
@@ -118,7 +202,25 @@ func (client *Client) Close() {
 	}
 
 	// Trace.Printf("marking client as closed...")
-	client.isClosed = true
+	client.closed = true
+}
+
+// isClosed reports whether Close has been called
+func (client *Client) isClosed() bool {
+	client.closedM.Lock()
+	defer client.closedM.Unlock()
+	return client.closed
+}
+
+func (client *Client) runCloseHooks() {
+	client.closeHooksM.Lock()
+	hooks := client.closeHooks
+	client.closeHooks = nil
+	client.closeHooksM.Unlock()
+
+	for _, hook := range hooks {
+		hook(client)
+	}
 }
 
 // closeConnection calls client.conn.Close() and sets the client.conn to nil
@@ -130,14 +232,15 @@ func (client *Client) closeConnection(conn *Connection) {
 }
 
 //func (client *Client) splitReqsAndReps(grNum, clientID int) (err error) {
-func (client *Client) splitReqsAndReps() (err error) {
+// msgs is passed in rather than read off client.conn, which Close sets to nil
+func (client *Client) splitReqsAndReps(msgs chan *Message) (err error) {
 	var replyChan chan *Message
 
 forLoop:
 	for {
 		// Trace.Printf("Entering forLoop splitReqsAndReps")
 		select {
-		case message, ok := <-client.conn.msgs:
+		case message, ok := <-msgs:
 			if !ok {
 				// Trace.Printf("client.conn.msgs... CLOSED!")
 				break forLoop
@@ -179,7 +282,7 @@ forLoop:
 		close(openReplyChan)
 	}
 	client.openRepliesLock.Unlock()
-	if !client.isClosed {
+	if !client.isClosed() {
 		client.Close()
 	}
 
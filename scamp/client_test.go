@@ -0,0 +1,158 @@
+package scamp
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipeClients wires a requester-side and a service-side Client together over an
+// in-memory TLS connection
+func pipeClients(t *testing.T) (requester *Client, service *Client) {
+	cert, err := tls.LoadX509KeyPair("../fixtures/sample.crt", "../fixtures/sample.key")
+	if err != nil {
+		t.Fatalf("could not load fixture keypair: `%s`", err)
+	}
+
+	clientSide, serviceSide := net.Pipe()
+	clientConn := tls.Client(clientSide, &tls.Config{InsecureSkipVerify: true})
+	serviceConn := tls.Server(serviceSide, &tls.Config{Certificates: []tls.Certificate{cert}})
+
+	requester = NewClient(NewConnection(clientConn, "client"), "test")
+	service = NewClient(NewConnection(serviceConn, "service"), "test")
+	return
+}
+
+func TestClientWithoutCache(t *testing.T) {
+	initSCAMPLogger()
+	DefaultCache = nil
+
+	requester, service := pipeClients(t)
+	defer service.Close()
+
+	request := NewRequestMessage()
+	request.SetAction("Logger.info")
+	request.SetEnvelope(EnvelopeJSON)
+	request.Write([]byte(`{"hello":"world"}`))
+
+	responseChan, err := requester.Send(request)
+	if err != nil {
+		t.Fatalf("could not send request: `%s`", err)
+	}
+
+	select {
+	case incoming := <-service.Incoming():
+		reply := NewResponseMessage()
+		reply.SetEnvelope(EnvelopeJSON)
+		reply.SetRequestID(incoming.RequestID)
+		reply.Write(incoming.Bytes())
+		_, err = service.Send(reply)
+		if err != nil {
+			t.Fatalf("could not send reply: `%s`", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for request")
+	}
+
+	select {
+	case reply := <-responseChan:
+		if string(reply.Bytes()) != `{"hello":"world"}` {
+			t.Fatalf("unexpected reply `%s`", reply.Bytes())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for reply")
+	}
+
+	closed := 0
+	requester.OnClose(func(*Client) { closed++ })
+	requester.Close()
+	requester.Close()
+	if closed != 1 {
+		t.Fatalf("expected close hook to run once, ran %d times", closed)
+	}
+
+	late := false
+	requester.OnClose(func(*Client) { late = true })
+	if !late {
+		t.Fatalf("hooks registered after close should run immediately")
+	}
+}
+
+func TestClientPoolForgetsClosedClients(t *testing.T) {
+	initSCAMPLogger()
+
+	requester, service := pipeClients(t)
+	defer service.Close()
+
+	pool := newClientPool()
+	pool.clients["bob"] = requester
+	requester.OnClose(func(closed *Client) {
+		pool.forget("bob", closed)
+	})
+
+	requester.Close()
+	if _, ok := pool.clients["bob"]; ok {
+		t.Fatalf("pool still holds a closed client")
+	}
+}
+
+func TestClientPoolDialsOutsideLock(t *testing.T) {
+	initSCAMPLogger()
+
+	listener, err := NewPipeListener("pooled-echo")
+	if err != nil {
+		t.Fatalf("could not listen: `%s`", err)
+	}
+	serv := newEchoService(t, listener)
+	go serv.Run()
+	defer serv.Stop()
+
+	pool := newClientPool()
+	defer pool.closeAll()
+
+	// accepts TCP connections but never answers the TLS handshake. Closed first, which
+	// fails the stuck dial.
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: `%s`", err)
+	}
+	defer silent.Close()
+	stuck := &ServiceInstance{ident: "stuck", connspec: "beepish+tls://" + silent.Addr().String()}
+	echo := &ServiceInstance{ident: "echo", connspec: listener.Connspec()}
+
+	go pool.get(stuck)
+	time.Sleep(50 * time.Millisecond)
+
+	// concurrent gets of one instance while another is still dialing share a client
+	clients := make([]*Client, 10)
+	var wg sync.WaitGroup
+	for i := range clients {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			clients[i], _ = pool.get(echo)
+		}(i)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("a slow dial held up the other instances")
+	}
+
+	pooled, _ := pool.pooled("echo")
+	if pooled == nil {
+		t.Fatalf("expected a pooled client")
+	}
+	for _, client := range clients {
+		if client != pooled {
+			t.Fatalf("expected every get to return the pooled client")
+		}
+	}
+}
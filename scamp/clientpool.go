@@ -0,0 +1,149 @@
+package scamp
+
+import (
+	"crypto/tls"
+	"sync"
+	"sync/atomic"
+)
+
+// clientPool holds one client per service instance for a single requester
+type clientPool struct {
+	clientsM sync.Mutex
+	clients  map[string]*Client
+	// cert is presented to services when dialing, if set
+	cert *tls.Certificate
+}
+
+func newClientPool() (pool *clientPool) {
+	pool = new(clientPool)
+	pool.clients = make(map[string]*Client)
+
+	return
+}
+
+// get returns the pooled client for sp, dialing a new one if there is none or the
+// previous one was closed. Dialing happens outside the lock so a slow instance doesn't
+// hold up requests to the others.
+func (pool *clientPool) get(sp *ServiceInstance) (client *Client, err error) {
+	client, cert := pool.pooled(sp.ident)
+	if client != nil {
+		return
+	}
+
+	dialed, err := dialConnspec(sp.connspec, cert)
+	if err != nil {
+		return nil, err
+	}
+
+	pool.clientsM.Lock()
+	client = pool.clients[sp.ident]
+	if client != nil && !client.isClosed() {
+		// another request dialed the instance first
+		pool.clientsM.Unlock()
+		dialed.Close()
+		return
+	}
+	client = dialed
+	pool.clients[sp.ident] = client
+	pool.clientsM.Unlock()
+
+	// registered outside the lock: the hook runs right away if the client already died
+	ident := sp.ident
+	client.OnClose(func(closed *Client) {
+		pool.forget(ident, closed)
+	})
+
+	return
+}
+
+// pooled returns the open client pooled for ident, if any, and the certificate to dial
+// a new one with
+func (pool *clientPool) pooled(ident string) (client *Client, cert *tls.Certificate) {
+	pool.clientsM.Lock()
+	defer pool.clientsM.Unlock()
+
+	cert = pool.cert
+	client = pool.clients[ident]
+	if client != nil && client.isClosed() {
+		client = nil
+	}
+	return
+}
+
+// forget drops client from the pool if it is still the one pooled for ident
+func (pool *clientPool) forget(ident string, client *Client) {
+	pool.clientsM.Lock()
+	defer pool.clientsM.Unlock()
+
+	if pool.clients[ident] == client {
+		delete(pool.clients, ident)
+	}
+}
+
+func (pool *clientPool) closeAll() {
+	pool.clientsM.Lock()
+	clients := pool.clients
+	pool.clients = make(map[string]*Client)
+	pool.clientsM.Unlock()
+
+	// close outside the lock; the close hooks call back into forget
+	for _, client := range clients {
+		client.Close()
+	}
+}
+
+// closeRevoked closes the pooled clients whose service presented a certificate on rl
+func (pool *clientPool) closeRevoked(rl *RevocationList) {
+	pool.clientsM.Lock()
+	var revoked []*Client
+	for ident, client := range pool.clients {
+		if rl.RevokedClient(client) {
+			revoked = append(revoked, client)
+			delete(pool.clients, ident)
+		}
+	}
+	pool.clientsM.Unlock()
+
+	for _, client := range revoked {
+		client.Close()
+	}
+}
+
+// balancer decides the order in which instances are tried for a request
+type balancer interface {
+	order(instances []*ServiceInstance) []*ServiceInstance
+}
+
+// roundRobinBalancer rotates the starting instance on every request, starting with
+// each instance in proportion to its weight. Instances with weight 0 are draining and
+// left out.
+type roundRobinBalancer struct {
+	next uint64
+}
+
+func (rr *roundRobinBalancer) order(instances []*ServiceInstance) (ordered []*ServiceInstance) {
+	weighted := make([]*ServiceInstance, 0, len(instances))
+	total := uint64(0)
+	for _, instance := range instances {
+		if instance.Weight() > 0 {
+			weighted = append(weighted, instance)
+			total += uint64(instance.Weight())
+		}
+	}
+	if total == 0 {
+		return
+	}
+
+	pick := (atomic.AddUint64(&rr.next, 1) - 1) % total
+	start := 0
+	for pick >= uint64(weighted[start].Weight()) {
+		pick -= uint64(weighted[start].Weight())
+		start++
+	}
+
+	ordered = make([]*ServiceInstance, 0, len(weighted))
+	ordered = append(ordered, weighted[start:]...)
+	ordered = append(ordered, weighted[:start]...)
+
+	return
+}
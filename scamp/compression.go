@@ -0,0 +1,179 @@
+package scamp
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Body compression is opt-in and negotiated per message so peers that don't know about it
+// never see a compressed body:
+//
+//   - a requester lists the algorithms it can read in the request's `accept_compression` header
+//   - a service may then compress its reply, naming the algorithm in the reply's `compression` header
+//
+// Requests are only compressed when the caller explicitly sets msg.Compression, i.e. when it
+// knows the service understands it.
+
+const (
+	// CompressionGzip compresses message bodies with gzip
+	CompressionGzip = "gzip"
+	// CompressionDeflate compresses message bodies with raw deflate
+	CompressionDeflate = "deflate"
+)
+
+// CompressionThreshold is the body size in bytes below which messages are sent uncompressed
+// even when compression was requested.
+var CompressionThreshold = 4 * 1024
+
+// MaxDecompressedSize is the largest body in bytes a compressed message may inflate to.
+// Larger bodies are refused rather than read into memory.
+var MaxDecompressedSize = 64 << 20
+
+type compressor struct {
+	compress   func(io.Writer) (io.WriteCloser, error)
+	decompress func(io.Reader) (io.ReadCloser, error)
+}
+
+var compressors = map[string]compressor{
+	CompressionGzip: compressor{
+		compress: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		decompress: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	CompressionDeflate: compressor{
+		compress: func(w io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(w, flate.DefaultCompression)
+		},
+		decompress: func(r io.Reader) (io.ReadCloser, error) {
+			return flate.NewReader(r), nil
+		},
+	},
+}
+
+func compressBody(algorithm string, body []byte) (compressed []byte, err error) {
+	c, ok := compressors[algorithm]
+	if !ok {
+		err = fmt.Errorf("unknown compression `%s`", algorithm)
+		return
+	}
+
+	var buf bytes.Buffer
+	w, err := c.compress(&buf)
+	if err != nil {
+		return
+	}
+	_, err = w.Write(body)
+	if err != nil {
+		return
+	}
+	err = w.Close()
+	if err != nil {
+		return
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decompressBody(algorithm string, body []byte) (decompressed []byte, err error) {
+	c, ok := compressors[algorithm]
+	if !ok {
+		err = fmt.Errorf("unknown compression `%s`", algorithm)
+		return
+	}
+
+	r, err := c.decompress(bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	limit := MaxDecompressedSize
+	decompressed, err = ioutil.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return
+	}
+	if len(decompressed) > limit {
+		err = fmt.Errorf("%s body inflates to more than %d bytes", algorithm, limit)
+		decompressed = nil
+	}
+	return
+}
+
+// supportedCompressions is the `accept_compression` value for everything this package can read
+func supportedCompressions() string {
+	return strings.Join([]string{CompressionGzip, CompressionDeflate}, ",")
+}
+
+// SetCompression asks for the message body to be compressed with algorithm when it is sent.
+// Bodies smaller than CompressionThreshold are still sent uncompressed.
+func (msg *Message) SetCompression(algorithm string) (err error) {
+	if _, ok := compressors[algorithm]; !ok && len(algorithm) > 0 {
+		err = fmt.Errorf("unknown compression `%s`", algorithm)
+		return
+	}
+
+	msg.Compression = algorithm
+	return
+}
+
+// SetAcceptCompression advertises that replies to this request may be compressed with any of
+// the algorithms this package supports.
+func (msg *Message) SetAcceptCompression() {
+	msg.AcceptCompression = supportedCompressions()
+}
+
+// SetCompressionFor compresses the message (a reply) with the first algorithm accepted by the
+// request it answers, if any.
+func (msg *Message) SetCompressionFor(request *Message) {
+	for _, algorithm := range strings.Split(request.AcceptCompression, ",") {
+		algorithm = strings.TrimSpace(algorithm)
+		if _, ok := compressors[algorithm]; ok {
+			msg.Compression = algorithm
+			return
+		}
+	}
+}
+
+// wireBody returns the DATA packets to send and the compression actually applied to them
+func (msg *Message) wireBody() (packets []*Packet, compression string, err error) {
+	if len(msg.Compression) == 0 || msg.bytesWritten < uint64(CompressionThreshold) {
+		return msg.packets, "", nil
+	}
+
+	compressed, err := compressBody(msg.Compression, msg.Bytes())
+	if err != nil {
+		return
+	}
+
+	wire := NewMessage()
+	wire.writeChunked(compressed)
+
+	return wire.packets, msg.Compression, nil
+}
+
+// decompress replaces a received compressed body with its decompressed contents
+func (msg *Message) decompress() (err error) {
+	if len(msg.Compression) == 0 {
+		return
+	}
+
+	body, err := decompressBody(msg.Compression, msg.Bytes())
+	if err != nil {
+		return
+	}
+
+	msg.packets = nil
+	msg.bytesWritten = 0
+	msg.Compression = ""
+	msg.writeChunked(body)
+
+	return
+}
@@ -0,0 +1,204 @@
+package scamp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func routeThroughTestConnection(t *testing.T, packets []*Packet) (msg *Message) {
+	var sink bytes.Buffer
+	conn := &Connection{
+		readWriter: bufio.NewReadWriter(bufio.NewReader(new(bytes.Buffer)), bufio.NewWriter(&sink)),
+		pktToMsg:   make(map[incomingMsgNo](*Message)),
+		msgs:       make(chan *Message, 1),
+	}
+
+	for _, pkt := range packets {
+		// round trip the packet through the wire format like packetReader would
+		var wire bytes.Buffer
+		_, err := pkt.Write(&wire)
+		if err != nil {
+			t.Fatalf("could not write packet: `%s`", err)
+		}
+		read, err := ReadPacket(bufio.NewReadWriter(bufio.NewReader(&wire), nil))
+		if err != nil {
+			t.Fatalf("could not read packet: `%s`", err)
+		}
+
+		err = conn.routePacket(read)
+		if err != nil {
+			t.Fatalf("could not route packet: `%s`", err)
+		}
+	}
+
+	return <-conn.msgs
+}
+
+func TestCompressedMessageRoundTrip(t *testing.T) {
+	body := bytes.Repeat([]byte(`{"sku":"ABC-123","qty":1},`), 1000)
+
+	msg := NewResponseMessage()
+	msg.SetEnvelope(EnvelopeJSON)
+	msg.SetRequestID(1)
+	msg.Write(body)
+	err := msg.SetCompression(CompressionGzip)
+	if err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+
+	packets, err := msg.toPackets(0)
+	if err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+	if packets[0].packetHeader.Compression != CompressionGzip {
+		t.Fatalf("expected the header to announce gzip, got `%s`", packets[0].packetHeader.Compression)
+	}
+	if len(packets[1].body) >= len(body) {
+		t.Fatalf("body was not compressed (%d bytes)", len(packets[1].body))
+	}
+
+	received := routeThroughTestConnection(t, packets)
+	if !bytes.Equal(received.Bytes(), body) {
+		t.Fatalf("decompressed body did not match")
+	}
+	if len(received.Compression) != 0 || len(received.Error) != 0 {
+		t.Fatalf("unexpected compression `%s` / error `%s` after delivery", received.Compression, received.Error)
+	}
+}
+
+func TestDecompressedSizeIsBounded(t *testing.T) {
+	defer func(limit int) { MaxDecompressedSize = limit }(MaxDecompressedSize)
+	MaxDecompressedSize = 1024
+
+	for _, algorithm := range []string{CompressionGzip, CompressionDeflate} {
+		compressed, err := compressBody(algorithm, make([]byte, MaxDecompressedSize))
+		if err != nil {
+			t.Fatalf("unexpected error: `%s`", err)
+		}
+		if _, err = decompressBody(algorithm, compressed); err != nil {
+			t.Fatalf("a body of MaxDecompressedSize should inflate: `%s`", err)
+		}
+
+		compressed, err = compressBody(algorithm, make([]byte, MaxDecompressedSize+1))
+		if err != nil {
+			t.Fatalf("unexpected error: `%s`", err)
+		}
+		if _, err = decompressBody(algorithm, compressed); err == nil {
+			t.Fatalf("expected %s bodies over MaxDecompressedSize to be refused", algorithm)
+		}
+	}
+}
+
+func TestSmallMessagesSkipCompression(t *testing.T) {
+	msg := NewResponseMessage()
+	msg.Write([]byte(`{"ok":true}`))
+	msg.SetCompression(CompressionDeflate)
+
+	packets, err := msg.toPackets(0)
+	if err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+	if len(packets[0].packetHeader.Compression) != 0 {
+		t.Fatalf("bodies below CompressionThreshold should not be compressed")
+	}
+	if !bytes.Equal(packets[1].body, []byte(`{"ok":true}`)) {
+		t.Fatalf("small body was modified: `%s`", packets[1].body)
+	}
+}
+
+func TestSetCompressionFor(t *testing.T) {
+	request := NewRequestMessage()
+	reply := NewResponseMessage()
+
+	reply.SetCompressionFor(request)
+	if len(reply.Compression) != 0 {
+		t.Fatalf("replies must not be compressed unless the request accepts it")
+	}
+
+	request.AcceptCompression = "zstd, deflate"
+	reply.SetCompressionFor(request)
+	if reply.Compression != CompressionDeflate {
+		t.Fatalf("expected deflate, got `%s`", reply.Compression)
+	}
+
+	if reply.SetCompression("zstd") == nil {
+		t.Fatalf("expected an error for an unknown algorithm")
+	}
+}
+
+// garbageWriter stands in for a compressor producing a body that doesn't inflate
+type garbageWriter struct{ io.Writer }
+
+func (w garbageWriter) Write(p []byte) (int, error) {
+	w.Writer.Write(bytes.Repeat([]byte{0xff}, 16))
+	return len(p), nil
+}
+
+func (w garbageWriter) Close() error { return nil }
+
+func TestCorruptRequestBodyIsRefused(t *testing.T) {
+	initSCAMPLogger()
+
+	listener, err := NewPipeListener("corrupt-body")
+	if err != nil {
+		t.Fatalf("could not listen: `%s`", err)
+	}
+	serv, err := NewServiceWithListener("main", "corrupt", listener)
+	if err != nil {
+		t.Fatalf("could not create service: `%s`", err)
+	}
+	called := make(chan bool, 1)
+	serv.Register("Echo.echo", func(msg *Message, client *Client) {
+		called <- true
+		reply := NewResponseMessage()
+		reply.SetEnvelope(EnvelopeJSON)
+		reply.SetRequestID(msg.RequestID)
+		client.Send(reply)
+	})
+	go serv.Run()
+	defer serv.Stop()
+
+	// swapped before anything reads the compressors: only the sender uses it
+	real := compressors[CompressionDeflate]
+	compressors[CompressionDeflate] = compressor{
+		compress: func(w io.Writer) (io.WriteCloser, error) {
+			return garbageWriter{w}, nil
+		},
+		decompress: real.decompress,
+	}
+	defer func() { compressors[CompressionDeflate] = real }()
+
+	client, err := dialConnspec(listener.Connspec(), nil)
+	if err != nil {
+		t.Fatalf("could not dial: `%s`", err)
+	}
+	defer client.Close()
+
+	request := NewRequestMessage()
+	request.SetAction("Echo.echo")
+	request.SetEnvelope(EnvelopeJSON)
+	request.Write(bytes.Repeat([]byte(" "), CompressionThreshold))
+	request.SetCompression(CompressionDeflate)
+	replies, err := client.Send(request)
+	if err != nil {
+		t.Fatalf("could not send request: `%s`", err)
+	}
+
+	select {
+	case reply := <-replies:
+		if len(reply.Error) == 0 {
+			t.Fatalf("expected an error reply for a body that doesn't decompress")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no reply received")
+	}
+	select {
+	case <-called:
+		t.Fatalf("the action was called with a body that doesn't decompress")
+	default:
+	}
+}
+
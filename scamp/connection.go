@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"fmt"
 	"io"
+	"net"
 
 	"strings"
 	"sync"
@@ -16,29 +17,40 @@ type outgoingMsgNo uint64
 
 // Connection a scamp connection
 type Connection struct {
-	conn           *tls.Conn
-	Fingerprint    string
-	readWriter     *bufio.ReadWriter
-	readWriterLock sync.Mutex
-	incomingmsgno  incomingMsgNo
-	outgoingmsgno  outgoingMsgNo
-	pktToMsg       map[incomingMsgNo](*Message)
-	msgs           chan *Message
-	client         *Client
-	isClosed       bool
-	closedMutex    sync.Mutex
-	scampDebugger  *scampDebugger
+	conn        net.Conn
+	Fingerprint string
+	// FingerprintSHA256 is the SHA256 fingerprint of the same certificate as Fingerprint
+	FingerprintSHA256 string
+	readWriter        *bufio.ReadWriter
+	readWriterLock    sync.Mutex
+	incomingmsgno     incomingMsgNo
+	outgoingmsgno     outgoingMsgNo
+	pktToMsg          map[incomingMsgNo](*Message)
+	msgs              chan *Message
+	client            *Client
+	isClosed          bool
+	closedMutex       sync.Mutex
+	scampDebugger     *scampDebugger
 }
 
 // DialConnection Used by Client to establish a secure connection to the remote service.
 // TODO: You must use the *connection.Fingerprint to verify the
 // remote host
 func DialConnection(connspec string) (conn *Connection, err error) {
+	return DialConnectionWithCert(connspec, nil)
+}
+
+// DialConnectionWithCert is DialConnection presenting cert to the remote service, so
+// services that require client certificates can identify the caller. A nil cert
+// presents none.
+func DialConnectionWithCert(connspec string, cert *tls.Certificate) (conn *Connection, err error) {
 	// Trace.Printf("Dialing connection to `%s`", connspec)
 	config := &tls.Config{
 		InsecureSkipVerify: true,
 	}
-	config.BuildNameToCertificate()
+	if cert != nil {
+		config.Certificates = []tls.Certificate{*cert}
+	}
 
 	tlsConn, err := tls.Dial("tcp", connspec, config)
 	if err != nil {
@@ -49,16 +61,20 @@ func DialConnection(connspec string) (conn *Connection, err error) {
 	return
 }
 
-// NewConnection Used by Service
-func NewConnection(tlsConn *tls.Conn, connType string) (conn *Connection) {
+// NewConnection Used by Service. netConn is normally a *tls.Conn whose handshake is done,
+// and Fingerprint is that of the certificate presented by the other end, if any. Any
+// other net.Conn (e.g. one end of a PipeListener) is used as is and has no Fingerprint.
+func NewConnection(netConn net.Conn, connType string) (conn *Connection) {
 	conn = new(Connection)
-	conn.conn = tlsConn
-
-	// TODO get the end entity certificate instead
-	peerCerts := conn.conn.ConnectionState().PeerCertificates
-	if len(peerCerts) == 1 {
-		peerCert := peerCerts[0]
-		conn.Fingerprint = sha1FingerPrint(peerCert)
+	conn.conn = netConn
+
+	if tlsConn, ok := netConn.(*tls.Conn); ok {
+		// the first certificate is the end entity one
+		peerCerts := tlsConn.ConnectionState().PeerCertificates
+		if len(peerCerts) > 0 {
+			conn.Fingerprint = sha1FingerPrint(peerCerts[0])
+			conn.FingerprintSHA256 = sha256FingerPrint(peerCerts[0])
+		}
 	}
 
 	var reader io.Reader = conn.conn
@@ -169,6 +185,8 @@ func (conn *Connection) routePacket(pkt *Packet) (err error) {
 		msg.SetError(pkt.packetHeader.Error)
 		msg.SetErrorCode(pkt.packetHeader.ErrorCode)
 		msg.SetTicket(pkt.packetHeader.Ticket)
+		msg.Compression = pkt.packetHeader.Compression
+		msg.AcceptCompression = pkt.packetHeader.AcceptCompression
 		// TODO: Do we need the requestId?
 
 		conn.pktToMsg[incomingMsgNo(pkt.msgNo)] = msg
@@ -199,6 +217,14 @@ func (conn *Connection) routePacket(pkt *Packet) (err error) {
 		}
 
 		delete(conn.pktToMsg, incomingMsgNo(pkt.msgNo))
+
+		decompressErr := msg.decompress()
+		if decompressErr != nil {
+			Error.Printf("could not decompress msgno %d: `%s`", pkt.msgNo, decompressErr)
+			msg.bodyErr = decompressErr
+			msg.SetError(fmt.Sprintf("could not decompress body: %s", decompressErr))
+			msg.SetErrorCode(defaultErrorCode)
+		}
 		// Trace.Printf("Delivering message number %d up the stack", pkt.msgNo)
 		// Trace.Printf("Adding message to channel:")
 		conn.msgs <- msg
@@ -253,7 +279,12 @@ func (conn *Connection) Send(msg *Message) (err error) {
 
 	// Trace.Printf("sending msgno %d", outgoingmsgno)
 
-	for _, pkt := range msg.toPackets(outgoingmsgno) {
+	packets, err := msg.toPackets(outgoingmsgno)
+	if err != nil {
+		return
+	}
+
+	for _, pkt := range packets {
 		// Trace.Printf("sending pkt %d", i)
 
 		retries := 0
@@ -11,8 +11,8 @@ import (
 	"bytes"
 
 	"crypto/rand"
-	"crypto/tls"
 	"encoding/base64"
+	"net"
 
 	"sync/atomic"
 )
@@ -29,7 +29,7 @@ type scampDebugger struct {
 
 var scampDebuggerID = uint64(0)
 
-func newScampDebugger(conn *tls.Conn, clientType string) (handle *scampDebugger, err error) {
+func newScampDebugger(conn net.Conn, clientType string) (handle *scampDebugger, err error) {
 	worked := false
 	var thisDebuggerID uint64
 
@@ -1,76 +1,400 @@
 package scamp
 
+import "bytes"
+import "compress/zlib"
+import "context"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "math/rand"
+import "strconv"
+import "sync"
 import "time"
 import "net"
 
 import "golang.org/x/net/ipv4"
 
-// DiscoveryAnnouncer ... TODO: godoc
+// DefaultMaxAnnounceSize is the largest announce packet DiscoveryAnnouncer sends: the
+// most a UDP datagram over IPv4 can carry
+var DefaultMaxAnnounceSize = 65507
+
+// maxAnnounceRecordSize bounds the size of decompressed announce packets
+const maxAnnounceRecordSize = 16 << 20
+
+// DiscoveryAnnouncer multicasts the announcements of the services it tracks, so
+// discovery can find them. Services may be tracked and untracked at any time.
 type DiscoveryAnnouncer struct {
-	services      []*Service
 	multicastConn *ipv4.PacketConn
 	multicastDest *net.UDPAddr
-	stopSig       (chan bool)
+
+	// sendM is held while announcing a tracked service and by Untrack, so no regular
+	// announcement follows the final one
+	sendM sync.Mutex
+
+	// announcerM guards everything below
+	announcerM    sync.Mutex
+	services      []*Service
+	nextAnnounce  map[*Service]time.Time
+	compress      bool
+	extensionOnly bool
+	maxSize       int
+	errorHooks    []func(*Service, error)
+	// wake interrupts Run's wait when a service is tracked
+	wake chan struct{}
+
+	// stop and done belong to AnnounceLoop
+	stop    context.CancelFunc
+	stopCtx context.Context
+	done    chan struct{}
+	running bool
+}
+
+// AnnounceTooLargeError is returned for services whose announce packet is larger than
+// the announcer's maximum packet size, even with the configured encodings
+type AnnounceTooLargeError struct {
+	Service string
+	Size    int
+	Max     int
+}
+
+func (err *AnnounceTooLargeError) Error() string {
+	return fmt.Sprintf("announcement of `%s` is %d bytes, more than the %d that fit in an announce packet", err.Service, err.Size, err.Max)
 }
 
 // NewDiscoveryAnnouncer creates a DiscoveryAnnouncer
 func NewDiscoveryAnnouncer() (announcer *DiscoveryAnnouncer, err error) {
-	announcer = new(DiscoveryAnnouncer)
-	announcer.services = make([]*Service, 0, 0)
-	announcer.stopSig = make(chan bool)
-
 	config := DefaultConfig()
-	announcer.multicastDest = &net.UDPAddr{IP: config.DiscoveryMulticastIP(), Port: config.DiscoveryMulticastPort()}
-	// announcer.multicastDest = &net.UDPAddr{IP: 127.0.0.1, Port: config.DiscoveryMulticastPort()}
-	announcer.multicastConn, err = localMulticastPacketConn()
+	compress, err := configBool(config, "discovery.announce_compress")
+	if err != nil {
+		return
+	}
+	extensionOnly, err := configBool(config, "discovery.announce_v4")
+	if err != nil {
+		return
+	}
+	multicastDest := &net.UDPAddr{IP: config.DiscoveryMulticastIP(), Port: config.DiscoveryMulticastPort()}
+	// multicastDest = &net.UDPAddr{IP: 127.0.0.1, Port: config.DiscoveryMulticastPort()}
+	multicastConn, err := localMulticastPacketConn()
 	if err != nil {
 		return
 	}
 
+	announcer = newDiscoveryAnnouncer(multicastConn, multicastDest)
+	announcer.compress = compress
+	announcer.extensionOnly = extensionOnly
 	return
 }
 
-// Stop notifies stopSig channel to stop announcer
-func (announcer *DiscoveryAnnouncer) Stop() {
-	announcer.stopSig <- true
+func newDiscoveryAnnouncer(multicastConn *ipv4.PacketConn, multicastDest *net.UDPAddr) (announcer *DiscoveryAnnouncer) {
+	announcer = new(DiscoveryAnnouncer)
+	announcer.multicastConn = multicastConn
+	announcer.multicastDest = multicastDest
+	announcer.services = make([]*Service, 0, 0)
+	announcer.nextAnnounce = make(map[*Service]time.Time)
+	announcer.wake = make(chan struct{}, 1)
+	announcer.stopCtx, announcer.stop = context.WithCancel(context.Background())
+	announcer.done = make(chan struct{})
+	announcer.maxSize = DefaultMaxAnnounceSize
+	return
 }
 
-// Track indicates that announcer should track and announce service
+// configBool reads an optional true/false setting, which defaults to false
+func configBool(conf *Config, key string) (value bool, err error) {
+	raw, ok := conf.Get(key)
+	if !ok {
+		return
+	}
+	value, err = strconv.ParseBool(raw)
+	if err != nil {
+		err = fmt.Errorf("bad `%s` `%s`: expected true or false", key, raw)
+	}
+	return
+}
+
+// SetCompression makes the announcer zlib-compress its packets, as other SCAMP
+// implementations do. Listeners accept both compressed and plain packets.
+func (announcer *DiscoveryAnnouncer) SetCompression(compress bool) {
+	announcer.announcerM.Lock()
+	defer announcer.announcerM.Unlock()
+	announcer.compress = compress
+}
+
+// SetExtensionEncoding makes the announcer describe every action in the v4 discovery
+// extension, which is much smaller than the v3 class records for services with many
+// actions
+func (announcer *DiscoveryAnnouncer) SetExtensionEncoding(extensionOnly bool) {
+	announcer.announcerM.Lock()
+	defer announcer.announcerM.Unlock()
+	announcer.extensionOnly = extensionOnly
+}
+
+// SetMaxPacketSize sets the largest packet the announcer sends. Larger announcements
+// fail with an AnnounceTooLargeError.
+func (announcer *DiscoveryAnnouncer) SetMaxPacketSize(size int) {
+	announcer.announcerM.Lock()
+	defer announcer.announcerM.Unlock()
+	announcer.maxSize = size
+}
+
+// OnError registers hook to be told about every failed announcement, along with the
+// service it was for. Failures are logged either way.
+func (announcer *DiscoveryAnnouncer) OnError(hook func(serv *Service, err error)) {
+	announcer.announcerM.Lock()
+	defer announcer.announcerM.Unlock()
+	announcer.errorHooks = append(announcer.errorHooks, hook)
+}
+
+// Track starts announcing serv. The first announcement is sent right away if the
+// announcer is running. Tracking a service twice has no effect.
 func (announcer *DiscoveryAnnouncer) Track(serv *Service) {
+	announcer.announcerM.Lock()
+	defer announcer.announcerM.Unlock()
+
+	for _, tracked := range announcer.services {
+		if tracked == serv {
+			return
+		}
+	}
 	announcer.services = append(announcer.services, serv)
+	announcer.nextAnnounce[serv] = time.Time{}
+
+	select {
+	case announcer.wake <- struct{}{}:
+	default:
+	}
 }
 
-// AnnounceLoop runs service announceloop and runs announcer.doAnnounce() at time
-// interval configured in defaultAnnounceInterval
-// TODO: make defaultAnnounceInterval configurable in the service (rather than hardcoded in scamp)
-func (announcer *DiscoveryAnnouncer) AnnounceLoop() {
-	// Trace.Printf("starting announcer loop")
+// Untrack stops announcing serv, after a final announcement with weight 0 telling
+// discovery to stop sending it requests
+func (announcer *DiscoveryAnnouncer) Untrack(serv *Service) (err error) {
+	announcer.sendM.Lock()
+	defer announcer.sendM.Unlock()
 
+	announcer.announcerM.Lock()
+	tracked := false
+	for i, candidate := range announcer.services {
+		if candidate == serv {
+			announcer.services = append(announcer.services[:i:i], announcer.services[i+1:]...)
+			tracked = true
+			break
+		}
+	}
+	delete(announcer.nextAnnounce, serv)
+	announcer.announcerM.Unlock()
+
+	if !tracked {
+		return
+	}
+	return announcer.announce(serv, true)
+}
+
+// Run announces every tracked service on its own schedule, every AnnounceInterval of
+// the service give or take a random jitter, until ctx is done. It then sends a final
+// announcement with weight 0 for every tracked service and returns ctx.Err().
+func (announcer *DiscoveryAnnouncer) Run(ctx context.Context) error {
 	for {
+		wait := announcer.doAnnounce(time.Now())
+
+		timer := time.NewTimer(wait)
 		select {
-		case <-announcer.stopSig:
-			return
-		default:
-			announcer.doAnnounce()
+		case <-ctx.Done():
+			timer.Stop()
+			announcer.goAway()
+			return ctx.Err()
+		case <-announcer.wake:
+			timer.Stop()
+		case <-timer.C:
 		}
+	}
+}
 
-		time.Sleep(time.Duration(defaultAnnounceInterval) * time.Second)
+// AnnounceLoop runs the announcer until Stop is called
+func (announcer *DiscoveryAnnouncer) AnnounceLoop() {
+	announcer.announcerM.Lock()
+	if announcer.running {
+		announcer.announcerM.Unlock()
+		return
 	}
+	announcer.running = true
+	announcer.announcerM.Unlock()
+
+	defer close(announcer.done)
+	announcer.Run(announcer.stopCtx)
 }
 
-func (announcer *DiscoveryAnnouncer) doAnnounce() (err error) {
+// Stop stops AnnounceLoop, and returns once the final announcements are sent
+func (announcer *DiscoveryAnnouncer) Stop() {
+	announcer.stop()
+
+	announcer.announcerM.Lock()
+	running := announcer.running
+	announcer.announcerM.Unlock()
+	if running {
+		<-announcer.done
+	}
+}
+
+// doAnnounce announces the services due at now and returns how long to wait until the
+// next one is
+func (announcer *DiscoveryAnnouncer) doAnnounce(now time.Time) (wait time.Duration) {
+	var due []*Service
+
+	announcer.announcerM.Lock()
+	wait = time.Duration(defaultAnnounceInterval) * time.Second
 	for _, serv := range announcer.services {
-		serviceDesc, err := serv.MarshalText()
+		next := announcer.nextAnnounce[serv]
+		if next.After(now) {
+			if next.Sub(now) < wait {
+				wait = next.Sub(now)
+			}
+			continue
+		}
+
+		delay := announceDelay(serv.AnnounceInterval())
+		announcer.nextAnnounce[serv] = now.Add(delay)
+		if delay < wait {
+			wait = delay
+		}
+		due = append(due, serv)
+	}
+	announcer.announcerM.Unlock()
+
+	// one failing service doesn't keep the others from being announced. Services
+	// untracked since were already announced as going away.
+	for _, serv := range due {
+		announcer.sendM.Lock()
+		announcer.announcerM.Lock()
+		_, tracked := announcer.nextAnnounce[serv]
+		announcer.announcerM.Unlock()
+		if tracked {
+			announcer.announce(serv, false)
+		}
+		announcer.sendM.Unlock()
+	}
+	return
+}
+
+// goAway sends the final announcement of every tracked service
+func (announcer *DiscoveryAnnouncer) goAway() {
+	announcer.announcerM.Lock()
+	services := append([]*Service(nil), announcer.services...)
+	announcer.announcerM.Unlock()
+
+	for _, serv := range services {
+		announcer.announce(serv, true)
+	}
+}
+
+// announce sends one announcement of serv, reporting failures to the error hooks.
+// final announcements have weight 0.
+func (announcer *DiscoveryAnnouncer) announce(serv *Service, final bool) (err error) {
+	packet, err := announcer.announcePacket(serv, final)
+	if err == nil {
+		_, err = announcer.multicastConn.WriteTo(packet, nil, announcer.multicastDest)
 		if err != nil {
-			Error.Printf("failed to marshal service as text: `%s`. skipping.", err)
+			err = fmt.Errorf("could not send announcement of `%s`: %s", serv.name, err)
 		}
+	}
+	if err == nil {
+		return
+	}
+
+	Error.Printf("failed to announce service: `%s`", err)
+	announcer.announcerM.Lock()
+	hooks := announcer.errorHooks
+	announcer.announcerM.Unlock()
+	for _, hook := range hooks {
+		hook(serv, err)
+	}
+	return
+}
+
+// announceDelay picks the time until the next announcement: interval moved by a
+// random amount of up to jitter either way
+func announceDelay(interval time.Duration, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return interval
+	}
+	return interval - jitter + time.Duration(rand.Int63n(int64(2*jitter)+1))
+}
+
+// announcePacket encodes the announcement of serv as configured
+func (announcer *DiscoveryAnnouncer) announcePacket(serv *Service, final bool) (packet []byte, err error) {
+	announcer.announcerM.Lock()
+	compress, extensionOnly, maxSize := announcer.compress, announcer.extensionOnly, announcer.maxSize
+	announcer.announcerM.Unlock()
+
+	packet, err = serv.marshalAnnouncement(extensionOnly, final)
+	if err != nil {
+		return
+	}
 
-		_, err = announcer.multicastConn.WriteTo(serviceDesc, nil, announcer.multicastDest)
+	if compress {
+		var buf bytes.Buffer
+		writer := zlib.NewWriter(&buf)
+		_, err = writer.Write(packet)
+		if err != nil {
+			return
+		}
+		err = writer.Close()
 		if err != nil {
-			return err
+			return
 		}
+		packet = buf.Bytes()
+	}
+
+	if maxSize > 0 && len(packet) > maxSize {
+		err = &AnnounceTooLargeError{Service: serv.name, Size: len(packet), Max: maxSize}
+		packet = nil
+		return
+	}
+	return
+}
+
+// decodeAnnouncePacket returns the announcement carried by a packet, inflating it
+// when it is zlib-compressed. Plain announcements start with the `[` of their class
+// records, which can never start a zlib stream.
+func decodeAnnouncePacket(packet []byte) (announce []byte, err error) {
+	if len(packet) == 0 || packet[0] == '[' {
+		announce = packet
+		return
+	}
+
+	reader, err := zlib.NewReader(bytes.NewReader(packet))
+	if err != nil {
+		err = fmt.Errorf("announce packet is neither plain nor zlib-compressed: %s", err)
+		return
+	}
+	defer reader.Close()
+
+	announce, err = ioutil.ReadAll(io.LimitReader(reader, maxAnnounceRecordSize+1))
+	if err != nil {
+		err = fmt.Errorf("could not inflate announce packet: %s", err)
+		return
+	}
+	if len(announce) > maxAnnounceRecordSize {
+		err = fmt.Errorf("announce packet inflates to more than %d bytes", maxAnnounceRecordSize)
+		announce = nil
+	}
+	return
+}
+
+// ParseAnnouncePacket reads the instance announced by a multicast packet, plain or
+// zlib-compressed, with v3 class records and/or the v4 extension. The announcement is
+// not verified; call Validate before trusting it.
+func ParseAnnouncePacket(packet []byte) (instance *ServiceInstance, err error) {
+	announce, err := decodeAnnouncePacket(packet)
+	if err != nil {
+		return
+	}
+
+	parts := bytes.SplitN(bytes.TrimSpace(announce), []byte("\n\n"), 3)
+	if len(parts) != 3 {
+		err = fmt.Errorf("expected class records, certificate and signature in announce packet, got %d parts", len(parts))
+		return
 	}
 
+	instance, err = newServiceProxy(parts[0], bytes.TrimSpace(parts[1]), bytes.TrimSpace(parts[2]))
 	return
 }
 
@@ -0,0 +1,380 @@
+package scamp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAnnouncePacketEncodings(t *testing.T) {
+	initSCAMPLogger()
+
+	cert, err := GenerateServiceCert("announce", CertOptions{KeyType: KeyTypeECDSA})
+	if err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+	serv, err := NewServiceExplicitCert("main", "127.0.0.1:0", "announce", cert.Keypair, cert.PEMCert)
+	if err != nil {
+		t.Fatalf("could not create service: `%s`", err)
+	}
+	defer serv.Stop()
+	for i := 0; i < 300; i++ {
+		serv.Register(fmt.Sprintf("Inventory.Warehouse%d.adjust", i), func(_ *Message, _ *Client) {})
+	}
+
+	sizes := make(map[string]int)
+	for _, encoding := range []struct {
+		name                    string
+		compress, extensionOnly bool
+	}{
+		{"plain", false, false},
+		{"zlib", true, false},
+		{"v4", false, true},
+		{"zlib+v4", true, true},
+	} {
+		announcer := newDiscoveryAnnouncer(nil, nil)
+		announcer.SetCompression(encoding.compress)
+		announcer.SetExtensionEncoding(encoding.extensionOnly)
+		packet, err := announcer.announcePacket(serv, false)
+		if err != nil {
+			t.Fatalf("%s: could not encode announcement: `%s`", encoding.name, err)
+		}
+		sizes[encoding.name] = len(packet)
+
+		instance, err := ParseAnnouncePacket(packet)
+		if err != nil {
+			t.Fatalf("%s: could not parse announcement: `%s`", encoding.name, err)
+		}
+		err = instance.Validate()
+		if err != nil {
+			t.Fatalf("%s: announcement did not verify: `%s`", encoding.name, err)
+		}
+
+		cache := NewMemoryServiceCache()
+		cache.Store(instance)
+		_, err = cache.SearchByAction("main", "Inventory.Warehouse299.adjust", 1, "json")
+		if err != nil {
+			t.Fatalf("%s: announced action not found: `%s`", encoding.name, err)
+		}
+	}
+	if sizes["v4"] >= sizes["plain"] || sizes["zlib"] >= sizes["plain"] || sizes["zlib+v4"] >= sizes["v4"] {
+		t.Fatalf("expected compression and the v4 extension to shrink the announcement: %v", sizes)
+	}
+
+	// the v4 announcement is also read from the discovery cache
+	announce, err := serv.marshalAnnouncement(true, false)
+	if err != nil {
+		t.Fatalf("could not marshal announcement: `%s`", err)
+	}
+	cache := NewMemoryServiceCache()
+	err = cache.DoScan(bufio.NewScanner(bytes.NewReader(append([]byte("%%%\n"), announce...))))
+	if err != nil || cache.Retrieve(serv.name) == nil {
+		t.Fatalf("the v4 announcement did not verify in the cache (%v)", err)
+	}
+
+	announcer := newDiscoveryAnnouncer(nil, nil)
+	announcer.SetCompression(true)
+	announcer.SetMaxPacketSize(sizes["zlib"] / 2)
+	_, err = announcer.announcePacket(serv, false)
+	tooLarge, ok := err.(*AnnounceTooLargeError)
+	if !ok || tooLarge.Service != serv.name || tooLarge.Size <= tooLarge.Max {
+		t.Fatalf("expected an AnnounceTooLargeError, got `%v`", err)
+	}
+
+	if _, err = ParseAnnouncePacket([]byte("garbage")); err == nil {
+		t.Fatalf("expected an error for a packet that is neither plain nor compressed")
+	}
+}
+
+// newTestAnnouncer returns an announcer sending to a local socket, and a function
+// returning the next instance announced to it
+func newTestAnnouncer(t *testing.T) (*DiscoveryAnnouncer, func() *ServiceInstance) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: `%s`", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	multicastConn, err := localMulticastPacketConn()
+	if err != nil {
+		t.Fatalf("could not open announce socket: `%s`", err)
+	}
+	t.Cleanup(func() { multicastConn.Close() })
+
+	receive := func() *ServiceInstance {
+		t.Helper()
+
+		buf := make([]byte, DefaultMaxAnnounceSize)
+		listener.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := listener.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("no announcement received: `%s`", err)
+		}
+		instance, err := ParseAnnouncePacket(buf[:n])
+		if err != nil {
+			t.Fatalf("could not parse announcement: `%s`", err)
+		}
+		return instance
+	}
+	return newDiscoveryAnnouncer(multicastConn, listener.LocalAddr().(*net.UDPAddr)), receive
+}
+
+func TestAnnounceSettings(t *testing.T) {
+	initSCAMPLogger()
+
+	cert, err := GenerateServiceCert("settings", CertOptions{KeyType: KeyTypeECDSA})
+	if err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+	serv, err := NewServiceExplicitCert("main", "127.0.0.1:0", "settings", cert.Keypair, cert.PEMCert)
+	if err != nil {
+		t.Fatalf("could not create service: `%s`", err)
+	}
+	defer serv.Stop()
+	serv.Register("Echo.echo", func(_ *Message, _ *Client) {})
+
+	conf := NewConfig()
+	conf.Set("service.announce_interval", "2s")
+	conf.Set("settings.announce_jitter", "100ms")
+	conf.Set("service.weight", "3")
+	err = serv.loadAnnounceConfig(conf)
+	if err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+	if interval, jitter := serv.AnnounceInterval(); interval != 2*time.Second || jitter != 100*time.Millisecond || serv.Weight() != 3 {
+		t.Fatalf("unexpected settings %s %s %d", interval, jitter, serv.Weight())
+	}
+	conf.Set("settings.announce_jitter", "2s")
+	if err = serv.loadAnnounceConfig(conf); err == nil {
+		t.Fatalf("expected jitter as long as the interval to be refused")
+	}
+	if err = serv.SetWeight(-1); err == nil {
+		t.Fatalf("expected a negative weight to be refused")
+	}
+
+	for i := 0; i < 100; i++ {
+		delay := announceDelay(time.Second, 100*time.Millisecond)
+		if delay < 900*time.Millisecond || delay > 1100*time.Millisecond {
+			t.Fatalf("delay %s is outside the jitter", delay)
+		}
+	}
+
+	announcer, receive := newTestAnnouncer(t)
+	announcer.Track(serv)
+
+	err = serv.SetAnnounceInterval(time.Second, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+	now := time.Now()
+	if wait := announcer.doAnnounce(now); wait != time.Second {
+		t.Fatalf("expected the next announcement in 1s, got %s", wait)
+	}
+	instance := receive()
+	if instance.Weight() != 3 || instance.AnnounceInterval() != time.Second {
+		t.Fatalf("unexpected announced weight %d and interval %s", instance.Weight(), instance.AnnounceInterval())
+	}
+
+	// draining takes effect on the next announcement, which is not due yet
+	serv.SetWeight(0)
+	if wait := announcer.doAnnounce(now.Add(400 * time.Millisecond)); wait != 600*time.Millisecond {
+		t.Fatalf("expected the next announcement in 600ms, got %s", wait)
+	}
+	announcer.doAnnounce(now.Add(time.Second))
+	if instance = receive(); instance.Weight() != 0 {
+		t.Fatalf("expected the drained instance to announce weight 0, got %d", instance.Weight())
+	}
+}
+
+func TestAnnouncerLifecycle(t *testing.T) {
+	initSCAMPLogger()
+
+	cert, err := GenerateServiceCert("lifecycle", CertOptions{KeyType: KeyTypeECDSA})
+	if err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+	serv, err := NewServiceExplicitCert("main", "127.0.0.1:0", "lifecycle", cert.Keypair, cert.PEMCert)
+	if err != nil {
+		t.Fatalf("could not create service: `%s`", err)
+	}
+	defer serv.Stop()
+	serv.Register("Echo.echo", func(_ *Message, _ *Client) {})
+	// a service without a certificate can't sign its announcements
+	pipe, err := NewPipeListener("unsigned")
+	if err != nil {
+		t.Fatalf("could not listen: `%s`", err)
+	}
+	defer pipe.Close()
+	unsigned, err := NewServiceWithListener("main", "unsigned", pipe)
+	if err != nil {
+		t.Fatalf("could not create service: `%s`", err)
+	}
+
+	announcer, receive := newTestAnnouncer(t)
+	failures := make(chan *Service, 10)
+	announcer.OnError(func(failed *Service, err error) { failures <- failed })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() { stopped <- announcer.Run(ctx) }()
+
+	// tracked services are announced right away, not after the 5s interval
+	announcer.Track(unsigned)
+	announcer.Track(serv)
+	if instance := receive(); instance.Ident() != serv.name || instance.Weight() != 1 {
+		t.Fatalf("unexpected announcement of `%s` with weight %d", instance.Ident(), instance.Weight())
+	}
+	select {
+	case failed := <-failures:
+		if failed != unsigned {
+			t.Fatalf("expected the failure to be reported for the unsigned service")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the failed announcement to be reported")
+	}
+
+	err = announcer.Untrack(unsigned)
+	if err == nil {
+		t.Fatalf("expected the final announcement of the unsigned service to fail")
+	}
+	<-failures
+
+	// Run returns promptly, announcing that the remaining service is going away
+	cancel()
+	select {
+	case err = <-stopped:
+		if err != context.Canceled {
+			t.Fatalf("unexpected error: `%v`", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Run did not return after its context was done")
+	}
+	if instance := receive(); instance.Ident() != serv.name || instance.Weight() != 0 {
+		t.Fatalf("expected a final announcement with weight 0, got weight %d", instance.Weight())
+	}
+
+	// Untrack sends the final announcement itself
+	announcer.Track(serv)
+	err = announcer.Untrack(serv)
+	if err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+	if instance := receive(); instance.Weight() != 0 {
+		t.Fatalf("expected a final announcement with weight 0, got weight %d", instance.Weight())
+	}
+
+	announcer.Stop()
+}
+
+func TestUntrackIsFinal(t *testing.T) {
+	initSCAMPLogger()
+
+	cert, err := GenerateServiceCert("leaving", CertOptions{KeyType: KeyTypeECDSA})
+	if err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+	serv, err := NewServiceExplicitCert("main", "127.0.0.1:0", "leaving", cert.Keypair, cert.PEMCert)
+	if err != nil {
+		t.Fatalf("could not create service: `%s`", err)
+	}
+	defer serv.Stop()
+	serv.Register("Echo.echo", func(_ *Message, _ *Client) {})
+	// announced first, its failure holds doAnnounce between finding serv due and
+	// announcing it
+	pipe, err := NewPipeListener("unsigned")
+	if err != nil {
+		t.Fatalf("could not listen: `%s`", err)
+	}
+	defer pipe.Close()
+	unsigned, err := NewServiceWithListener("main", "unsigned", pipe)
+	if err != nil {
+		t.Fatalf("could not create service: `%s`", err)
+	}
+
+	announcer, receive := newTestAnnouncer(t)
+	blocked := make(chan struct{}, 1)
+	release := make(chan struct{})
+	announcer.OnError(func(failed *Service, err error) {
+		if failed == unsigned {
+			blocked <- struct{}{}
+			<-release
+		}
+	})
+	announcer.Track(unsigned)
+	announcer.Track(serv)
+
+	announced := make(chan struct{})
+	go func() {
+		announcer.doAnnounce(time.Now())
+		close(announced)
+	}()
+	<-blocked
+	untracked := make(chan error, 1)
+	go func() { untracked <- announcer.Untrack(serv) }()
+	// time for an unordered Untrack to send its final announcement
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	<-announced
+	if err = <-untracked; err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+
+	// everything sent for serv arrives before a marker announced last
+	marker, err := NewServiceExplicitCert("main", "127.0.0.1:0", "marker", cert.Keypair, cert.PEMCert)
+	if err != nil {
+		t.Fatalf("could not create service: `%s`", err)
+	}
+	defer marker.Stop()
+	marker.Register("Echo.echo", func(_ *Message, _ *Client) {})
+	announcer.announce(marker, false)
+
+	var last *ServiceInstance
+	for instance := receive(); instance.Ident() != marker.name; instance = receive() {
+		last = instance
+	}
+	if last == nil || last.Weight() != 0 {
+		t.Fatalf("expected the final announcement to be the last one")
+	}
+}
+
+func TestParseMalformedAnnouncePackets(t *testing.T) {
+	initSCAMPLogger()
+
+	// announce packets come off the network unauthenticated: none of these may panic
+	for _, records := range []string{
+		`[3]`,
+		`[]`,
+		`null`,
+		`{}`,
+		`"not a record"`,
+		`[3,"id","main",1,5000,"beepish+tls://127.0.0.1:30100",["json"]]`,
+		`[3,1,2,3,4,5,6,7,8]`,
+		`[3,"id","main",1,5000,"beepish+tls://127.0.0.1:30100",["json"],[["Logger"]],1]`,
+		`[3,"id","main",1,5000,"beepish+tls://127.0.0.1:30100",["json"],[["Logger",["info"]]],1]`,
+		`[3,"id","main",1,5000,"beepish+tls://127.0.0.1:30100",["json"],[["Logger",["info","",1,2]]],1]`,
+		`[3,"id","main",1,5000,"beepish+tls://127.0.0.1:30100",["json"],[["Logger",null]],1]`,
+	} {
+		_, err := ParseAnnouncePacket([]byte(records + "\n\ncert\n\nsig"))
+		if err == nil {
+			t.Fatalf("expected an error for `%s`", records)
+		}
+	}
+
+	for _, packet := range []string{"", "\n\n", "[3]\n\ncert", "x\x9c"} {
+		if _, err := ParseAnnouncePacket([]byte(packet)); err == nil {
+			t.Fatalf("expected an error for packet `%q`", packet)
+		}
+	}
+
+	// protocols that are neither names nor an extension are skipped
+	instance, err := ParseAnnouncePacket([]byte(`[3,"id","main",1,5000,"beepish+tls://127.0.0.1:30100",[null,"json"],[["Logger",["info",""]]],1]` + "\n\ncert\n\nsig"))
+	if err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+	if len(instance.protocols) != 1 {
+		t.Fatalf("expected the null protocol to be skipped, got %v", instance.protocols)
+	}
+}
@@ -0,0 +1,197 @@
+package scamp
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// discoveryExtensionVmaj is the extension version this package reads and writes
+const discoveryExtensionVmaj = 4
+
+// classes decodes the extension's run-length encoded arrays into announced classes.
+// Every action carries its own sector, version, envelopes and flags. acname lists one
+// name per action; the other arrays hold either single values or [count, value] runs
+// and must expand to as many values as there are names.
+func (ext *ServiceProxyDiscoveryExtension) classes() (classes []InstanceClass, err error) {
+	if ext.Vmaj != discoveryExtensionVmaj {
+		err = fmt.Errorf("unsupported discovery extension version %d.%d", ext.Vmaj, ext.Vmin)
+		return
+	}
+
+	count := len(ext.AcName)
+	namespaces, err := expandRLE("acns", ext.AcNs, count)
+	if err != nil {
+		return
+	}
+	sectors, err := expandRLE("acsec", ext.AcSec, count)
+	if err != nil {
+		return
+	}
+	versions, err := expandRLE("acver", ext.AcVer, count)
+	if err != nil {
+		return
+	}
+	envelopes, err := expandRLE("acenv", ext.AcEnv, count)
+	if err != nil {
+		return
+	}
+	flags, err := expandRLE("acflag", ext.AcFlag, count)
+	if err != nil {
+		return
+	}
+
+	classIndex := make(map[string]int)
+	for i, rawName := range ext.AcName {
+		var action InstanceAction
+		var className string
+		var ok bool
+		if action.actionName, ok = rawName.(string); !ok {
+			err = fmt.Errorf("acname %d: expected a string, got `%v`", i, rawName)
+			return
+		}
+		if className, ok = namespaces[i].(string); !ok {
+			err = fmt.Errorf("acns %d: expected a string, got `%v`", i, namespaces[i])
+			return
+		}
+		if action.sector, ok = sectors[i].(string); !ok {
+			err = fmt.Errorf("acsec %d: expected a string, got `%v`", i, sectors[i])
+			return
+		}
+		if action.crudTags, ok = flags[i].(string); !ok {
+			err = fmt.Errorf("acflag %d: expected a string, got `%v`", i, flags[i])
+			return
+		}
+		rawEnvelopes, ok := envelopes[i].(string)
+		if !ok {
+			err = fmt.Errorf("acenv %d: expected a string, got `%v`", i, envelopes[i])
+			return
+		}
+		action.envelopes = strings.Split(rawEnvelopes, ",")
+		action.version, err = extensionVersion(versions[i])
+		if err != nil {
+			err = fmt.Errorf("acver %d: %s", i, err)
+			return
+		}
+
+		j, seen := classIndex[className]
+		if !seen {
+			j = len(classes)
+			classIndex[className] = j
+			classes = append(classes, InstanceClass{className: className})
+		}
+		classes[j].actions = append(classes[j].actions, action)
+	}
+
+	return
+}
+
+// extensionVersion reads an acver value, which some announcers send as a string
+func extensionVersion(value interface{}) (version int, err error) {
+	switch v := value.(type) {
+	case float64:
+		version = int(v)
+	case string:
+		version, err = strconv.Atoi(v)
+	default:
+		err = fmt.Errorf("expected a version, got `%v`", value)
+	}
+	return
+}
+
+// expandRLE decodes a run-length encoded extension array into count values
+func expandRLE(field string, entries []interface{}, count int) (values []interface{}, err error) {
+	values = make([]interface{}, 0, count)
+	for _, entry := range entries {
+		run, isRun := entry.([]interface{})
+		if !isRun {
+			if len(values) == count {
+				err = fmt.Errorf("%s: more than %d values", field, count)
+				return
+			}
+			values = append(values, entry)
+			continue
+		}
+
+		if len(run) != 2 {
+			err = fmt.Errorf("%s: bad run `%v`", field, entry)
+			return
+		}
+		// the length comes off the wire before the record is verified: bound it by the
+		// number of values still expected before allocating anything
+		length, isCount := run[0].(float64)
+		if !isCount || length < 0 || length != math.Trunc(length) || length > float64(count-len(values)) {
+			err = fmt.Errorf("%s: bad run length in `%v`", field, entry)
+			return
+		}
+		for i := 0; i < int(length); i++ {
+			values = append(values, run[1])
+		}
+	}
+
+	if len(values) != count {
+		err = fmt.Errorf("%s: expected %d values, got %d", field, count, len(values))
+		return
+	}
+	return
+}
+
+// encodeRLE collapses consecutive equal values into [count, value] runs
+func encodeRLE(values []interface{}) (entries []interface{}) {
+	entries = make([]interface{}, 0)
+	for i := 0; i < len(values); {
+		j := i + 1
+		for j < len(values) && values[j] == values[i] {
+			j++
+		}
+		entries = append(entries, []interface{}{j - i, values[i]})
+		i = j
+	}
+	return
+}
+
+// newDiscoveryExtension encodes the actions of sp that have their own sector or
+// envelopes, which the v3 class records cannot describe. It returns nil when there
+// are none.
+func newDiscoveryExtension(sp *ServiceInstance) (ext *ServiceProxyDiscoveryExtension) {
+	var names, namespaces, sectors, versions, envelopes, flags []interface{}
+	for _, class := range sp.classes {
+		for _, action := range class.actions {
+			if !action.extended() {
+				continue
+			}
+			names = append(names, action.actionName)
+			namespaces = append(namespaces, class.className)
+			sectors = append(sectors, sp.actionSector(action))
+			versions = append(versions, action.version)
+			envelopes = append(envelopes, strings.Join(sp.actionEnvelopes(action), ","))
+			flags = append(flags, action.crudTags)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	ext = new(ServiceProxyDiscoveryExtension)
+	ext.Vmaj = discoveryExtensionVmaj
+	ext.AcName = names
+	ext.AcNs = encodeRLE(namespaces)
+	ext.AcSec = encodeRLE(sectors)
+	ext.AcVer = encodeRLE(versions)
+	ext.AcEnv = encodeRLE(envelopes)
+	ext.AcFlag = encodeRLE(flags)
+	return
+}
+
+// extendActions moves every action of sp to the v4 extension, which encodes long
+// action lists much more compactly than the v3 class records
+func (sp *ServiceInstance) extendActions() {
+	for i := range sp.classes {
+		for j := range sp.classes[i].actions {
+			action := &sp.classes[i].actions[j]
+			action.sector = sp.actionSector(*action)
+			action.envelopes = sp.actionEnvelopes(*action)
+		}
+	}
+}
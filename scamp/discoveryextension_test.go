@@ -0,0 +1,127 @@
+package scamp
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestParseDiscoveryExtension(t *testing.T) {
+	classRecords := []byte(`[3,"channel-1","main",1,5,"beepish+tls://10.8.1.158:30359",["json",{"vmin":0,"vmaj":4,"acsec":[[7,"background"]],"acname":["_evaluate","_execute","_evaluate","_execute","_munge","_evaluate","_execute"],"acver":[[6,1],"2"],"acenv":[[7,"json,jsonstore,extdirect"]],"acflag":[[4,""],"noauth",[2,""]],"acns":[[2,"Channel.Amazon.FeedInterchange"],[3,"Channel.Amazon.InvPush"],[2,"Channel.Amazon.OrderImport"]]}],[["Logger",["info","read",1]]],1440001142628.000000]`)
+	instance, err := newServiceProxy(classRecords, serviceProxyCertRaw, serviceProxySigRaw)
+	if err != nil {
+		t.Fatalf("failed to parse record: `%s`", err)
+	}
+
+	classes := instance.Classes()
+	if len(classes) != 4 {
+		t.Fatalf("expected the v3 class and 3 extension classes, got %d", len(classes))
+	}
+	munge := classes[2].Actions()[2]
+	if classes[2].Name() != "Channel.Amazon.InvPush" || munge.Name() != "_munge" || munge.Sector() != "background" ||
+		!reflect.DeepEqual(munge.Envelopes(), []string{"json", "jsonstore", "extdirect"}) || !reflect.DeepEqual(munge.Flags(), []string{"noauth"}) {
+		t.Fatalf("unexpected action %s %s %v %v", munge.Name(), munge.Sector(), munge.Envelopes(), munge.Flags())
+	}
+	if execute := classes[3].Actions()[1]; execute.Version() != 2 {
+		t.Fatalf("expected string versions to be read, got %d", execute.Version())
+	}
+	if info := classes[0].Actions()[0]; info.Sector() != "main" || !reflect.DeepEqual(info.Envelopes(), []string{"json"}) {
+		t.Fatalf("expected v3 actions to take the instance's sector and envelopes, got %s %v", info.Sector(), info.Envelopes())
+	}
+
+	cache := NewMemoryServiceCache()
+	cache.Store(instance)
+	for _, search := range []struct {
+		sector, action, envelope string
+		version                  int
+	}{
+		{"background", "Channel.Amazon.InvPush._munge", "jsonstore", 1},
+		{"background", "Channel.Amazon.OrderImport._execute", "extdirect", 2},
+		{"main", "Logger.info", "json", 1},
+	} {
+		_, err = cache.SearchByAction(search.sector, search.action, search.version, search.envelope)
+		if err != nil {
+			t.Fatalf("could not find %s:%s~%d#%s", search.sector, search.action, search.version, search.envelope)
+		}
+	}
+	if _, err = cache.SearchByAction("main", "Channel.Amazon.InvPush._munge", 1, "json"); err == nil {
+		t.Fatalf("expected extension actions to only be indexed in their own sector")
+	}
+
+	// a malformed extension is ignored rather than failing the record
+	classRecords = []byte(`[3,"channel-2","main",1,5,"beepish+tls://10.8.1.158:30359",["json",{"vmin":0,"vmaj":4,"acname":["_execute"],"acsec":[[2,"background"]],"acver":[1],"acenv":["json"],"acflag":[""],"acns":["Channel"]}],[["Logger",["info","read",1]]],1440001142628.000000]`)
+	instance, err = newServiceProxy(classRecords, serviceProxyCertRaw, serviceProxySigRaw)
+	if err != nil {
+		t.Fatalf("failed to parse record: `%s`", err)
+	}
+	if len(instance.Classes()) != 1 {
+		t.Fatalf("expected the malformed extension to be ignored")
+	}
+
+	// run lengths are checked before expanding, as records aren't verified yet
+	for _, acsec := range []string{`[[100000000,"main"]]`, `[[1.5,"main"]]`, `["main","main"]`} {
+		packet := []byte(`[3,"channel-3","main",1,5,"beepish+tls://10.8.1.158:30359",["json",{"vmin":0,"vmaj":4,"acname":["_execute"],"acsec":` + acsec + `,"acver":[1],"acenv":["json"],"acflag":[""],"acns":["Channel"]}],[["Logger",["info","read",1]]],1440001142628.000000]` + "\n\n" + string(serviceProxyCertRaw) + "\n\n" + string(serviceProxySigRaw) + "\n\n")
+		instance, err = ParseAnnouncePacket(packet)
+		if err != nil {
+			t.Fatalf("failed to parse record: `%s`", err)
+		}
+		if len(instance.Classes()) != 1 {
+			t.Fatalf("expected the extension with acsec %s to be ignored", acsec)
+		}
+	}
+	if _, err = expandRLE("acsec", []interface{}{[]interface{}{float64(3), "main"}}, 2); err == nil {
+		t.Fatalf("expected a run longer than the action count to be refused")
+	}
+}
+
+func TestAnnounceDiscoveryExtension(t *testing.T) {
+	initSCAMPLogger()
+
+	cert, err := GenerateServiceCert("extension", CertOptions{KeyType: KeyTypeECDSA})
+	if err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+	serv, err := NewServiceExplicitCert("main", "127.0.0.1:0", "extension", cert.Keypair, cert.PEMCert)
+	if err != nil {
+		t.Fatalf("could not create service: `%s`", err)
+	}
+	defer serv.Stop()
+	serv.Register("Echo.echo", func(_ *Message, _ *Client) {})
+	serv.RegisterEnvelopes("Echo.both", []envelopeFormat{EnvelopeJSON, EnvelopeCBOR}, func(_ *Message, _ *Client) {})
+	serv.RegisterEnvelopes("Blob.put", []envelopeFormat{EnvelopeCBOR}, func(_ *Message, _ *Client) {})
+
+	announce, err := serv.MarshalText()
+	if err != nil {
+		t.Fatalf("could not marshal announcement: `%s`", err)
+	}
+	if !bytes.Contains(announce, []byte(`"vmaj":4`)) {
+		t.Fatalf("expected the announcement to carry the v4 extension: `%s`", announce)
+	}
+
+	cache := NewMemoryServiceCache()
+	err = cache.DoScan(bufio.NewScanner(bytes.NewReader(append([]byte("%%%\n"), announce...))))
+	if err != nil {
+		t.Fatalf("could not scan announcement: `%s`", err)
+	}
+	if cache.Retrieve(serv.name) == nil {
+		t.Fatalf("the announcement did not verify")
+	}
+
+	for _, search := range []struct {
+		action, envelope string
+		found            bool
+	}{
+		{"Echo.echo", "json", true},
+		{"Echo.echo", "cbor", false},
+		{"Echo.both", "json", true},
+		{"Echo.both", "cbor", true},
+		{"Blob.put", "cbor", true},
+		{"Blob.put", "json", false},
+	} {
+		_, err = cache.SearchByAction("main", search.action, 1, search.envelope)
+		if (err == nil) != search.found {
+			t.Fatalf("%s#%s: expected found=%t", search.action, search.envelope, search.found)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package scamp
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DiscoveryListener receives the announcements multicast by DiscoveryAnnouncers
+type DiscoveryListener struct {
+	conn net.PacketConn
+}
+
+// ListenDiscovery joins the discovery multicast group configured in conf
+// (discovery.multicast_address and discovery.port) on the default interface
+func ListenDiscovery(conf *Config) (listener *DiscoveryListener, err error) {
+	initSCAMPLogger()
+
+	group := &net.UDPAddr{IP: conf.DiscoveryMulticastIP(), Port: conf.DiscoveryMulticastPort()}
+	conn, err := net.ListenMulticastUDP("udp", nil, group)
+	if err != nil {
+		return
+	}
+
+	listener = NewDiscoveryListener(conn)
+	return
+}
+
+// NewDiscoveryListener receives announcements from conn, which may be any packet socket
+func NewDiscoveryListener(conn net.PacketConn) (listener *DiscoveryListener) {
+	initSCAMPLogger()
+
+	listener = new(DiscoveryListener)
+	listener.conn = conn
+	return
+}
+
+// Run passes every verified announcement received to handle, until ctx is done or
+// the listener is closed. Announcements that can't be parsed or verified are logged
+// and dropped. Run returns ctx.Err() when ctx is done.
+func (listener *DiscoveryListener) Run(ctx context.Context, handle func(*ServiceInstance)) (err error) {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			listener.conn.Close()
+		case <-stop:
+		}
+	}()
+
+	buf := make([]byte, 65536)
+	for {
+		n, from, readErr := listener.conn.ReadFrom(buf)
+		if readErr != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return readErr
+		}
+
+		instance, parseErr := ParseAnnouncePacket(buf[:n])
+		if parseErr == nil {
+			parseErr = instance.Validate()
+		}
+		if parseErr != nil {
+			Warning.Printf("dropping announcement from %s: %s", from, parseErr)
+			continue
+		}
+		handle(instance)
+	}
+}
+
+// Close stops the listener
+func (listener *DiscoveryListener) Close() error {
+	return listener.conn.Close()
+}
+
+// DefaultExpireAfter is how many announce intervals an instance may miss before a
+// MulticastProvider drops it
+const DefaultExpireAfter = 3
+
+// DefaultExpireInterval is how often a MulticastProvider checks for instances that
+// stopped announcing, and passes on changes
+var DefaultExpireInterval = time.Second
+
+// MulticastProvider feeds a ServiceCache with the announcements received live by a
+// DiscoveryListener, without going through a cache file. It keeps the newest
+// announcement of every instance and drops instances that stop announcing
+// themselves or go away with weight 0.
+type MulticastProvider struct {
+	listener *DiscoveryListener
+
+	// ExpireAfter is how many announce intervals an instance may miss
+	ExpireAfter int
+	// ExpireInterval is how often Run checks for expired instances
+	ExpireInterval time.Duration
+
+	announcementsM sync.Mutex
+	announcements  map[string]*announcement
+}
+
+type announcement struct {
+	instance *ServiceInstance
+	expires  time.Time
+}
+
+// NewMulticastProvider creates a provider for the announcements received by listener.
+// listener may be nil when announcements are passed to Observe directly.
+func NewMulticastProvider(listener *DiscoveryListener) (provider *MulticastProvider) {
+	provider = new(MulticastProvider)
+	provider.listener = listener
+	provider.ExpireAfter = DefaultExpireAfter
+	provider.ExpireInterval = DefaultExpireInterval
+	provider.announcements = make(map[string]*announcement)
+	return
+}
+
+// Observe records a verified announcement received at now, and reports whether it
+// changed the provider's instances. It replaces the previous announcement of the
+// same instance unless that one is newer, and removes the instance if it announces
+// weight 0.
+func (provider *MulticastProvider) Observe(instance *ServiceInstance, now time.Time) (changed bool) {
+	provider.announcementsM.Lock()
+	defer provider.announcementsM.Unlock()
+
+	previous, seen := provider.announcements[instance.ident]
+	if seen && previous.instance.AnnounceTime().After(instance.AnnounceTime()) {
+		return
+	}
+
+	if instance.weight == 0 {
+		delete(provider.announcements, instance.ident)
+		return seen
+	}
+
+	interval := instance.AnnounceInterval()
+	if interval <= 0 {
+		interval = time.Duration(defaultAnnounceInterval) * time.Second
+	}
+	expires := now.Add(time.Duration(provider.ExpireAfter) * interval)
+
+	// a periodic re-announcement: keep the newest, but nothing changed
+	if seen && previous.instance.SameAnnouncement(instance) {
+		previous.instance = instance
+		previous.expires = expires
+		return
+	}
+	provider.announcements[instance.ident] = &announcement{instance: instance, expires: expires}
+	return true
+}
+
+// Expire drops the instances that have not announced themselves in time, as of now,
+// and returns their idents
+func (provider *MulticastProvider) Expire(now time.Time) (expired []string) {
+	provider.announcementsM.Lock()
+	defer provider.announcementsM.Unlock()
+
+	for ident, announcement := range provider.announcements {
+		if now.After(announcement.expires) {
+			delete(provider.announcements, ident)
+			expired = append(expired, ident)
+		}
+	}
+	sort.Strings(expired)
+	return
+}
+
+// Instances returns the current instances, sorted by ident
+func (provider *MulticastProvider) Instances() (instances []*ServiceInstance) {
+	provider.announcementsM.Lock()
+	defer provider.announcementsM.Unlock()
+
+	for _, announcement := range provider.announcements {
+		instances = append(instances, announcement.instance)
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].ident < instances[j].ident })
+	return
+}
+
+// Run listens for announcements and passes the current instances to update every
+// ExpireInterval in which they changed, until ctx is done or the listener fails
+func (provider *MulticastProvider) Run(ctx context.Context, update func([]*ServiceInstance)) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var changedM sync.Mutex
+	changed := false
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- provider.listener.Run(ctx, func(instance *ServiceInstance) {
+			if provider.Observe(instance, time.Now()) {
+				changedM.Lock()
+				changed = true
+				changedM.Unlock()
+			}
+		})
+	}()
+
+	ticker := time.NewTicker(provider.ExpireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err = <-listenErr:
+			return
+		case <-ticker.C:
+		}
+
+		expired := provider.Expire(time.Now())
+		for _, ident := range expired {
+			Info.Printf("instance `%s` stopped announcing", ident)
+		}
+
+		changedM.Lock()
+		if len(expired) > 0 {
+			changed = true
+		}
+		pending := changed
+		changed = false
+		changedM.Unlock()
+		if pending {
+			update(provider.Instances())
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package scamp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// DiscoveryProvider finds service instances for a ServiceCache. Several providers may
+// feed the same cache, see ServiceCache.AddProvider.
+type DiscoveryProvider interface {
+	// Run passes the provider's complete set of instances to update every time it
+	// changes, until ctx is done or the provider fails. Providers that check
+	// signatures do so before passing instances on.
+	Run(ctx context.Context, update func(instances []*ServiceInstance)) error
+}
+
+// providerSource holds the instances one provider currently feeds a cache
+type providerSource struct {
+	instances []*ServiceInstance
+}
+
+// AddProvider feeds the instances found by provider into the cache, next to those of
+// the cache file and of other providers, until ctx is done or the provider fails;
+// its instances are then removed. When instances from different sources share an
+// ident, the one stored last wins. Revoked instances are dropped, and so are signed
+// instances whose certificate fails the cache's expiry policy.
+func (cache *ServiceCache) AddProvider(ctx context.Context, provider DiscoveryProvider) {
+	source := new(providerSource)
+	cache.cacheM.Lock()
+	cache.sources = append(cache.sources, source)
+	cache.cacheM.Unlock()
+
+	go func() {
+		err := provider.Run(ctx, func(instances []*ServiceInstance) {
+			cache.provide(source, instances)
+		})
+		if err != nil && ctx.Err() == nil {
+			Error.Printf("discovery provider %T stopped: %s", provider, err)
+		}
+		cache.removeSource(source)
+	}()
+}
+
+// provide replaces the instances of source with instances
+func (cache *ServiceCache) provide(source *providerSource, instances []*ServiceInstance) {
+	cache.cacheM.Lock()
+	defer cache.cacheM.Unlock()
+
+	admitted := make([]*ServiceInstance, 0, len(instances))
+	for _, instance := range instances {
+		err := cache.admitNoLock(instance)
+		if err != nil {
+			Warning.Printf("dropping `%s`: %s", instance.ident, err)
+			continue
+		}
+		admitted = append(admitted, instance)
+	}
+
+	snapshot := cache.load().clone()
+	snapshot.purge(source.instances...)
+	for _, instance := range admitted {
+		snapshot.index(instance)
+	}
+	source.instances = admitted
+	cache.publishNoLock(snapshot)
+}
+
+func (cache *ServiceCache) removeSource(source *providerSource) {
+	cache.cacheM.Lock()
+	defer cache.cacheM.Unlock()
+
+	for i, candidate := range cache.sources {
+		if candidate == source {
+			cache.sources = append(cache.sources[:i:i], cache.sources[i+1:]...)
+			break
+		}
+	}
+
+	snapshot := cache.load().clone()
+	snapshot.purge(source.instances...)
+	source.instances = nil
+	cache.publishNoLock(snapshot)
+}
+
+// indexProvidedNoLock adds the instances of every provider to snapshot
+func (cache *ServiceCache) indexProvidedNoLock(snapshot *cacheSnapshot) {
+	for _, source := range cache.sources {
+		for _, instance := range source.instances {
+			// revoked since it was provided
+			if cache.revokedNoLock(instance) {
+				continue
+			}
+			snapshot.index(instance)
+		}
+	}
+}
+
+// admitNoLock checks a provided instance against the revocation list and, if it is
+// signed, the expiry policy
+func (cache *ServiceCache) admitNoLock(instance *ServiceInstance) (err error) {
+	if cache.revokedNoLock(instance) {
+		err = errors.New("its certificate is revoked")
+		return
+	}
+	if _, certErr := instance.certificate(); certErr == nil {
+		err = cache.checkCertExpiry(instance)
+	}
+	return
+}
+
+// DefaultCacheFileInterval is how often a CacheFileProvider checks its file for changes
+var DefaultCacheFileInterval = 5 * time.Second
+
+// CacheFileProvider reads a signed discovery cache file, as written by the cache
+// manager, and reads it again whenever it changes. Records failing verification are
+// dropped.
+type CacheFileProvider struct {
+	path string
+	// Interval is how often the file is checked for changes
+	Interval time.Duration
+}
+
+// NewCacheFileProvider creates a provider reading the cache file at path
+func NewCacheFileProvider(path string) (provider *CacheFileProvider) {
+	provider = new(CacheFileProvider)
+	provider.path = path
+	provider.Interval = DefaultCacheFileInterval
+	return
+}
+
+// Run reads the file right away and whenever its modification time or size change.
+// Files that can't be read are logged and tried again.
+func (provider *CacheFileProvider) Run(ctx context.Context, update func([]*ServiceInstance)) error {
+	initSCAMPLogger()
+
+	var modTime time.Time
+	var size int64
+	var records map[string]*ServiceInstance
+
+	ticker := time.NewTicker(provider.Interval)
+	defer ticker.Stop()
+	for {
+		stat, err := os.Stat(provider.path)
+		if err == nil && (!stat.ModTime().Equal(modTime) || stat.Size() != size || records == nil) {
+			var order []*ServiceInstance
+			records, order, err = provider.read(records)
+			if err == nil {
+				modTime, size = stat.ModTime(), stat.Size()
+				update(order)
+			}
+		}
+		if err != nil {
+			Error.Printf("could not read discovery cache `%s`: %s", provider.path, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (provider *CacheFileProvider) read(previous map[string]*ServiceInstance) (records map[string]*ServiceInstance, order []*ServiceInstance, err error) {
+	file, err := os.Open(provider.path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	records, order, err = scanRecords(bufio.NewScanner(file), previous, true)
+	if err != nil {
+		records = previous
+		err = fmt.Errorf("bad record: %s", err)
+	}
+	return
+}
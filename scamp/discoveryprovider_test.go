@@ -0,0 +1,198 @@
+package scamp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStaticProvider(t *testing.T) {
+	initSCAMPLogger()
+
+	conf := NewConfig()
+	if _, err := NewStaticProvider(conf); err == nil {
+		t.Fatalf("expected static discovery to need opting in")
+	}
+	conf.Set("discovery.allow_static", "true")
+	conf.Set("scamp.production", "true")
+	if _, err := NewStaticProvider(conf); err == nil {
+		t.Fatalf("expected static discovery to be refused in production")
+	}
+	conf.Set("scamp.production", "false")
+	provider, err := NewStaticProvider(conf)
+	if err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+
+	dir := t.TempDir()
+	yamlPath := filepath.Join(dir, "services.yaml")
+	ioutil.WriteFile(yamlPath, []byte(`services:
+  - ident: logger-1
+    connspec: beepish+tls://127.0.0.1:30100
+    actions: [Logger.info, Logger.warn~2]
+`), 0644)
+	jsonPath := filepath.Join(dir, "services.json")
+	ioutil.WriteFile(jsonPath, []byte(`{"services": [{"ident": "blob-1", "sector": "background", "connspec": "beepish+tls://127.0.0.1:30101", "protocols": ["json", "cbor"], "actions": ["Blob.put"]}]}`), 0644)
+	for _, path := range []string{yamlPath, jsonPath} {
+		err = provider.LoadManifest(path)
+		if err != nil {
+			t.Fatalf("could not load `%s`: `%s`", path, err)
+		}
+	}
+
+	badPath := filepath.Join(dir, "bad.yaml")
+	ioutil.WriteFile(badPath, []byte("services:\n  - ident: typo-1\n    conspec: beepish+tls://127.0.0.1:30102\n"), 0644)
+	if err = provider.LoadManifest(badPath); err == nil {
+		t.Fatalf("expected unknown manifest fields to be refused")
+	}
+
+	cache := NewMemoryServiceCache()
+	events := cache.Subscribe(CacheFilter{})
+	defer cache.Unsubscribe(events)
+	ctx, cancel := context.WithCancel(context.Background())
+	cache.AddProvider(ctx, provider)
+	expectEvent(t, events, InstanceAdded, "blob-1")
+	expectEvent(t, events, InstanceAdded, "logger-1")
+
+	for _, search := range []struct {
+		sector, action, envelope string
+		version                  int
+	}{
+		{"main", "Logger.info", "json", 1},
+		{"main", "Logger.warn", "json", 2},
+		{"background", "Blob.put", "cbor", 1},
+	} {
+		_, err = cache.SearchByAction(search.sector, search.action, search.version, search.envelope)
+		if err != nil {
+			t.Fatalf("could not find %s:%s~%d#%s", search.sector, search.action, search.version, search.envelope)
+		}
+	}
+
+	provider.Add("logger-2", "main", "beepish+tls://127.0.0.1:30103", []string{"json"}, "Logger.info")
+	expectEvent(t, events, InstanceAdded, "logger-2")
+
+	cancel()
+	expectEvent(t, events, InstanceRemoved, "blob-1")
+	expectEvent(t, events, InstanceRemoved, "logger-1")
+	expectEvent(t, events, InstanceRemoved, "logger-2")
+}
+
+func TestComposedProviders(t *testing.T) {
+	initSCAMPLogger()
+
+	dir := t.TempDir()
+	fileAnnounce, fileIdent := announceWithValidity(t, "from-file", time.Now(), time.Hour)
+	path := filepath.Join(dir, "discovery")
+	ioutil.WriteFile(path, fileAnnounce, 0644)
+	ownAnnounce, ownIdent := announceWithValidity(t, "own-file", time.Now(), time.Hour)
+	multicastAnnounce, multicastIdent := announceWithValidity(t, "multicast", time.Now(), time.Hour)
+
+	conf := NewConfig()
+	conf.Set("discovery.allow_static", "true")
+	static, err := NewStaticProvider(conf)
+	if err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+	static.Add("static-1", "main", "beepish+tls://127.0.0.1:30100", []string{"json"}, "Logger.info")
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: `%s`", err)
+	}
+	multicast := NewMulticastProvider(NewDiscoveryListener(conn))
+	multicast.ExpireInterval = 10 * time.Millisecond
+
+	cache := NewMemoryServiceCache()
+	events := cache.Subscribe(CacheFilter{})
+	defer cache.Unsubscribe(events)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cache.AddProvider(ctx, static)
+	expectEvent(t, events, InstanceAdded, "static-1")
+	cache.AddProvider(ctx, NewCacheFileProvider(path))
+	expectEvent(t, events, InstanceAdded, fileIdent)
+	cache.AddProvider(ctx, multicast)
+
+	sender, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("could not dial: `%s`", err)
+	}
+	defer sender.Close()
+	// a forged announcement is dropped by the listener
+	forged := bytes.Replace(multicastAnnounce[len("%%%\n"):], []byte(`"main"`), []byte(`"evil"`), 1)
+	sender.Write(forged)
+	sender.Write(multicastAnnounce[len("%%%\n"):])
+	expectEvent(t, events, InstanceAdded, multicastIdent)
+	if cache.Retrieve(multicastIdent).Sector() != "main" {
+		t.Fatalf("expected the forged announcement to be dropped")
+	}
+
+	// scanning the cache's own records keeps the providers' instances
+	err = cache.DoScan(bufio.NewScanner(bytes.NewReader(ownAnnounce)))
+	if err != nil {
+		t.Fatalf("could not scan: `%s`", err)
+	}
+	expectEvent(t, events, InstanceAdded, ownIdent)
+	if cache.Size() != 4 {
+		t.Fatalf("expected instances from all 4 sources, got %d", cache.Size())
+	}
+}
+
+func TestMulticastProviderIgnoresReannouncements(t *testing.T) {
+	initSCAMPLogger()
+
+	cert, err := GenerateServiceCert("heartbeat", CertOptions{KeyType: KeyTypeECDSA})
+	if err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+	serv, err := NewServiceExplicitCert("main", "127.0.0.1:0", "heartbeat", cert.Keypair, cert.PEMCert)
+	if err != nil {
+		t.Fatalf("could not create service: `%s`", err)
+	}
+	defer serv.Stop()
+	serv.Register("Echo.echo", func(_ *Message, _ *Client) {})
+	announce := func() *ServiceInstance {
+		time.Sleep(2 * time.Millisecond)
+		record, err := serv.MarshalText()
+		if err != nil {
+			t.Fatalf("could not marshal announcement: `%s`", err)
+		}
+		instance, err := ParseAnnouncePacket(record)
+		if err != nil {
+			t.Fatalf("could not parse announcement: `%s`", err)
+		}
+		return instance
+	}
+
+	provider := NewMulticastProvider(nil)
+	now := time.Now()
+	first := announce()
+	if !provider.Observe(first, now) {
+		t.Fatalf("expected a new instance to be a change")
+	}
+
+	// the next announcement differs only in its timestamp
+	second := announce()
+	if bytes.Equal(first.rawClassRecords, second.rawClassRecords) {
+		t.Fatalf("expected the announcements to have different timestamps")
+	}
+	if !first.SameAnnouncement(second) {
+		t.Fatalf("expected announcements differing in timestamp to be the same")
+	}
+	if provider.Observe(second, now.Add(time.Second)) {
+		t.Fatalf("expected a re-announcement not to be a change")
+	}
+	if instances := provider.Instances(); len(instances) != 1 || instances[0] != second {
+		t.Fatalf("expected the newest announcement to be kept")
+	}
+
+	serv.SetWeight(2)
+	if !provider.Observe(announce(), now.Add(2*time.Second)) {
+		t.Fatalf("expected a new weight to be a change")
+	}
+}
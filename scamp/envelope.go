@@ -0,0 +1,228 @@
+package scamp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// EnvelopeCodec encodes and decodes message bodies for one envelope format. msg is the
+// message being written or read; codecs may use its header values (type, action, request id)
+// to build or unwrap the envelope.
+type EnvelopeCodec interface {
+	Encode(msg *Message, data interface{}) ([]byte, error)
+	Decode(msg *Message, body []byte, v interface{}) error
+}
+
+type envelopeRegistration struct {
+	name  string
+	codec EnvelopeCodec
+}
+
+var envelopesM sync.RWMutex
+var envelopes = make(map[envelopeFormat]envelopeRegistration)
+var envelopesByName = make(map[string]envelopeFormat)
+var nextEnvelopeFormat = EnvelopeCBOR + 1
+
+func init() {
+	registerEnvelope(EnvelopeJSON, "json", jsonCodec{})
+	registerEnvelope(EnvelopeJSONSTORE, "jsonstore", jsonStoreCodec{})
+	registerEnvelope(EnvelopeEXTDIRECT, "extdirect", extDirectCodec{})
+	registerEnvelope(EnvelopeMSGPACK, "msgpack", msgpackCodec{})
+	registerEnvelope(EnvelopeCBOR, "cbor", cborCodec{})
+}
+
+func registerEnvelope(format envelopeFormat, name string, codec EnvelopeCodec) {
+	envelopesM.Lock()
+	defer envelopesM.Unlock()
+
+	envelopes[format] = envelopeRegistration{name: name, codec: codec}
+	envelopesByName[name] = format
+}
+
+// RegisterEnvelope adds a codec for the envelope called name (as it appears in packet headers
+// and announced protocol lists) and returns the format to use with Message.SetEnvelope.
+func RegisterEnvelope(name string, codec EnvelopeCodec) (format envelopeFormat, err error) {
+	if len(name) == 0 || strings.ContainsAny(name, ",\"") {
+		err = fmt.Errorf("invalid envelope name `%s`", name)
+		return
+	}
+
+	envelopesM.Lock()
+	defer envelopesM.Unlock()
+
+	if _, ok := envelopesByName[name]; ok {
+		err = fmt.Errorf("envelope `%s` is already registered", name)
+		return
+	}
+
+	format = nextEnvelopeFormat
+	nextEnvelopeFormat++
+
+	envelopes[format] = envelopeRegistration{name: name, codec: codec}
+	envelopesByName[name] = format
+
+	return
+}
+
+// EnvelopeByName looks up a registered envelope by its wire name
+func EnvelopeByName(name string) (format envelopeFormat, ok bool) {
+	envelopesM.RLock()
+	defer envelopesM.RUnlock()
+
+	format, ok = envelopesByName[name]
+	return
+}
+
+func (envFormat envelopeFormat) String() string {
+	envelopesM.RLock()
+	defer envelopesM.RUnlock()
+
+	reg, ok := envelopes[envFormat]
+	if !ok {
+		return fmt.Sprintf("unknown(%d)", int(envFormat))
+	}
+	return reg.name
+}
+
+func (envFormat envelopeFormat) codec() (codec EnvelopeCodec, err error) {
+	envelopesM.RLock()
+	defer envelopesM.RUnlock()
+
+	reg, ok := envelopes[envFormat]
+	if !ok {
+		err = fmt.Errorf("unknown format `%d`", envFormat)
+		return
+	}
+	return reg.codec, nil
+}
+
+// jsonCodec is the `json` envelope: the body is the JSON encoding of the payload and errors are
+// carried in the reply headers.
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(_ *Message, data interface{}) ([]byte, error) {
+	return json.Marshal(data)
+}
+
+func (jsonCodec) Decode(_ *Message, body []byte, v interface{}) error {
+	return json.Unmarshal(body, v)
+}
+
+// jsonStoreCodec is the `jsonstore` envelope used by Ext JS data stores. Requests are plain JSON
+// like the `json` envelope. Replies are wrapped in a store result:
+//
+//	{"success":true,"data":PAYLOAD}
+//
+// A reply with `"success":false` decodes to an error carrying its `message`.
+type jsonStoreCodec struct{}
+
+type jsonStoreReply struct {
+	Success bool            `json:"success"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	Message string          `json:"message,omitempty"`
+}
+
+func (jsonStoreCodec) Encode(msg *Message, data interface{}) (body []byte, err error) {
+	if msg.MessageType != MessageTypeReply {
+		return json.Marshal(data)
+	}
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	return json.Marshal(jsonStoreReply{Success: true, Data: raw})
+}
+
+func (jsonStoreCodec) Decode(msg *Message, body []byte, v interface{}) (err error) {
+	if msg.MessageType != MessageTypeReply {
+		return json.Unmarshal(body, v)
+	}
+
+	var reply jsonStoreReply
+	err = json.Unmarshal(body, &reply)
+	if err != nil {
+		return
+	}
+	if !reply.Success {
+		return &ReplyError{Code: defaultErrorCode, Message: reply.Message}
+	}
+	if len(reply.Data) == 0 {
+		return
+	}
+	return json.Unmarshal(reply.Data, v)
+}
+
+// extDirectCodec is the `extdirect` envelope, an Ext.Direct RPC transaction. The message action
+// `Class.method` is split into the Ext.Direct action and method and the request id is used as
+// the transaction id. Requests carry the payload as the single entry of `data`:
+//
+//	{"type":"rpc","tid":1,"action":"Class","method":"method","data":[PAYLOAD]}
+//
+// and replies carry it as `result`. An `exception` reply decodes to an error.
+type extDirectCodec struct{}
+
+type extDirectTransaction struct {
+	Type    string            `json:"type"`
+	TID     int               `json:"tid"`
+	Action  string            `json:"action,omitempty"`
+	Method  string            `json:"method,omitempty"`
+	Data    []json.RawMessage `json:"data,omitempty"`
+	Result  json.RawMessage   `json:"result,omitempty"`
+	Message string            `json:"message,omitempty"`
+}
+
+func splitActionName(action string) (className, methodName string) {
+	dotIndex := strings.LastIndex(action, ".")
+	if dotIndex == -1 {
+		return "", action
+	}
+	return action[:dotIndex], action[dotIndex+1:]
+}
+
+func (extDirectCodec) Encode(msg *Message, data interface{}) (body []byte, err error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+
+	txn := extDirectTransaction{Type: "rpc", TID: msg.RequestID}
+	txn.Action, txn.Method = splitActionName(msg.Action)
+	if msg.MessageType == MessageTypeReply {
+		txn.Result = raw
+	} else {
+		txn.Data = []json.RawMessage{raw}
+	}
+
+	return json.Marshal(&txn)
+}
+
+func (extDirectCodec) Decode(msg *Message, body []byte, v interface{}) (err error) {
+	var txn extDirectTransaction
+	err = json.Unmarshal(body, &txn)
+	if err != nil {
+		return
+	}
+
+	switch txn.Type {
+	case "exception":
+		return &ReplyError{Code: defaultErrorCode, Message: txn.Message}
+	case "rpc":
+	default:
+		return fmt.Errorf("unexpected extdirect transaction type `%s`", txn.Type)
+	}
+
+	var raw json.RawMessage
+	if msg.MessageType == MessageTypeReply {
+		raw = txn.Result
+	} else if len(txn.Data) > 0 {
+		raw = txn.Data[0]
+	}
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return
+	}
+	return json.Unmarshal(raw, v)
+}
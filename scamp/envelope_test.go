@@ -0,0 +1,121 @@
+package scamp
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestEnvelopeNames(t *testing.T) {
+	for _, envelope := range []envelopeFormat{EnvelopeJSON, EnvelopeJSONSTORE, EnvelopeEXTDIRECT, EnvelopeMSGPACK, EnvelopeCBOR} {
+		b, err := json.Marshal(envelope)
+		if err != nil {
+			t.Fatalf("could not marshal envelope %d: `%s`", envelope, err)
+		}
+
+		var decoded envelopeFormat
+		err = json.Unmarshal(b, &decoded)
+		if err != nil {
+			t.Fatalf("could not unmarshal `%s`: `%s`", b, err)
+		}
+		if decoded != envelope {
+			t.Fatalf("expected %d, got %d", envelope, decoded)
+		}
+	}
+
+	_, err := json.Marshal(envelopeFormat(999))
+	if err == nil {
+		t.Fatalf("expected an error marshalling an unknown envelope")
+	}
+}
+
+func TestRegisterEnvelopeRejectsDuplicates(t *testing.T) {
+	_, err := RegisterEnvelope("json", jsonCodec{})
+	if err == nil {
+		t.Fatalf("expected an error registering `json` twice")
+	}
+}
+
+func TestEnvelopeRoundTrips(t *testing.T) {
+	for _, envelope := range []envelopeFormat{EnvelopeJSON, EnvelopeJSONSTORE, EnvelopeEXTDIRECT, EnvelopeMSGPACK, EnvelopeCBOR} {
+		for _, mtype := range []messageType{MessageTypeRequest, MessageTypeReply} {
+			msg := NewMessage()
+			msg.SetMessageType(mtype)
+			msg.SetEnvelope(envelope)
+			msg.SetAction("Logger.info")
+			msg.SetRequestID(3)
+
+			_, err := msg.WriteEnvelope(echoRequest{Name: "bob"})
+			if err != nil {
+				t.Fatalf("%s: could not encode: `%s`", envelope, err)
+			}
+
+			var decoded echoRequest
+			err = msg.ReadEnvelope(&decoded)
+			if err != nil {
+				t.Fatalf("%s: could not decode `%s`: `%s`", envelope, msg.Bytes(), err)
+			}
+			if decoded.Name != "bob" {
+				t.Fatalf("%s: round trip lost the payload: `%s`", envelope, msg.Bytes())
+			}
+		}
+	}
+}
+
+func TestExtDirectEnvelope(t *testing.T) {
+	msg := NewRequestMessage()
+	msg.SetEnvelope(EnvelopeEXTDIRECT)
+	msg.SetAction("Logger.info")
+	msg.SetRequestID(3)
+	msg.WriteEnvelope(echoRequest{Name: "bob"})
+
+	expected := []byte(`{"type":"rpc","tid":3,"action":"Logger","method":"info","data":[{"name":"bob"}]}`)
+	if !bytes.Equal(msg.Bytes(), expected) {
+		t.Fatalf("expected `%s`, got `%s`", expected, msg.Bytes())
+	}
+
+	reply := NewResponseMessage()
+	reply.SetEnvelope(EnvelopeEXTDIRECT)
+	reply.Write([]byte(`{"type":"exception","tid":3,"message":"nope"}`))
+
+	var resp echoResponse
+	err := reply.ReadEnvelope(&resp)
+	if replyErr, ok := err.(*ReplyError); !ok || replyErr.Message != "nope" {
+		t.Fatalf("expected exception to decode as a ReplyError, got `%v`", err)
+	}
+}
+
+func TestJSONStoreEnvelopeFailure(t *testing.T) {
+	reply := NewResponseMessage()
+	reply.SetEnvelope(EnvelopeJSONSTORE)
+	reply.Write([]byte(`{"success":false,"message":"nope"}`))
+
+	var resp echoResponse
+	err := reply.ReadEnvelope(&resp)
+	if replyErr, ok := err.(*ReplyError); !ok || replyErr.Message != "nope" {
+		t.Fatalf("expected failure to decode as a ReplyError, got `%v`", err)
+	}
+}
+
+func TestServiceAnnouncesRegisteredEnvelopes(t *testing.T) {
+	s := Service{
+		actions: make(map[string]*ServiceAction),
+	}
+	s.Register("Logging.info", func(_ *Message, _ *Client) {})
+	s.RegisterEnvelopes("Logging.store", []envelopeFormat{EnvelopeJSONSTORE, EnvelopeEXTDIRECT}, func(_ *Message, _ *Client) {})
+
+	protocols := serviceEnvelopes(&s)
+	expected := []string{"json", "jsonstore", "extdirect"}
+	if len(protocols) != len(expected) {
+		t.Fatalf("expected %s, got %s", expected, protocols)
+	}
+	for i := range expected {
+		if protocols[i] != expected[i] {
+			t.Fatalf("expected %s, got %s", expected, protocols)
+		}
+	}
+
+	if s.actions["Logging.info"].acceptsEnvelope(EnvelopeEXTDIRECT) {
+		t.Fatalf("Register should only accept the json envelope")
+	}
+}
@@ -1,9 +1,5 @@
 package scamp
 
-import (
-	"fmt"
-)
-
 var DefaultCache *ServiceCache
 
 //Initialize performs package-level setup. This must be called before calling any other package functionality, as it sets up global configuration.
@@ -14,13 +10,12 @@ func Initialize(configPath string) (err error) {
 		return
 	}
 
-	cachePath, found := DefaultConfig().Get("discovery.cache_path")
-	if !found {
-		err = fmt.Errorf("no such config param `discovery.cache_path`. must be set to use scamp-go")
+	DefaultCache, err = loadServiceCache(DefaultConfig())
+	if err != nil {
 		return
 	}
 
-	DefaultCache, err = NewServiceCache(cachePath)
+	defaultRequester, err = NewRequester(DefaultConfig(), DefaultCache)
 	if err != nil {
 		return
 	}
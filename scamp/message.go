@@ -18,6 +18,12 @@ type Message struct {
 	IdentifyingToken string
 	Error            string
 	ErrorCode        string
+	// Compression is the algorithm the body is (or will be, when sent) compressed with
+	Compression string
+	// AcceptCompression lists the algorithms a requester can read in the reply
+	AcceptCompression string
+	// bodyErr is set when a received body could not be decompressed
+	bodyErr error
 }
 
 // NewMessage creates a new scamp message
@@ -45,7 +51,7 @@ func (msg *Message) SetAction(action string) {
 	msg.Action = action
 }
 
-// SetEnvelope sets the envelope type fr a message (JSON, or JSONSTORE)
+// SetEnvelope sets the envelope type fr a message (JSON, JSONSTORE, EXTDIRECT or a registered codec)
 func (msg *Message) SetEnvelope(env envelopeFormat) {
 	msg.Envelope = env
 }
@@ -125,12 +131,46 @@ func (msg *Message) WriteJSON(data interface{}) (n int, err error) {
 		return
 	}
 
-	msg.bytesWritten += uint64(len(buf.Bytes()))
+	msg.writeChunked(buf.Bytes())
 
-	// Trace.Printf("WriteJson data size: %d", len(buf.Bytes()))
+	return
+}
+
+// WriteEnvelope encodes the payload with the codec for msg.Envelope and appends it (in chunks)
+// to msg.packets. Set the message type, action and request id first; some envelopes embed them.
+func (msg *Message) WriteEnvelope(data interface{}) (n int, err error) {
+	codec, err := msg.Envelope.codec()
+	if err != nil {
+		return
+	}
+
+	body, err := codec.Encode(msg, data)
+	if err != nil {
+		return
+	}
+
+	msg.writeChunked(body)
+
+	return len(body), nil
+}
+
+// ReadEnvelope decodes the message body into v with the codec for msg.Envelope
+func (msg *Message) ReadEnvelope(v interface{}) (err error) {
+	codec, err := msg.Envelope.codec()
+	if err != nil {
+		return
+	}
+
+	return codec.Decode(msg, msg.Bytes(), v)
+}
+
+func (msg *Message) writeChunked(body []byte) {
+	msg.bytesWritten += uint64(len(body))
+
+	// Trace.Printf("WriteJson data size: %d", len(body))
 
-	if len(buf.Bytes()) > msgChunkSize {
-		slice := buf.Bytes()[:]
+	if len(body) > msgChunkSize {
+		slice := body[:]
 		for {
 			// Trace.Printf("slice size: %d", len(slice))
 
@@ -146,10 +186,8 @@ func (msg *Message) WriteJSON(data interface{}) (n int, err error) {
 		}
 
 	} else {
-		msg.packets = append(msg.packets, &Packet{packetType: DATA, body: buf.Bytes()})
+		msg.packets = append(msg.packets, &Packet{packetType: DATA, body: body})
 	}
-
-	return
 }
 
 // BytesWritten returns msg.bytesWritten
@@ -157,17 +195,24 @@ func (msg *Message) BytesWritten() uint64 {
 	return msg.bytesWritten
 }
 
-func (msg *Message) toPackets(msgNo uint64) []*Packet {
+func (msg *Message) toPackets(msgNo uint64) (packets []*Packet, err error) {
+	dataPackets, compression, err := msg.wireBody()
+	if err != nil {
+		return
+	}
+
 	headerHeader := PacketHeader{
-		Action:           msg.Action,
-		Envelope:         msg.Envelope,
-		Version:          msg.Version,
-		RequestID:        msg.RequestID, // TODO: nope, can't do this
-		MessageType:      msg.MessageType,
-		Error:            msg.Error,
-		ErrorCode:        msg.ErrorCode,
-		Ticket:           msg.GetTicket(),
-		IdentifyingToken: msg.GetIdentifyingToken(),
+		Action:            msg.Action,
+		Envelope:          msg.Envelope,
+		Version:           msg.Version,
+		RequestID:         msg.RequestID, // TODO: nope, can't do this
+		MessageType:       msg.MessageType,
+		Error:             msg.Error,
+		ErrorCode:         msg.ErrorCode,
+		Ticket:            msg.GetTicket(),
+		IdentifyingToken:  msg.GetIdentifyingToken(),
+		Compression:       compression,
+		AcceptCompression: msg.AcceptCompression,
 	}
 
 	headerPacket := Packet{
@@ -181,17 +226,17 @@ func (msg *Message) toPackets(msgNo uint64) []*Packet {
 		msgNo:      msgNo,
 	}
 
-	packets := make([]*Packet, 1)
+	packets = make([]*Packet, 1)
 	packets[0] = &headerPacket
 
-	for _, dataPacket := range msg.packets {
+	for _, dataPacket := range dataPackets {
 		dataPacket.msgNo = msgNo
 		packets = append(packets, dataPacket)
 	}
 
 	packets = append(packets, &eofPacket)
 
-	return packets
+	return
 }
 
 // Bytes reads from all message packets, writes them to a buffer and returns the buffer.Bytes()
@@ -0,0 +1,336 @@
+package scamp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// msgpackCodec is the `msgpack` envelope: the body is the MessagePack encoding of the payload,
+// built with the same field rules as the `json` envelope. Errors are carried in the reply headers.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Encode(_ *Message, data interface{}) (body []byte, err error) {
+	return marshalMsgpack(data)
+}
+
+func (msgpackCodec) Decode(_ *Message, body []byte, v interface{}) (err error) {
+	return unmarshalMsgpack(body, v)
+}
+
+func marshalMsgpack(data interface{}) (body []byte, err error) {
+	w := new(msgpackWriter)
+	err = encodeBinaryValue(w, reflect.ValueOf(data))
+	if err != nil {
+		return
+	}
+	return w.buf.Bytes(), nil
+}
+
+func unmarshalMsgpack(body []byte, v interface{}) (err error) {
+	r := &msgpackReader{data: body}
+	x, err := r.readValue(0)
+	if err != nil {
+		return
+	}
+	if r.pos != len(r.data) {
+		return fmt.Errorf("msgpack: %d trailing bytes", len(r.data)-r.pos)
+	}
+	return decodeBinaryInto(x, v)
+}
+
+type msgpackWriter struct {
+	buf     bytes.Buffer
+	scratch [9]byte
+}
+
+func (w *msgpackWriter) writeMarker(marker byte, n uint64, size int) {
+	w.scratch[0] = marker
+	switch size {
+	case 1:
+		w.scratch[1] = byte(n)
+	case 2:
+		binary.BigEndian.PutUint16(w.scratch[1:], uint16(n))
+	case 4:
+		binary.BigEndian.PutUint32(w.scratch[1:], uint32(n))
+	case 8:
+		binary.BigEndian.PutUint64(w.scratch[1:], n)
+	}
+	w.buf.Write(w.scratch[:1+size])
+}
+
+func (w *msgpackWriter) writeNil() {
+	w.buf.WriteByte(0xc0)
+}
+
+func (w *msgpackWriter) writeBool(b bool) {
+	if b {
+		w.buf.WriteByte(0xc3)
+	} else {
+		w.buf.WriteByte(0xc2)
+	}
+}
+
+func (w *msgpackWriter) writeInt(i int64) {
+	switch {
+	case i >= 0:
+		w.writeUint(uint64(i))
+	case i >= -32:
+		w.buf.WriteByte(byte(i))
+	case i >= math.MinInt8:
+		w.writeMarker(0xd0, uint64(i), 1)
+	case i >= math.MinInt16:
+		w.writeMarker(0xd1, uint64(i), 2)
+	case i >= math.MinInt32:
+		w.writeMarker(0xd2, uint64(i), 4)
+	default:
+		w.writeMarker(0xd3, uint64(i), 8)
+	}
+}
+
+func (w *msgpackWriter) writeUint(u uint64) {
+	switch {
+	case u <= 0x7f:
+		w.buf.WriteByte(byte(u))
+	case u <= math.MaxUint8:
+		w.writeMarker(0xcc, u, 1)
+	case u <= math.MaxUint16:
+		w.writeMarker(0xcd, u, 2)
+	case u <= math.MaxUint32:
+		w.writeMarker(0xce, u, 4)
+	default:
+		w.writeMarker(0xcf, u, 8)
+	}
+}
+
+func (w *msgpackWriter) writeFloat(f float64) {
+	w.writeMarker(0xcb, math.Float64bits(f), 8)
+}
+
+func (w *msgpackWriter) writeString(s string) {
+	n := uint64(len(s))
+	switch {
+	case n < 32:
+		w.buf.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		w.writeMarker(0xd9, n, 1)
+	case n <= math.MaxUint16:
+		w.writeMarker(0xda, n, 2)
+	default:
+		w.writeMarker(0xdb, n, 4)
+	}
+	w.buf.WriteString(s)
+}
+
+func (w *msgpackWriter) writeBytes(b []byte) {
+	n := uint64(len(b))
+	switch {
+	case n <= math.MaxUint8:
+		w.writeMarker(0xc4, n, 1)
+	case n <= math.MaxUint16:
+		w.writeMarker(0xc5, n, 2)
+	default:
+		w.writeMarker(0xc6, n, 4)
+	}
+	w.buf.Write(b)
+}
+
+func (w *msgpackWriter) writeArrayHeader(n int) {
+	switch {
+	case n < 16:
+		w.buf.WriteByte(0x90 | byte(n))
+	case n <= math.MaxUint16:
+		w.writeMarker(0xdc, uint64(n), 2)
+	default:
+		w.writeMarker(0xdd, uint64(n), 4)
+	}
+}
+
+func (w *msgpackWriter) writeMapHeader(n int) {
+	switch {
+	case n < 16:
+		w.buf.WriteByte(0x80 | byte(n))
+	case n <= math.MaxUint16:
+		w.writeMarker(0xde, uint64(n), 2)
+	default:
+		w.writeMarker(0xdf, uint64(n), 4)
+	}
+}
+
+// maxBinaryDepth bounds nesting when decoding untrusted binary bodies
+const maxBinaryDepth = 512
+
+var errBinaryTruncated = errors.New("unexpected end of data")
+
+type msgpackReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *msgpackReader) next(n int) (b []byte, err error) {
+	if n < 0 || len(r.data)-r.pos < n {
+		return nil, errBinaryTruncated
+	}
+	b = r.data[r.pos : r.pos+n]
+	r.pos += n
+	return
+}
+
+func (r *msgpackReader) readUint(size int) (u uint64, err error) {
+	b, err := r.next(size)
+	if err != nil {
+		return
+	}
+	switch size {
+	case 1:
+		u = uint64(b[0])
+	case 2:
+		u = uint64(binary.BigEndian.Uint16(b))
+	case 4:
+		u = uint64(binary.BigEndian.Uint32(b))
+	case 8:
+		u = binary.BigEndian.Uint64(b)
+	}
+	return
+}
+
+func (r *msgpackReader) readValue(depth int) (x interface{}, err error) {
+	if depth > maxBinaryDepth {
+		return nil, fmt.Errorf("msgpack: nesting too deep")
+	}
+
+	b, err := r.next(1)
+	if err != nil {
+		return
+	}
+	marker := b[0]
+
+	switch {
+	case marker <= 0x7f:
+		return int64(marker), nil
+	case marker >= 0xe0:
+		return int64(int8(marker)), nil
+	case marker&0xf0 == 0x80:
+		return r.readMap(int(marker&0x0f), depth)
+	case marker&0xf0 == 0x90:
+		return r.readArray(int(marker&0x0f), depth)
+	case marker&0xe0 == 0xa0:
+		return r.readString(int(marker & 0x1f))
+	}
+
+	var n uint64
+	switch marker {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err = r.readUint(1 << (marker - 0xc4))
+		if err != nil {
+			return
+		}
+		raw, err := r.next(int(n))
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), raw...), nil
+	case 0xca:
+		n, err = r.readUint(4)
+		return float64(math.Float32frombits(uint32(n))), err
+	case 0xcb:
+		n, err = r.readUint(8)
+		return math.Float64frombits(n), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, err = r.readUint(1 << (marker - 0xcc))
+		return n, err
+	case 0xd0:
+		n, err = r.readUint(1)
+		return int64(int8(n)), err
+	case 0xd1:
+		n, err = r.readUint(2)
+		return int64(int16(n)), err
+	case 0xd2:
+		n, err = r.readUint(4)
+		return int64(int32(n)), err
+	case 0xd3:
+		n, err = r.readUint(8)
+		return int64(n), err
+	case 0xd9, 0xda, 0xdb:
+		n, err = r.readUint(1 << (marker - 0xd9))
+		if err != nil {
+			return
+		}
+		return r.readString(int(n))
+	case 0xdc, 0xdd:
+		n, err = r.readUint(2 << (marker - 0xdc))
+		if err != nil {
+			return
+		}
+		return r.readArray(int(n), depth)
+	case 0xde, 0xdf:
+		n, err = r.readUint(2 << (marker - 0xde))
+		if err != nil {
+			return
+		}
+		return r.readMap(int(n), depth)
+	}
+
+	return nil, fmt.Errorf("msgpack: unsupported type 0x%02x", marker)
+}
+
+func (r *msgpackReader) readString(n int) (x interface{}, err error) {
+	b, err := r.next(n)
+	if err != nil {
+		return
+	}
+	return string(b), nil
+}
+
+func (r *msgpackReader) readArray(n int, depth int) (x interface{}, err error) {
+	if n > len(r.data)-r.pos {
+		return nil, errBinaryTruncated
+	}
+	items := make([]interface{}, n)
+	for i := range items {
+		items[i], err = r.readValue(depth + 1)
+		if err != nil {
+			return
+		}
+	}
+	return items, nil
+}
+
+func (r *msgpackReader) readMap(n int, depth int) (x interface{}, err error) {
+	if n > len(r.data)-r.pos {
+		return nil, errBinaryTruncated
+	}
+	entries := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		key, err := r.readValue(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		value, err := r.readValue(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		entries[binaryKeyString(key)] = value
+	}
+	return entries, nil
+}
+
+// binaryKeyString turns a decoded map key into the string key used for generic maps
+func binaryKeyString(key interface{}) string {
+	switch k := key.(type) {
+	case string:
+		return k
+	case []byte:
+		return string(k)
+	}
+	return fmt.Sprint(key)
+}
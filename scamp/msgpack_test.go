@@ -0,0 +1,68 @@
+package scamp
+
+import (
+	"bytes"
+	"testing"
+)
+
+type binaryPayload struct {
+	Name    string            `json:"name"`
+	Count   int               `json:"count"`
+	Ratio   float64           `json:"ratio,omitempty"`
+	Tags    []string          `json:"tags"`
+	Attrs   map[string]int    `json:"attrs"`
+	Raw     []byte            `json:"raw"`
+	Skipped string            `json:"-"`
+	Nested  *binaryPayload    `json:"nested,omitempty"`
+	Extra   map[string]string `json:"extra,omitempty"`
+}
+
+func TestMsgpackEncoding(t *testing.T) {
+	body, err := marshalMsgpack(map[string]interface{}{"a": 1, "b": []interface{}{true, nil, "x"}, "c": -33})
+	if err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+
+	expected := []byte{0x83, 0xa1, 'a', 0x01, 0xa1, 'b', 0x93, 0xc3, 0xc0, 0xa1, 'x', 0xa1, 'c', 0xd0, 0xdf}
+	if !bytes.Equal(body, expected) {
+		t.Fatalf("expected `% x`, got `% x`", expected, body)
+	}
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	in := binaryPayload{
+		Name:    "inventory",
+		Count:   -70000,
+		Ratio:   0.25,
+		Tags:    []string{"a", "b"},
+		Attrs:   map[string]int{"x": 300},
+		Raw:     []byte{0, 1, 2},
+		Skipped: "not sent",
+		Nested:  &binaryPayload{Name: "child", Count: 1 << 40},
+	}
+
+	body, err := marshalMsgpack(in)
+	if err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+
+	var out binaryPayload
+	err = unmarshalMsgpack(body, &out)
+	if err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+
+	if out.Name != in.Name || out.Count != in.Count || out.Ratio != in.Ratio || len(out.Tags) != 2 ||
+		out.Attrs["x"] != 300 || !bytes.Equal(out.Raw, in.Raw) || out.Skipped != "" ||
+		out.Nested == nil || out.Nested.Count != 1<<40 {
+		t.Fatalf("round trip mismatch: %+v", out)
+	}
+}
+
+func TestMsgpackRejectsTruncated(t *testing.T) {
+	var out interface{}
+	err := unmarshalMsgpack([]byte{0x92, 0x01}, &out)
+	if err == nil {
+		t.Fatalf("expected an error for a truncated array")
+	}
+}
@@ -37,6 +37,8 @@ func localMulticastPacketConn() (conn *ipv4.PacketConn, err error) {
 	return
 }
 
+// getIPForAnnouncePacket picks the first IPv4 address of a non-loopback interface,
+// falling back to a global unicast IPv6 address on IPv6-only hosts
 func getIPForAnnouncePacket() (ip net.IP, err error) {
 	infs, err := net.Interfaces()
 	if err != nil {
@@ -44,6 +46,7 @@ func getIPForAnnouncePacket() (ip net.IP, err error) {
 		return
 	}
 
+	var ip6 net.IP
 	for _, inf := range infs {
 		if inf.Flags&net.FlagLoopback != 0 {
 			continue
@@ -61,6 +64,10 @@ func getIPForAnnouncePacket() (ip net.IP, err error) {
 				continue
 			} else if ip.To4() == nil {
 				// Trace.Printf("IP is not IPv4: `%s`\n", ip)
+				if ip6 == nil && ip.IsGlobalUnicast() {
+					ip6 = ip
+				}
+				ip = nil
 				continue
 			}
 			break
@@ -70,6 +77,9 @@ func getIPForAnnouncePacket() (ip net.IP, err error) {
 		}
 	}
 
+	if ip == nil {
+		ip = ip6
+	}
 	if ip == nil {
 		err = fmt.Errorf("no suitables IPs found")
 		return
@@ -6,13 +6,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"sync/atomic"
 )
 
 const (
 	theRestSize = 5
 )
 
-var packetSeenSinceBoot = 0
+// packetSeenSinceBoot counts packets read by every connection
+var packetSeenSinceBoot int64
 
 // Packet represents a message packet
 type Packet struct {
@@ -110,7 +112,7 @@ func ReadPacket(reader *bufio.ReadWriter) (pkt *Packet, err error) {
 	}
 
 	// Trace.Printf("(%d) done reading packet", packetSeenSinceBoot)
-	packetSeenSinceBoot = packetSeenSinceBoot + 1
+	atomic.AddInt64(&packetSeenSinceBoot, 1)
 	return pkt, nil
 }
 
@@ -143,7 +145,7 @@ func (pkt *Packet) Write(writer io.Writer) (written int, err error) {
 	case ACK:
 		packetTypeBytes = ackBytes
 	default:
-		err = fmt.Errorf(fmt.Sprintf("unknown packetType `%d`", pkt.packetType))
+		err = fmt.Errorf("unknown packetType `%d`", pkt.packetType)
 		return
 	}
 
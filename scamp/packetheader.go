@@ -17,6 +17,12 @@ const (
 	EnvelopeJSON envelopeFormat = iota
 	// EnvelopeJSONSTORE JSONSTORE message envelope
 	EnvelopeJSONSTORE
+	// EnvelopeEXTDIRECT EXTDIRECT message envelope
+	EnvelopeEXTDIRECT
+	// EnvelopeMSGPACK MessagePack message envelope
+	EnvelopeMSGPACK
+	// EnvelopeCBOR CBOR message envelope
+	EnvelopeCBOR
 )
 
 // PacketHeader Serialized to JSON and stuffed in the 'header' property
@@ -31,32 +37,32 @@ type PacketHeader struct {
 	IdentifyingToken string         `json:"identifying_token"`
 	MessageType      messageType    `json:"type"`    // both
 	Version          int            `json:"version"` // request
+	// Compression names the algorithm the DATA packets are compressed with. It is only set when
+	// the peer asked for it with AcceptCompression (or for requests, when the caller opted in).
+	Compression       string `json:"compression,omitempty"`        // both
+	AcceptCompression string `json:"accept_compression,omitempty"` // request
 }
 
-var envelopeJSONBytes = []byte(`"json"`)
-var envelopeJSONStoreBytes = []byte(`"jsonstore"`)
-
 func (envFormat envelopeFormat) MarshalJSON() (retval []byte, err error) {
-	switch envFormat {
-	case EnvelopeJSON:
-		retval = envelopeJSONBytes
-	case EnvelopeJSONSTORE:
-		retval = envelopeJSONStoreBytes
-	default:
-		err = fmt.Errorf("unknown format `%d`", envFormat)
+	if _, err = envFormat.codec(); err != nil {
+		return
 	}
 
-	return
+	return json.Marshal(envFormat.String())
 }
 
 func (envFormat *envelopeFormat) UnmarshalJSON(incoming []byte) error {
-	if bytes.Equal(envelopeJSONBytes, incoming) {
-		*envFormat = EnvelopeJSON
-	} else if bytes.Equal(envelopeJSONStoreBytes, incoming) {
-		*envFormat = EnvelopeJSONSTORE
-	} else {
+	var name string
+	err := json.Unmarshal(incoming, &name)
+	if err != nil {
+		return fmt.Errorf("unknown envelope type `%s`", incoming)
+	}
+
+	format, ok := EnvelopeByName(name)
+	if !ok {
 		return fmt.Errorf("unknown envelope type `%s`", incoming)
 	}
+	*envFormat = format
 	return nil
 }
 
@@ -97,7 +103,7 @@ func (messageType *messageType) UnmarshalJSON(incoming []byte) (err error) {
 	} else if bytes.Equal(replyBytes, incoming) {
 		*messageType = MessageTypeReply
 	} else {
-		Error.Printf(fmt.Sprintf("unknown message type `%s`", incoming))
+		Error.Printf("unknown message type `%s`", incoming)
 		err = fmt.Errorf("unknown message type `%s`", incoming)
 	}
 
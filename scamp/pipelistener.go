@@ -0,0 +1,127 @@
+package scamp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// PipeConnspecScheme is the connspec scheme of services served over a PipeListener,
+// e.g. `scamp+pipe://logger`
+const PipeConnspecScheme = "scamp+pipe"
+
+var errPipeListenerClosed = errors.New("pipe listener closed")
+
+var (
+	pipeListenersM sync.Mutex
+	pipeListeners  = make(map[string]*PipeListener)
+)
+
+// PipeListener is an in-process net.Listener. Every Dial creates a net.Pipe and hands
+// the other end to Accept, so a Service and its clients can talk without TLS files or
+// sockets. Listeners are registered by name while open so `scamp+pipe://name`
+// connspecs resolve to them.
+type PipeListener struct {
+	name      string
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewPipeListener creates and registers a PipeListener. name must not be in use by
+// another open PipeListener.
+func NewPipeListener(name string) (l *PipeListener, err error) {
+	pipeListenersM.Lock()
+	defer pipeListenersM.Unlock()
+
+	if _, ok := pipeListeners[name]; ok {
+		err = fmt.Errorf("pipe listener `%s` already exists", name)
+		return
+	}
+
+	l = &PipeListener{
+		name:   name,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	pipeListeners[name] = l
+
+	return
+}
+
+// Accept waits for the next Dial
+func (l *PipeListener) Accept() (conn net.Conn, err error) {
+	select {
+	case conn = <-l.conns:
+		return
+	case <-l.closed:
+		err = errPipeListenerClosed
+		return
+	}
+}
+
+// Dial connects to the listener and returns the client end of the pipe
+func (l *PipeListener) Dial() (conn net.Conn, err error) {
+	clientSide, serviceSide := net.Pipe()
+
+	select {
+	case l.conns <- serviceSide:
+		conn = clientSide
+		return
+	case <-l.closed:
+		clientSide.Close()
+		serviceSide.Close()
+		err = errPipeListenerClosed
+		return
+	}
+}
+
+// Close stops the listener and unregisters its name. Connections already accepted stay open.
+func (l *PipeListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+
+		pipeListenersM.Lock()
+		if pipeListeners[l.name] == l {
+			delete(pipeListeners, l.name)
+		}
+		pipeListenersM.Unlock()
+	})
+
+	return nil
+}
+
+// Addr returns the listener's name as a net.Addr
+func (l *PipeListener) Addr() net.Addr {
+	return pipeAddr(l.name)
+}
+
+// Connspec is the connspec clients use to reach this listener
+func (l *PipeListener) Connspec() string {
+	return fmt.Sprintf("%s://%s", PipeConnspecScheme, l.name)
+}
+
+type pipeAddr string
+
+func (addr pipeAddr) Network() string { return "pipe" }
+func (addr pipeAddr) String() string  { return string(addr) }
+
+// dialPipe connects a client to the open PipeListener called name
+func dialPipe(name string) (client *Client, err error) {
+	pipeListenersM.Lock()
+	l := pipeListeners[name]
+	pipeListenersM.Unlock()
+	if l == nil {
+		err = fmt.Errorf("no pipe listener named `%s`", name)
+		return
+	}
+
+	conn, err := l.Dial()
+	if err != nil {
+		return
+	}
+	client = NewClient(NewConnection(conn, "client"), "service-proxy")
+
+	return
+}
@@ -1,27 +1,178 @@
 package scamp
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"log"
 	"time"
 )
 
+var defaultRequestTimeout = 300 * time.Second
+
+var defaultRequester *Requester
+
+var errRequesterNotInitialized = errors.New("default requester is not initialized. call scamp.Initialize() before making requests")
+
+// Requester makes requests against a single SCAMP environment. Each Requester owns
+// its configuration, discovery cache, client pool, balancer, timeout and logger so
+// several environments (e.g. prod and a staging mirror) can be used from one process.
+type Requester struct {
+	config    *Config
+	cache     *ServiceCache
+	pool      *clientPool
+	balancer  balancer
+	timeout   time.Duration
+	logger    *log.Logger
+	envelopes []envelopeFormat
+	compress  bool
+	// ownsCache is set when the requester loaded its cache and so closes it
+	ownsCache bool
+	// stopRevocations deregisters the pool from the cache's revocations
+	stopRevocations func()
+}
+
+// NewRequester creates a Requester for the environment described by conf. If cache is nil
+// a new ServiceCache is loaded from the `discovery.cache_path` of conf, applying its
+// `discovery.cert_expiry` policy and `discovery.revoked_fingerprints` list.
+func NewRequester(conf *Config, cache *ServiceCache) (req *Requester, err error) {
+	if conf == nil {
+		err = fmt.Errorf("requester needs a non-nil config")
+		return
+	}
+
+	ownsCache := cache == nil
+	if ownsCache {
+		cache, err = loadServiceCache(conf)
+		if err != nil {
+			return
+		}
+	}
+
+	initSCAMPLogger()
+
+	req = new(Requester)
+	req.config = conf
+	req.cache = cache
+	req.pool = newClientPool()
+	req.balancer = new(roundRobinBalancer)
+	req.timeout = defaultRequestTimeout
+	req.logger = Error
+	req.envelopes = []envelopeFormat{EnvelopeJSON}
+	req.ownsCache = ownsCache
+
+	req.stopRevocations = cache.onRevocation(req.pool.closeRevoked)
+
+	return
+}
+
+// DefaultRequester returns the requester set up by Initialize, or an error if the
+// package has not been initialized.
+func DefaultRequester() (req *Requester, err error) {
+	if defaultRequester == nil {
+		err = errRequesterNotInitialized
+		return
+	}
+
+	return defaultRequester, nil
+}
+
+// SetTimeout sets how long the requester waits for a reply
+func (req *Requester) SetTimeout(timeout time.Duration) {
+	req.timeout = timeout
+}
+
+// SetLogger sets the logger used for the requester's diagnostics
+func (req *Requester) SetLogger(logger *log.Logger) {
+	req.logger = logger
+}
+
+// SetClientCertificate makes the requester present cert, normally the calling service's
+// own certificate, when connecting to services. Services requiring client certificates
+// use it to identify the caller. Clients already pooled keep their connections.
+func (req *Requester) SetClientCertificate(cert tls.Certificate) {
+	req.pool.clientsM.Lock()
+	defer req.pool.clientsM.Unlock()
+
+	req.pool.cert = &cert
+}
+
+// SetAcceptCompression controls whether requests advertise that replies may be compressed
+func (req *Requester) SetAcceptCompression(accept bool) {
+	req.compress = accept
+}
+
+// SetEnvelopes sets the envelopes the requester may use, most preferred first.
+// NegotiateEnvelope and Call pick the first one announced for the requested action.
+func (req *Requester) SetEnvelopes(envelopes []envelopeFormat) (err error) {
+	if len(envelopes) == 0 {
+		err = fmt.Errorf("requester needs at least one envelope")
+		return
+	}
+	for _, envelope := range envelopes {
+		if _, err = envelope.codec(); err != nil {
+			return
+		}
+	}
+
+	req.envelopes = envelopes
+	return
+}
+
+// NegotiateEnvelope returns the most preferred envelope that some instance announces for
+// sector:action~version.
+func (req *Requester) NegotiateEnvelope(sector, action string, version int) (envelope envelopeFormat, err error) {
+	for _, envelope = range req.envelopes {
+		instances, searchErr := req.cache.SearchByAction(sector, action, version, envelope.String())
+		if searchErr == nil && len(instances) > 0 {
+			return
+		}
+	}
+
+	err = fmt.Errorf("could not find %s:%s~%d in any of %s", sector, action, version, req.envelopes)
+	return
+}
+
+// Config returns the requester's configuration
+func (req *Requester) Config() *Config {
+	return req.config
+}
+
+// Cache returns the requester's discovery cache
+func (req *Requester) Cache() *ServiceCache {
+	return req.cache
+}
+
+// Close closes every pooled client held by the requester and stops following the
+// cache's revocations. A cache the requester loaded itself is closed too.
+func (req *Requester) Close() {
+	req.stopRevocations()
+	req.pool.closeAll()
+	if req.ownsCache {
+		req.cache.Close()
+	}
+}
+
 // MakeJSONRequest retreives the appropriate service proxy based on the message action, and makes a
-// JSON request.
-func MakeJSONRequest(sector, action string, version int, msg *Message) (message *Message, err error) {
-	var msgType string
-	if msg.Envelope == EnvelopeJSON {
-		msgType = "json"
-	} else if msg.Envelope == EnvelopeJSONSTORE {
-		msgType = "jsonstore"
-	} else {
+// JSON request. Messages in other envelopes are sent to an instance announcing that envelope.
+func (req *Requester) MakeJSONRequest(sector, action string, version int, msg *Message) (message *Message, err error) {
+	return req.MakeJSONRequestContext(context.Background(), sector, action, version, msg)
+}
+
+// MakeJSONRequestContext is MakeJSONRequest but gives up waiting for the reply when ctx is done.
+func (req *Requester) MakeJSONRequestContext(ctx context.Context, sector, action string, version int, msg *Message) (message *Message, err error) {
+	if _, err = msg.Envelope.codec(); err != nil {
 		err = fmt.Errorf("unsupported envelope type: `%d`", msg.Envelope)
 		return
 	}
+	// Only instances announcing the message's envelope are candidates
+	msgType := msg.Envelope.String()
 
 	//TODO: add retry logic in case service proxies are nil
-	var serviceProxies []*serviceProxy
+	var serviceProxies []*ServiceInstance
 
-	serviceProxies, err = DefaultCache.SearchByAction(sector, action, version, msgType)
+	serviceProxies, err = req.cache.SearchByAction(sector, action, version, msgType)
 	if err != nil {
 		return
 	}
@@ -32,43 +183,64 @@ func MakeJSONRequest(sector, action string, version int, msg *Message) (message
 
 	msg.SetAction(action)
 	msg.SetVersion(version)
+	if req.compress {
+		msg.SetAcceptCompression()
+	}
 
-	sent := false
+	var sentTo *Client
 	var responseChan chan *Message
 
-	for _, serviceProxy := range serviceProxies {
-		client, err := serviceProxy.GetClient()
-		if err != nil {
+	ordered := req.balancer.order(serviceProxies)
+	if len(ordered) == 0 {
+		err = fmt.Errorf("could not find %s:%s~%d#%s: every instance is draining", sector, action, version, msgType)
+		return
+	}
+
+	for _, serviceProxy := range ordered {
+		client, clientErr := req.pool.get(serviceProxy)
+		if clientErr != nil {
+			req.logger.Printf("could not connect to %s: `%s`", serviceProxy.ident, clientErr)
+			err = clientErr
 			continue
 		}
 
 		responseChan, err = client.Send(msg)
 		if err == nil {
-			sent = true
+			sentTo = client
 			break
 		}
+		req.logger.Printf("could not send to %s: `%s`", serviceProxy.ident, err)
 	}
 
-	if !sent {
+	if sentTo == nil {
 		err = fmt.Errorf("Request failed: %s.%s not found: %s", sector, action, err)
 		return
 	}
 
-	for {
-		select {
-		case msg, ok := <-responseChan:
-			if !ok {
-				break
-			}
-			if msg == nil {
-				break
-			}
-			message = msg
-			return
-		case <-time.After(300 * time.Second):
-			//close(responseChan)
-			err = fmt.Errorf("request timed out")
+	select {
+	case reply, ok := <-responseChan:
+		if !ok || reply == nil {
+			err = fmt.Errorf("connection closed before reply was received")
 			return
 		}
+		message = reply
+	case <-time.After(req.timeout):
+		sentTo.abandonReply(msg.RequestID)
+		err = fmt.Errorf("request timed out")
+	case <-ctx.Done():
+		sentTo.abandonReply(msg.RequestID)
+		err = ctx.Err()
 	}
+
+	return
+}
+
+// MakeJSONRequest makes a JSON request using the default requester set up by Initialize.
+func MakeJSONRequest(sector, action string, version int, msg *Message) (message *Message, err error) {
+	req, err := DefaultRequester()
+	if err != nil {
+		return
+	}
+
+	return req.MakeJSONRequest(sector, action, version, msg)
 }
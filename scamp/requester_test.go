@@ -1,8 +1,15 @@
 package scamp
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
 	"flag"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"time"
 
 	"testing"
 )
@@ -15,7 +22,7 @@ func TestRequester(t *testing.T) {
 
 	resp, err := MakeJSONRequest("main", "Logger.info", 1, msg)
 	if err != nil {
-		t.Fatalf(err.Error())
+		t.Fatalf("%s", err)
 	}
 	if resp == nil || len(resp.Bytes()) == 0 {
 		t.Fail()
@@ -23,6 +30,247 @@ func TestRequester(t *testing.T) {
 
 }
 
+func TestRequesterUsesOwnCache(t *testing.T) {
+	cache, err := newServiceCache("/tmp/blah")
+	if err != nil {
+		t.Fatalf("could not create service cache: `%s`", err)
+	}
+	instance := new(ServiceInstance)
+	instance.ident = "bob"
+	instance.sector = "main"
+	instance.protocols = []string{"json"}
+	instance.classes = []InstanceClass{
+		InstanceClass{
+			className: "Logger",
+			actions:   []InstanceAction{InstanceAction{actionName: "info", version: 1}},
+		},
+	}
+	cache.Store(instance)
+
+	req, err := NewRequester(NewConfig(), cache)
+	if err != nil {
+		t.Fatalf("could not create requester: `%s`", err)
+	}
+	if req.Cache() != cache {
+		t.Fatalf("requester did not keep the cache it was given")
+	}
+
+	msg := NewRequestMessage()
+	msg.SetEnvelope(EnvelopeJSON)
+	_, err = req.MakeJSONRequest("main", "Logger.warn", 1, msg)
+	if err == nil {
+		t.Fatalf("expected an error for an unknown action")
+	}
+}
+
+func TestRequestAfterCanceledRequest(t *testing.T) {
+	initSCAMPLogger()
+
+	cert, err := GenerateServiceCert("slow", CertOptions{KeyType: KeyTypeECDSA})
+	if err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert.Keypair}})
+	if err != nil {
+		t.Fatalf("could not listen: `%s`", err)
+	}
+	serv := newEchoService(t, listener)
+	serv.SetCertificate(cert.Keypair, cert.PEMCert)
+	release := make(chan struct{})
+	serv.Register("Echo.slow", func(msg *Message, client *Client) {
+		<-release
+		reply := NewResponseMessage()
+		reply.SetEnvelope(EnvelopeJSON)
+		reply.SetRequestID(msg.RequestID)
+		reply.Write(msg.Bytes())
+		client.Send(reply)
+	})
+	go serv.Run()
+	defer serv.Stop()
+
+	announce, err := serv.MarshalText()
+	if err != nil {
+		t.Fatalf("could not marshal announcement: `%s`", err)
+	}
+	cache := NewMemoryServiceCache()
+	err = cache.DoScan(bufio.NewScanner(bytes.NewReader(append([]byte("%%%\n"), announce...))))
+	if err != nil {
+		t.Fatalf("could not scan announcement: `%s`", err)
+	}
+
+	req, err := NewRequester(NewConfig(), cache)
+	if err != nil {
+		t.Fatalf("could not create requester: `%s`", err)
+	}
+	defer req.Close()
+
+	// give up on a request, then let its reply arrive late
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	msg := NewRequestMessage()
+	msg.SetEnvelope(EnvelopeJSON)
+	msg.Write([]byte(`"slow"`))
+	_, err = req.MakeJSONRequestContext(ctx, "main", "Echo.slow", 1, msg)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected the request to be canceled, got `%v`", err)
+	}
+	close(release)
+
+	// the late reply must not stall the pooled client
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	msg = NewRequestMessage()
+	msg.SetEnvelope(EnvelopeJSON)
+	msg.Write([]byte(`"ping"`))
+	reply, err := req.MakeJSONRequestContext(ctx, "main", "Echo.echo", 1, msg)
+	if err != nil {
+		t.Fatalf("request after a canceled one failed: `%s`", err)
+	}
+	if string(reply.Bytes()) != `"ping"` {
+		t.Fatalf("unexpected reply `%s`", reply.Bytes())
+	}
+}
+
+func TestRequesterCloseStopsItsCache(t *testing.T) {
+	manifest := filepath.Join(t.TempDir(), "services.yaml")
+	err := ioutil.WriteFile(manifest, []byte(`services:
+  - ident: logger-1
+    connspec: beepish+tls://127.0.0.1:30100
+    actions: [Logger.info]
+`), 0644)
+	if err != nil {
+		t.Fatalf("could not write manifest: `%s`", err)
+	}
+	conf := NewConfig()
+	conf.Set("discovery.allow_static", "true")
+	conf.Set("discovery.static_manifest", manifest)
+
+	req, err := NewRequester(conf, nil)
+	if err != nil {
+		t.Fatalf("could not create requester: `%s`", err)
+	}
+	cache := req.Cache()
+	events := cache.Subscribe(CacheFilter{})
+	defer cache.Unsubscribe(events)
+	if cache.Retrieve("logger-1") == nil {
+		expectEvent(t, events, InstanceAdded, "logger-1")
+	}
+	if len(cache.revokeHooks) != 1 {
+		t.Fatalf("expected the requester to follow revocations")
+	}
+
+	req.Close()
+	if len(cache.revokeHooks) != 0 {
+		t.Fatalf("expected Close to stop following revocations")
+	}
+	// the static provider stopped with the cache
+	expectEvent(t, events, InstanceRemoved, "logger-1")
+
+	// a cache passed in belongs to the caller and stays open
+	shared := NewMemoryServiceCache()
+	req, err = NewRequester(NewConfig(), shared)
+	if err != nil {
+		t.Fatalf("could not create requester: `%s`", err)
+	}
+	req.Close()
+	if len(shared.revokeHooks) != 0 {
+		t.Fatalf("expected Close to stop following revocations")
+	}
+}
+
+func TestNegotiateEnvelope(t *testing.T) {
+	cache, err := newServiceCache("/tmp/blah")
+	if err != nil {
+		t.Fatalf("could not create service cache: `%s`", err)
+	}
+	instance := new(ServiceInstance)
+	instance.ident = "bulk"
+	instance.sector = "main"
+	instance.protocols = []string{"json", "cbor"}
+	instance.classes = []InstanceClass{
+		InstanceClass{
+			className: "Inventory",
+			actions:   []InstanceAction{InstanceAction{actionName: "dump", version: 1}},
+		},
+	}
+	cache.Store(instance)
+
+	req, err := NewRequester(NewConfig(), cache)
+	if err != nil {
+		t.Fatalf("could not create requester: `%s`", err)
+	}
+
+	err = req.SetEnvelopes([]envelopeFormat{EnvelopeMSGPACK, EnvelopeCBOR, EnvelopeJSON})
+	if err != nil {
+		t.Fatalf("could not set envelopes: `%s`", err)
+	}
+
+	envelope, err := req.NegotiateEnvelope("main", "Inventory.dump", 1)
+	if err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+	if envelope != EnvelopeCBOR {
+		t.Fatalf("expected cbor, got %s", envelope)
+	}
+
+	req.SetEnvelopes([]envelopeFormat{EnvelopeMSGPACK})
+	_, err = req.NegotiateEnvelope("main", "Inventory.dump", 1)
+	if err == nil {
+		t.Fatalf("expected an error when no preferred envelope is announced")
+	}
+}
+
+func TestNewRequesterRequiresConfig(t *testing.T) {
+	_, err := NewRequester(nil, nil)
+	if err == nil {
+		t.Fatalf("expected an error for a nil config")
+	}
+
+	_, err = NewRequester(NewConfig(), nil)
+	if err == nil {
+		t.Fatalf("expected an error for a config without `discovery.cache_path`")
+	}
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	a, b, c := new(ServiceInstance), new(ServiceInstance), new(ServiceInstance)
+	a.weight, b.weight, c.weight = 1, 1, 1
+	instances := []*ServiceInstance{a, b, c}
+
+	rr := new(roundRobinBalancer)
+	first := rr.order(instances)
+	second := rr.order(instances)
+	if len(first) != 3 || len(second) != 3 {
+		t.Fatalf("balancer dropped instances")
+	}
+	if first[0] == second[0] {
+		t.Fatalf("expected the starting instance to rotate")
+	}
+}
+
+func TestWeightedBalancer(t *testing.T) {
+	heavy, light, draining := new(ServiceInstance), new(ServiceInstance), new(ServiceInstance)
+	heavy.weight, light.weight, draining.weight = 3, 1, 0
+	instances := []*ServiceInstance{heavy, light, draining}
+
+	rr := new(roundRobinBalancer)
+	starts := make(map[*ServiceInstance]int)
+	for i := 0; i < 8; i++ {
+		ordered := rr.order(instances)
+		if len(ordered) != 2 {
+			t.Fatalf("expected the draining instance to be left out, got %d instances", len(ordered))
+		}
+		starts[ordered[0]]++
+	}
+	if starts[heavy] != 6 || starts[light] != 2 {
+		t.Fatalf("expected starts in proportion to weight, got %d and %d", starts[heavy], starts[light])
+	}
+
+	if ordered := rr.order([]*ServiceInstance{draining}); len(ordered) != 0 {
+		t.Fatalf("expected no instance to try when all are draining")
+	}
+}
+
 func TestMain(m *testing.M) {
 	flag.Parse()
 	Initialize("/etc/SCAMP/soa.conf")
@@ -0,0 +1,296 @@
+package scamp
+
+import (
+	"bufio"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RevocationReloadInterval is how often a revocation list loaded from soa.conf's
+// `discovery.revoked_fingerprints` checks its file for changes
+var RevocationReloadInterval = 5 * time.Second
+
+// RevocationList is a set of revoked certificate fingerprints. Announcements signed
+// with a revoked certificate are dropped from the ServiceCache using the list, and
+// connections to services presenting one are closed.
+//
+// The file format is one SHA1 or SHA256 fingerprint per line, in the same format as
+// authorized_services. Anything after the fingerprint, and lines starting with `#`,
+// are ignored.
+type RevocationList struct {
+	path         string
+	reloadM      sync.Mutex
+	modTime      time.Time
+	size         int64
+	fingerprintM sync.RWMutex
+	fingerprints map[string]bool
+	hooksM       sync.Mutex
+	hooks        []func(*RevocationList)
+}
+
+// NewRevocationList creates an empty list that is not backed by a file
+func NewRevocationList() (rl *RevocationList) {
+	rl = new(RevocationList)
+	rl.fingerprints = make(map[string]bool)
+
+	return
+}
+
+// LoadRevocationList reads the revoked fingerprints in the file at path. Reload and
+// Watch pick up later changes to it.
+func LoadRevocationList(path string) (rl *RevocationList, err error) {
+	rl = NewRevocationList()
+	rl.path = path
+
+	_, err = rl.Reload()
+	if err != nil {
+		rl = nil
+		return
+	}
+
+	return
+}
+
+// Load replaces the revoked fingerprints with the ones read from s
+func (rl *RevocationList) Load(s *bufio.Scanner) (err error) {
+	fingerprints := make(map[string]bool)
+
+	lineNo := 0
+	for s.Scan() {
+		lineNo++
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		fingerprint := canonicalFingerprint(fields[0])
+		if len(fingerprint) == 0 {
+			err = fmt.Errorf("line %d: `%s` is not a SHA1 or SHA256 fingerprint", lineNo, fields[0])
+			return
+		}
+		fingerprints[fingerprint] = true
+	}
+	err = s.Err()
+	if err != nil {
+		return
+	}
+
+	rl.fingerprintM.Lock()
+	rl.fingerprints = fingerprints
+	rl.fingerprintM.Unlock()
+
+	rl.changed()
+	return
+}
+
+// Revoke adds fingerprint to the list
+func (rl *RevocationList) Revoke(fingerprint string) (err error) {
+	canonical := canonicalFingerprint(fingerprint)
+	if len(canonical) == 0 {
+		err = fmt.Errorf("`%s` is not a SHA1 or SHA256 fingerprint", fingerprint)
+		return
+	}
+
+	rl.fingerprintM.Lock()
+	rl.fingerprints[canonical] = true
+	rl.fingerprintM.Unlock()
+
+	rl.changed()
+	return
+}
+
+// Revoked reports whether fingerprint is on the list
+func (rl *RevocationList) Revoked(fingerprint string) bool {
+	canonical := canonicalFingerprint(fingerprint)
+	if len(canonical) == 0 {
+		return false
+	}
+
+	rl.fingerprintM.RLock()
+	defer rl.fingerprintM.RUnlock()
+
+	return rl.fingerprints[canonical]
+}
+
+// RevokedCert reports whether cert is on the list by either of its fingerprints
+func (rl *RevocationList) RevokedCert(cert *x509.Certificate) bool {
+	return rl.Revoked(sha1FingerPrint(cert)) || rl.Revoked(sha256FingerPrint(cert))
+}
+
+// RevokedClient reports whether the certificate client's peer presented is on the list
+func (rl *RevocationList) RevokedClient(client *Client) bool {
+	return rl.Revoked(client.Fingerprint()) || rl.Revoked(client.FingerprintSHA256())
+}
+
+// Size is the number of revoked fingerprints
+func (rl *RevocationList) Size() int {
+	rl.fingerprintM.RLock()
+	defer rl.fingerprintM.RUnlock()
+
+	return len(rl.fingerprints)
+}
+
+// OnChange registers a hook run every time the list is loaded or a fingerprint is revoked
+func (rl *RevocationList) OnChange(hook func(*RevocationList)) {
+	rl.hooksM.Lock()
+	defer rl.hooksM.Unlock()
+
+	rl.hooks = append(rl.hooks, hook)
+}
+
+func (rl *RevocationList) changed() {
+	rl.hooksM.Lock()
+	hooks := rl.hooks
+	rl.hooksM.Unlock()
+
+	for _, hook := range hooks {
+		hook(rl)
+	}
+}
+
+// Reload reads the list's file again if its modification time or size changed since
+// it was last read. A list that is not backed by a file is left alone.
+func (rl *RevocationList) Reload() (reloaded bool, err error) {
+	if len(rl.path) == 0 {
+		return
+	}
+
+	rl.reloadM.Lock()
+	defer rl.reloadM.Unlock()
+
+	stat, err := os.Stat(rl.path)
+	if err != nil {
+		return
+	}
+	if stat.ModTime().Equal(rl.modTime) && stat.Size() == rl.size {
+		return
+	}
+
+	file, err := os.Open(rl.path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	err = rl.Load(bufio.NewScanner(file))
+	if err != nil {
+		err = fmt.Errorf("could not load revoked fingerprints from `%s`: %s", rl.path, err)
+		return
+	}
+	rl.modTime = stat.ModTime()
+	rl.size = stat.Size()
+
+	reloaded = true
+	return
+}
+
+// Watch calls Reload every interval until stop is closed. Failed reloads keep the
+// fingerprints already revoked and are logged.
+func (rl *RevocationList) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			_, err := rl.Reload()
+			if err != nil {
+				Error.Printf("%s", err)
+			}
+		}
+	}
+}
+
+// SetRevocationList makes the cache drop instances whose certificate is on rl, now and
+// whenever rl changes, and refuse to store new ones. Requesters using the cache close
+// their pooled connections to revoked services.
+func (cache *ServiceCache) SetRevocationList(rl *RevocationList) {
+	cache.cacheM.Lock()
+	cache.revocations = rl
+	cache.cacheM.Unlock()
+
+	rl.OnChange(cache.applyRevocations)
+	cache.applyRevocations(rl)
+}
+
+// revokeHook wraps a hook registered with onRevocation so it can be found again
+type revokeHook struct {
+	run func(*RevocationList)
+}
+
+// onRevocation registers a hook run after the cache applied a change of its
+// revocation list. Calling remove deregisters it.
+func (cache *ServiceCache) onRevocation(hook func(*RevocationList)) (remove func()) {
+	registered := &revokeHook{run: hook}
+
+	cache.cacheM.Lock()
+	cache.revokeHooks = append(cache.revokeHooks, registered)
+	cache.cacheM.Unlock()
+
+	remove = func() {
+		cache.cacheM.Lock()
+		defer cache.cacheM.Unlock()
+
+		for i, candidate := range cache.revokeHooks {
+			if candidate == registered {
+				cache.revokeHooks = append(cache.revokeHooks[:i:i], cache.revokeHooks[i+1:]...)
+				return
+			}
+		}
+	}
+	return
+}
+
+// applyRevocations purges the instances rl revokes and closes their clients
+func (cache *ServiceCache) applyRevocations(rl *RevocationList) {
+	cache.cacheM.Lock()
+	if cache.revocations != rl {
+		// replaced by another list since
+		cache.cacheM.Unlock()
+		return
+	}
+
+	var revoked []*ServiceInstance
+	for _, instance := range cache.load().identIndex {
+		if cache.revokedNoLock(instance) {
+			revoked = append(revoked, instance)
+		}
+	}
+	if len(revoked) > 0 {
+		snapshot := cache.load().clone()
+		for _, instance := range revoked {
+			Warning.Printf("dropping `%s`: its certificate was revoked", instance.ident)
+			snapshot.purge(instance)
+		}
+		cache.publishNoLock(snapshot)
+	}
+	hooks := cache.revokeHooks
+	cache.cacheM.Unlock()
+
+	for _, instance := range revoked {
+		instance.closeClient()
+	}
+	for _, hook := range hooks {
+		hook.run(rl)
+	}
+}
+
+// revokedNoLock reports whether instance's certificate is on the cache's revocation list
+func (cache *ServiceCache) revokedNoLock(instance *ServiceInstance) bool {
+	if cache.revocations == nil {
+		return false
+	}
+
+	cert, err := instance.certificate()
+	if err != nil {
+		return false
+	}
+
+	return cache.revocations.RevokedCert(cert)
+}
@@ -0,0 +1,140 @@
+package scamp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRevocationListLoad(t *testing.T) {
+	rl := NewRevocationList()
+	err := rl.Load(bufio.NewScanner(strings.NewReader(`# leaked on 2026-10-01
+23:C6:D6:64:E1:14:49:23:2C:35:CB:81:D9:EA:47:28:23:A9:BA:F6 sample
+
+81:0f:03:2d:6a:4f:7e:61:d6:33:0e:1c:3d:18:a4:20:73:9d:3e:59:74:c6:42:25:5b:e2:c9:dd:1c:2f:26:c6
+`)))
+	if err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+	if rl.Size() != 2 {
+		t.Fatalf("expected 2 fingerprints, got %d", rl.Size())
+	}
+	if !rl.Revoked("23c6d664e11449232c35cb81d9ea472823a9baf6") {
+		t.Fatalf("expected fingerprints to match without regard for colons and case")
+	}
+	if !rl.Revoked("81:0F:03:2D:6A:4F:7E:61:D6:33:0E:1C:3D:18:A4:20:73:9D:3E:59:74:C6:42:25:5B:E2:C9:DD:1C:2F:26:C6") {
+		t.Fatalf("expected the SHA256 fingerprint to be revoked")
+	}
+	if rl.Revoked("") || rl.Revoked("AA:BB") {
+		t.Fatalf("expected malformed fingerprints not to be revoked")
+	}
+
+	err = rl.Load(bufio.NewScanner(strings.NewReader("not-a-fingerprint\n")))
+	if err == nil {
+		t.Fatalf("expected an error for a malformed line")
+	}
+	if rl.Size() != 2 {
+		t.Fatalf("a failed load should keep the previous fingerprints")
+	}
+}
+
+func TestRevokedAnnouncementsAreDropped(t *testing.T) {
+	initSCAMPLogger()
+
+	cert, err := GenerateServiceCert("revoked", CertOptions{KeyType: KeyTypeECDSA})
+	if err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert.Keypair}})
+	if err != nil {
+		t.Fatalf("could not listen: `%s`", err)
+	}
+	serv := newEchoService(t, listener)
+	serv.SetCertificate(cert.Keypair, cert.PEMCert)
+	go serv.Run()
+	defer serv.Stop()
+
+	announce, err := serv.MarshalText()
+	if err != nil {
+		t.Fatalf("could not marshal announcement: `%s`", err)
+	}
+	announce = append([]byte("%%%\n"), announce...)
+
+	path := filepath.Join(t.TempDir(), "revoked_fingerprints")
+	err = ioutil.WriteFile(path, []byte("# nothing revoked yet\n"), 0644)
+	if err != nil {
+		t.Fatalf("could not write revocation list: `%s`", err)
+	}
+	rl, err := LoadRevocationList(path)
+	if err != nil {
+		t.Fatalf("could not load revocation list: `%s`", err)
+	}
+
+	cache := NewMemoryServiceCache()
+	cache.SetRevocationList(rl)
+	err = cache.DoScan(bufio.NewScanner(bytes.NewReader(announce)))
+	if err != nil {
+		t.Fatalf("could not scan announcement: `%s`", err)
+	}
+	if cache.Retrieve(serv.name) == nil {
+		t.Fatalf("expected the announcement to be stored")
+	}
+
+	req, err := NewRequester(NewConfig(), cache)
+	if err != nil {
+		t.Fatalf("could not create requester: `%s`", err)
+	}
+	defer req.Close()
+	msg := NewRequestMessage()
+	msg.SetEnvelope(EnvelopeJSON)
+	msg.Write([]byte(`"ping"`))
+	_, err = req.MakeJSONRequest("main", "Echo.echo", 1, msg)
+	if err != nil {
+		t.Fatalf("request failed: `%s`", err)
+	}
+	pooled := req.pool.clients[serv.name]
+	if pooled == nil {
+		t.Fatalf("expected a pooled client")
+	}
+
+	// a newer file revoking the service's SHA256 fingerprint is picked up by Reload
+	fingerprint := GetSHA256FingerPrint(cert.Keypair.Leaf)
+	err = ioutil.WriteFile(path, []byte(fingerprint+" leaked\n"), 0644)
+	if err != nil {
+		t.Fatalf("could not write revocation list: `%s`", err)
+	}
+	reloaded, err := rl.Reload()
+	if err != nil || !reloaded {
+		t.Fatalf("expected the changed file to be reloaded (%v)", err)
+	}
+
+	if cache.Retrieve(serv.name) != nil {
+		t.Fatalf("expected the revoked instance to be dropped")
+	}
+	if _, err = cache.SearchByAction("main", "Echo.echo", 1, "json"); err == nil {
+		t.Fatalf("expected the revoked instance's actions to be dropped")
+	}
+	if !pooled.isClosed() {
+		t.Fatalf("expected the pooled connection to the revoked service to be closed")
+	}
+
+	err = cache.DoScan(bufio.NewScanner(bytes.NewReader(announce)))
+	if err != nil {
+		t.Fatalf("could not scan announcement: `%s`", err)
+	}
+	if cache.Retrieve(serv.name) != nil {
+		t.Fatalf("expected the revoked announcement to be refused")
+	}
+
+	// unchanged files are not read again
+	time.Sleep(10 * time.Millisecond)
+	reloaded, _ = rl.Reload()
+	if reloaded {
+		t.Fatalf("expected an unchanged file not to be reloaded")
+	}
+}
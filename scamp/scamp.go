@@ -51,25 +51,16 @@ func doFakeDiscoveryCache(keyPath, certPath, announcePath string) {
 		Error.Fatalf("could not read key at %s", keyPath)
 	}
 
-	block, _ := pem.Decode(keyRawBytes)
-
-	if block == nil {
-		Error.Fatalf("could not decode key data (%s)", block.Type)
-		return
-	} else if block.Type != "RSA PRIVATE KEY" {
-		Error.Fatalf("expected key type 'RSA PRIVATE KEY' but got '%s'", block.Type)
-	}
-
-	privKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	privKey, err := parsePrivateKeyPEM(keyRawBytes)
 	if err != nil {
-		Error.Fatalf("could not parse key from %s (%s)", keyPath, block.Type)
+		Error.Fatalf("could not parse key from %s (%s)", keyPath, err)
 	}
 
 	announceData, err := ioutil.ReadFile(announcePath)
 	if err != nil {
 		Error.Fatalf("could not read announce data from %s", announcePath)
 	}
-	announceSig, err := signSHA256([]byte(announceData), privKey)
+	announceSig, err := signPayload([]byte(announceData), privKey)
 	if err != nil {
 		Error.Fatalf("could not sign announce data: %s", err)
 	}
@@ -102,6 +93,7 @@ func doCertFingerprint(fingerprintPath string) {
 	fingerprint := GetSHA1FingerPrint(cert)
 	if len(fingerprint) > 0 {
 		fmt.Printf("fingerprint: %s\n", fingerprint)
+		fmt.Printf("sha256 fingerprint: %s\n", GetSHA256FingerPrint(cert))
 	} else {
 		Error.Fatalf("could not fingerprint certificate")
 	}
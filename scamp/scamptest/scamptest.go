@@ -0,0 +1,187 @@
+// Package scamptest wires SCAMP services and requesters together in memory so they
+// can be tested without soa.conf, certificates, a discovery cache or sockets.
+//
+//	serv := scamptest.NewTestService(t, "main", "logger")
+//	scamp.RegisterJSON(serv.Service, "Logger.info", handler)
+//	serv.Start()
+//
+//	cache := scamptest.NewFakeCache()
+//	cache.AddService(t, serv)
+//
+//	reply := scamptest.Request(t, scamptest.NewRequester(t, cache), "main", "Logger.info", 1, payload)
+//	scamptest.AssertReply(t, reply, expected)
+package scamptest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gudtech/scamp-go/scamp"
+)
+
+var nextListenerID uint64
+
+// TestService is a scamp.Service served over an in-memory scamp.PipeListener
+type TestService struct {
+	*scamp.Service
+	Listener *scamp.PipeListener
+}
+
+// NewTestService creates a service listening on a fresh PipeListener. Register its
+// actions, then call Start. The service is stopped when the test finishes.
+func NewTestService(t testing.TB, sector, humanName string) (ts *TestService) {
+	t.Helper()
+
+	name := fmt.Sprintf("%s-%d", humanName, atomic.AddUint64(&nextListenerID, 1))
+	listener, err := scamp.NewPipeListener(name)
+	if err != nil {
+		t.Fatalf("could not create pipe listener: `%s`", err)
+	}
+
+	serv, err := scamp.NewServiceWithListener(sector, humanName, listener)
+	if err != nil {
+		listener.Close()
+		t.Fatalf("could not create service: `%s`", err)
+	}
+
+	ts = &TestService{
+		Service:  serv,
+		Listener: listener,
+	}
+	t.Cleanup(serv.Stop)
+
+	return
+}
+
+// Start runs the service in the background
+func (ts *TestService) Start() {
+	go ts.Run()
+}
+
+// Connspec is the connspec clients use to reach the service
+func (ts *TestService) Connspec() string {
+	return ts.Listener.Connspec()
+}
+
+// Dial opens a client connection to the service, closed when the test finishes
+func (ts *TestService) Dial(t testing.TB) (client *scamp.Client) {
+	t.Helper()
+
+	conn, err := ts.Listener.Dial()
+	if err != nil {
+		t.Fatalf("could not dial `%s`: `%s`", ts.Connspec(), err)
+	}
+	client = scamp.NewClient(scamp.NewConnection(conn, "client"), "scamptest")
+	t.Cleanup(client.Close)
+
+	return
+}
+
+// FakeCache is a scamp.ServiceCache whose entries are set by the test instead of
+// being read from a discovery file
+type FakeCache struct {
+	*scamp.ServiceCache
+}
+
+// NewFakeCache creates an empty FakeCache
+func NewFakeCache() *FakeCache {
+	return &FakeCache{scamp.NewMemoryServiceCache()}
+}
+
+// AddService makes every action registered on ts discoverable. Register the actions
+// before adding the service.
+func (cache *FakeCache) AddService(t testing.TB, ts *TestService) {
+	t.Helper()
+
+	err := cache.StoreService(ts.Service)
+	if err != nil {
+		t.Fatalf("could not add service: `%s`", err)
+	}
+}
+
+// AddInstance adds an instance by hand, e.g. one whose connspec points nowhere.
+// See scamp.ServiceCache.StoreStatic for the format of actions.
+func (cache *FakeCache) AddInstance(t testing.TB, ident, sector, connspec string, envelopes []string, actions ...string) {
+	t.Helper()
+
+	err := cache.StoreStatic(ident, sector, connspec, envelopes, actions...)
+	if err != nil {
+		t.Fatalf("could not add instance `%s`: `%s`", ident, err)
+	}
+}
+
+// NewRequester creates a requester resolving services through cache. It is closed
+// when the test finishes.
+func NewRequester(t testing.TB, cache *FakeCache) (requester *scamp.Requester) {
+	t.Helper()
+
+	requester, err := scamp.NewRequester(scamp.NewConfig(), cache.ServiceCache)
+	if err != nil {
+		t.Fatalf("could not create requester: `%s`", err)
+	}
+	t.Cleanup(requester.Close)
+
+	return
+}
+
+// Request sends body as a JSON request and returns the reply
+func Request(t testing.TB, requester *scamp.Requester, sector, action string, version int, body interface{}) (reply *scamp.Message) {
+	t.Helper()
+
+	msg := scamp.NewRequestMessage()
+	msg.SetEnvelope(scamp.EnvelopeJSON)
+	_, err := msg.WriteJSON(body)
+	if err != nil {
+		t.Fatalf("could not encode request: `%s`", err)
+	}
+
+	reply, err = requester.MakeJSONRequestContext(context.Background(), sector, action, version, msg)
+	if err != nil {
+		t.Fatalf("request to `%s` failed: `%s`", action, err)
+	}
+
+	return
+}
+
+// AssertReply fails the test unless reply succeeded and its JSON body equals expected
+// once both are encoded as JSON
+func AssertReply(t testing.TB, reply *scamp.Message, expected interface{}) {
+	t.Helper()
+
+	if len(reply.Error) != 0 {
+		t.Fatalf("expected a successful reply, got error `%s` (code `%s`)", reply.Error, reply.ErrorCode)
+	}
+
+	var got interface{}
+	err := json.Unmarshal(reply.Bytes(), &got)
+	if err != nil {
+		t.Fatalf("reply is not JSON: `%s` (`%s`)", err, reply.Bytes())
+	}
+
+	expectedJSON, err := json.Marshal(expected)
+	if err != nil {
+		t.Fatalf("could not encode expected reply: `%s`", err)
+	}
+	var want interface{}
+	json.Unmarshal(expectedJSON, &want)
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected reply `%s`, got `%s`", expectedJSON, reply.Bytes())
+	}
+}
+
+// AssertReplyError fails the test unless reply carries an error with the given code
+func AssertReplyError(t testing.TB, reply *scamp.Message, code string) {
+	t.Helper()
+
+	if len(reply.Error) == 0 {
+		t.Fatalf("expected an error reply with code `%s`, got `%s`", code, reply.Bytes())
+	}
+	if reply.ErrorCode != code {
+		t.Fatalf("expected error code `%s`, got `%s` (`%s`)", code, reply.ErrorCode, reply.Error)
+	}
+}
@@ -0,0 +1,92 @@
+package scamptest
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gudtech/scamp-go/scamp"
+)
+
+type greeting struct {
+	Name string `json:"name"`
+}
+
+type greetingReply struct {
+	Message string `json:"message"`
+}
+
+func newGreeter(t *testing.T) *TestService {
+	serv := NewTestService(t, "main", "greeter")
+	err := scamp.RegisterJSON(serv.Service, "Greeter.hello", func(_ *scamp.Message, req greeting) (greetingReply, error) {
+		if len(req.Name) == 0 {
+			return greetingReply{}, &scamp.ReplyError{Code: "missing_name", Message: "name is required"}
+		}
+		return greetingReply{Message: "hello " + req.Name}, nil
+	})
+	if err != nil {
+		t.Fatalf("could not register: `%s`", err)
+	}
+	serv.Start()
+
+	return serv
+}
+
+func TestRequestThroughFakeCache(t *testing.T) {
+	serv := newGreeter(t)
+
+	cache := NewFakeCache()
+	cache.AddService(t, serv)
+	requester := NewRequester(t, cache)
+
+	reply := Request(t, requester, "main", "Greeter.hello", 1, greeting{Name: "bob"})
+	AssertReply(t, reply, greetingReply{Message: "hello bob"})
+
+	reply = Request(t, requester, "main", "Greeter.hello", 1, greeting{})
+	AssertReplyError(t, reply, "missing_name")
+}
+
+func TestDialTestService(t *testing.T) {
+	serv := newGreeter(t)
+	client := serv.Dial(t)
+
+	msg := scamp.NewRequestMessage()
+	msg.SetAction("Greeter.hello")
+	msg.SetEnvelope(scamp.EnvelopeJSON)
+	msg.WriteJSON(greeting{Name: "alice"})
+
+	replies, err := client.Send(msg)
+	if err != nil {
+		t.Fatalf("could not send: `%s`", err)
+	}
+	AssertReply(t, <-replies, map[string]string{"message": "hello alice"})
+}
+
+func TestStaticInstances(t *testing.T) {
+	serv := newGreeter(t)
+
+	cache := NewFakeCache()
+	cache.AddInstance(t, "greeter-static", "main", serv.Connspec(), []string{"json"}, "Greeter.hello~1")
+	requester := NewRequester(t, cache)
+
+	resp, err := scamp.CallJSONWith[greeting, greetingReply](t.Context(), requester, "main", "Greeter.hello", 1, greeting{Name: "carol"})
+	if err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+	if resp.Message != "hello carol" {
+		t.Fatalf("unexpected reply `%s`", resp.Message)
+	}
+
+	err = cache.Remove("greeter-static")
+	if err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+	_, err = scamp.CallJSONWith[greeting, greetingReply](t.Context(), requester, "main", "Greeter.hello", 1, greeting{Name: "carol"})
+	if err == nil {
+		t.Fatalf("expected removed instance to be undiscoverable")
+	}
+
+	var replyErr *scamp.ReplyError
+	if errors.As(err, &replyErr) {
+		t.Fatalf("expected a discovery error, got reply error `%s`", err)
+	}
+}
@@ -1,16 +1,18 @@
 package scamp
 
 import (
+	"crypto"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"io/ioutil"
 	"net"
+	u "net/url"
 	// "encoding/json"
 	"bytes"
 	"fmt"
+	"strconv"
 	"time"
 
 	"sync"
@@ -20,14 +22,28 @@ import (
 // Two minute timeout on clients
 var msgTimeout = time.Second * 120
 
+// handshakeTimeout bounds the TLS handshake of accepted connections
+var handshakeTimeout = time.Second * 10
+
 // ServiceActionFunc represents a service callback
 type ServiceActionFunc func(*Message, *Client)
 
 // ServiceAction interface
 type ServiceAction struct {
-	callback ServiceActionFunc
-	crudTags string
-	version  int
+	callback  ServiceActionFunc
+	crudTags  string
+	version   int
+	envelopes []envelopeFormat
+}
+
+// acceptsEnvelope reports whether the action was registered for the given envelope
+func (action *ServiceAction) acceptsEnvelope(envelope envelopeFormat) bool {
+	for _, accepted := range action.envelopes {
+		if accepted == envelope {
+			return true
+		}
+	}
+	return false
 }
 
 // Service represents a scamp service
@@ -37,9 +53,13 @@ type Service struct {
 	name        string
 	humanName   string
 
-	listener     net.Listener
-	listenerIP   net.IP
-	listenerPort int
+	// listener is the one announced; extraListeners are only served
+	listener       net.Listener
+	listenerIP     net.IP
+	listenerPort   int
+	extraListeners []net.Listener
+	advertisedHost string
+	unixSocketPath string
 
 	actions   map[string]*ServiceAction
 	isRunning bool
@@ -52,6 +72,17 @@ type Service struct {
 	cert    tls.Certificate
 	pemCert []byte // just a copy of what was read off disk at tls cert load time
 
+	// tlsConfig is only set when the service opened its own listener
+	tlsConfig *tls.Config
+	// authorizedCallers, if set, restricts which callers may invoke which actions
+	authorizedCallers *AuthorizedServicesCache
+
+	// announceM guards the announce settings, which may change while announcing
+	announceM        sync.Mutex
+	announceInterval time.Duration
+	announceJitter   time.Duration
+	weight           int
+
 	// stats
 	statsCloseChan      chan bool
 	connectionsAccepted uint64
@@ -88,124 +119,398 @@ func NewService(sector string, serviceSpec string, humanName string) (*Service,
 // with an explicitly specified certificate rather than an implicitly discovered one.
 // keypair is a TLS certificate, and pemCert is the raw bytes of an X509 certificate.
 func NewServiceExplicitCert(sector string, serviceSpec string, humanName string, keypair tls.Certificate, pemCert []byte) (serv *Service, err error) {
+	serv, err = newService(sector, humanName)
+	if err != nil {
+		return
+	}
+	serv.serviceSpec = serviceSpec
+
+	serv.cert = keypair
+
+	// Load cert in to memory for announce packet writing
+	serv.pemCert = bytes.TrimSpace(pemCert)
+
+	// Finally, get ready for incoming requests
+	err = serv.listen()
+	if err != nil {
+		return
+	}
+
+	// go PrintStatsLoop(serv, time.Duration(15)*time.Second, serv.statsCloseChan)
+
+	// Trace.Printf("done initializing service")
+
+	return
+}
+
+// NewServiceWithListener intializes a scamp service that accepts connections from an
+// already open listener, e.g. a PipeListener in tests. Connections are used as
+// accepted: wrap the listener with tls.NewListener for TLS. The service cannot be
+// announced until it is given a certificate with SetCertificate.
+func NewServiceWithListener(sector string, humanName string, listener net.Listener) (serv *Service, err error) {
+	serv, err = newService(sector, humanName)
+	if err != nil {
+		return
+	}
+
+	serv.listener = listener
+	serv.serviceSpec = listener.Addr().String()
+	err = serv.setAnnounceAddr()
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+func newService(sector string, humanName string) (serv *Service, err error) {
 	if len(humanName) > 18 {
 		err = fmt.Errorf("name `%s` is too long, must be less than 18 bytes", humanName)
 		return
 	}
 
+	initSCAMPLogger()
+
 	serv = new(Service)
 	serv.sector = sector
-	serv.serviceSpec = serviceSpec
 	serv.humanName = humanName
 	serv.generateRandomName()
 
 	serv.actions = make(map[string]*ServiceAction)
+	serv.statsCloseChan = make(chan bool)
 
-	serv.cert = keypair
+	serv.announceInterval = time.Duration(defaultAnnounceInterval) * time.Second
+	serv.announceJitter = serv.announceInterval / 10
+	serv.weight = 1
+	if defaultConfig != nil {
+		err = serv.loadAnnounceConfig(defaultConfig)
+		if err != nil {
+			return
+		}
+	}
 
-	// Load cert in to memory for announce packet writing
+	return
+}
+
+// loadAnnounceConfig reads the announce settings of the service from conf:
+// `<name>.announce_interval`, `<name>.announce_jitter` and `<name>.weight`, falling
+// back to the `service.` keys shared by every service
+func (serv *Service) loadAnnounceConfig(conf *Config) (err error) {
+	get := func(key string) (value string, ok bool) {
+		value, ok = conf.Get(serv.humanName + "." + key)
+		if !ok {
+			value, ok = conf.Get("service." + key)
+		}
+		return
+	}
+
+	if value, ok := get("announce_interval"); ok {
+		serv.announceInterval, err = time.ParseDuration(value)
+		if err != nil || serv.announceInterval <= 0 {
+			err = fmt.Errorf("bad announce_interval `%s`: expected a positive duration like 5s", value)
+			return
+		}
+		serv.announceJitter = serv.announceInterval / 10
+	}
+	if value, ok := get("announce_jitter"); ok {
+		serv.announceJitter, err = time.ParseDuration(value)
+		if err != nil || serv.announceJitter < 0 || serv.announceJitter >= serv.announceInterval {
+			err = fmt.Errorf("bad announce_jitter `%s`: expected a duration shorter than the announce interval", value)
+			return
+		}
+	}
+	if value, ok := get("weight"); ok {
+		serv.weight, err = strconv.Atoi(value)
+		if err != nil || serv.weight < 0 {
+			err = fmt.Errorf("bad weight `%s`: expected a non-negative integer", value)
+			return
+		}
+	}
+	return
+}
+
+// SetAnnounceInterval sets how often the service is announced. Each announcement is
+// moved by a random amount of up to jitter either way, so that instances started
+// together don't announce in bursts. The interval is announced too: discovery expires
+// instances that miss a few announcements.
+func (serv *Service) SetAnnounceInterval(interval time.Duration, jitter time.Duration) (err error) {
+	if interval <= 0 || jitter < 0 || jitter >= interval {
+		err = fmt.Errorf("bad announce interval %s with jitter %s: need 0 <= jitter < interval", interval, jitter)
+		return
+	}
+
+	serv.announceM.Lock()
+	defer serv.announceM.Unlock()
+	serv.announceInterval = interval
+	serv.announceJitter = jitter
+	return
+}
+
+// AnnounceInterval returns how often the service is announced, and the jitter applied
+// to each announcement
+func (serv *Service) AnnounceInterval() (interval time.Duration, jitter time.Duration) {
+	serv.announceM.Lock()
+	defer serv.announceM.Unlock()
+	return serv.announceInterval, serv.announceJitter
+}
+
+// SetWeight sets the announced share of requests the service wants relative to the
+// other instances of its actions, from the next announcement on. It may be changed
+// while the service runs: lower it to canary an instance, or set it to 0 to drain it.
+// Requesters start requests at instances in proportion to their weight and send
+// none to instances with weight 0.
+func (serv *Service) SetWeight(weight int) (err error) {
+	if weight < 0 {
+		err = fmt.Errorf("bad weight %d: must not be negative", weight)
+		return
+	}
+
+	serv.announceM.Lock()
+	defer serv.announceM.Unlock()
+	serv.weight = weight
+	return
+}
+
+// Weight returns the weight the service is announced with
+func (serv *Service) Weight() int {
+	serv.announceM.Lock()
+	defer serv.announceM.Unlock()
+	return serv.weight
+}
+
+// SetCertificate sets the certificate the service announces itself with. keypair is a
+// TLS certificate, and pemCert is the raw bytes of an X509 certificate.
+func (serv *Service) SetCertificate(keypair tls.Certificate, pemCert []byte) {
+	serv.cert = keypair
 	serv.pemCert = bytes.TrimSpace(pemCert)
+}
 
-	// Finally, get ready for incoming requests
-	err = serv.listen()
-	if err != nil {
+// SetAdvertisedHost sets the host name or IP announced in the service's connspec,
+// instead of the address it listens on (or, for wildcard listeners, the first
+// non-loopback interface address). Set `service.address` in soa.conf to do the same
+// for services created with NewService.
+func (serv *Service) SetAdvertisedHost(host string) {
+	serv.advertisedHost = host
+}
+
+// RequireClientCerts makes the service refuse TLS connections from callers that don't
+// present a certificate. Certificates are not checked against a CA: callers are told
+// apart by fingerprint, see AuthorizeCallers. For services created with
+// NewServiceWithListener, set ClientAuth on the listener's tls.Config instead.
+func (serv *Service) RequireClientCerts() (err error) {
+	if serv.tlsConfig == nil {
+		err = errors.New("service was given its listener; configure client certificates on its tls.Config")
 		return
 	}
 
-	serv.statsCloseChan = make(chan bool)
-	// go PrintStatsLoop(serv, time.Duration(15)*time.Second, serv.statsCloseChan)
+	serv.tlsConfig.ClientAuth = tls.RequireAnyClientCert
+	return
+}
 
-	// Trace.Printf("done initializing service")
+// AuthorizeCallers restricts every action to callers whose certificate fingerprint is
+// authorized for it in authorized (see AuthorizedServicesCache.Authorized). Requests from
+// other callers, including ones without a certificate, are answered with an
+// `unauthorized` error.
+func (serv *Service) AuthorizeCallers(authorized *AuthorizedServicesCache) {
+	serv.authorizedCallers = authorized
+}
+
+// AddListener makes the service accept connections from listener as well. Only the
+// service's main listener is announced. Connections are used as accepted: wrap the
+// listener with tls.NewListener for TLS.
+func (serv *Service) AddListener(listener net.Listener) (err error) {
+	if serv.isRunning {
+		err = errors.New("cannot add listeners while server is running")
+		return
+	}
+
+	serv.extraListeners = append(serv.extraListeners, listener)
+	return
+}
+
+// setAnnounceAddr picks the address to announce from the main listener
+func (serv *Service) setAnnounceAddr() (err error) {
+	tcpAddr, ok := serv.listener.Addr().(*net.TCPAddr)
+	if !ok {
+		return
+	}
+	serv.listenerPort = tcpAddr.Port
+
+	if defaultConfig != nil && len(serv.advertisedHost) == 0 {
+		if address, found := defaultConfig.Get("service.address"); found {
+			serv.advertisedHost = address
+			return
+		}
+	}
+
+	if !tcpAddr.IP.IsUnspecified() {
+		serv.listenerIP = tcpAddr.IP
+		return
+	}
+
+	serv.listenerIP, err = getIPForAnnouncePacket()
+	// Trace.Printf("serv.listenerIP: `%s`", serv.listenerIP)
 
 	return
 }
 
+// connspec is the address announced for this service. IPv6 hosts are bracketed.
+func (serv *Service) connspec() string {
+	if pipe, ok := serv.listener.(*PipeListener); ok {
+		return pipe.Connspec()
+	}
+	if serv.listener != nil {
+		if unixAddr, ok := serv.listener.Addr().(*net.UnixAddr); ok {
+			return unixConnspec(serv.unixHost(), unixAddr.Name)
+		}
+	}
+
+	host := serv.advertisedHost
+	if len(host) == 0 {
+		if ip4 := serv.listenerIP.To4(); ip4 != nil {
+			host = ip4.String()
+		} else {
+			host = serv.listenerIP.String()
+		}
+	}
+
+	connspec := fmt.Sprintf("beepish+tls://%s", net.JoinHostPort(host, strconv.Itoa(serv.listenerPort)))
+	if len(serv.unixSocketPath) > 0 {
+		connspec += "?unix=" + u.QueryEscape(serv.unixSocketPath)
+	}
+
+	return connspec
+}
+
 // TODO: port discovery and interface/IP discovery should happen here
 // important to set values so announce packets are correct
 func (serv *Service) listen() (err error) {
-	config := &tls.Config{
+	// callers presenting a certificate are identified by its fingerprint
+	serv.tlsConfig = &tls.Config{
 		Certificates: []tls.Certificate{serv.cert},
+		ClientAuth:   tls.RequestClientCert,
 	}
 
 	Info.Printf("starting service on %s", serv.serviceSpec)
-	serv.listener, err = tls.Listen("tcp", serv.serviceSpec, config)
+	serv.listener, err = tls.Listen("tcp", serv.serviceSpec, serv.tlsConfig)
 	if err != nil {
 		return err
 	}
 	addr := serv.listener.Addr()
 	Info.Printf("service now listening to %s", addr.String())
 
-	// TODO: get listenerIP to return 127.0.0.1 or something other than '::'/nil
-	// serv.listenerIP = serv.listener.Addr().(*net.TCPAddr).IP
-	serv.listenerIP, err = getIPForAnnouncePacket()
-	// Trace.Printf("serv.listenerIP: `%s`", serv.listenerIP)
-
+	err = serv.setAnnounceAddr()
 	if err != nil {
 		return
 	}
 
-	serv.listenerPort = serv.listener.Addr().(*net.TCPAddr).Port
-
 	return
 }
 
-// Register registers a service handler callback
+// Register registers a service handler callback accepting the JSON envelope
 func (serv *Service) Register(name string, callback ServiceActionFunc) (err error) {
+	return serv.RegisterEnvelopes(name, []envelopeFormat{EnvelopeJSON}, callback)
+}
+
+// RegisterEnvelopes registers a service handler callback accepting the given envelopes.
+// Requests in any other envelope are answered with an error.
+func (serv *Service) RegisterEnvelopes(name string, envelopes []envelopeFormat, callback ServiceActionFunc) (err error) {
 	if serv.isRunning {
 		err = errors.New("cannot register handlers while server is running")
 		return
 	}
+	if len(envelopes) == 0 {
+		err = fmt.Errorf("action `%s` must accept at least one envelope", name)
+		return
+	}
+	for _, envelope := range envelopes {
+		if _, err = envelope.codec(); err != nil {
+			return
+		}
+	}
 
 	serv.actions[name] = &ServiceAction{
-		callback: callback,
-		version:  1,
+		callback:  callback,
+		version:   1,
+		envelopes: envelopes,
 	}
 	return
 }
 
-//Run starts a scamp service
+// Run starts a scamp service. It serves every listener until all of them are closed.
 func (serv *Service) Run() {
+	var wg sync.WaitGroup
+	for _, listener := range serv.extraListeners {
+		wg.Add(1)
+		go func(listener net.Listener) {
+			defer wg.Done()
+			serv.serve(listener, &wg)
+		}(listener)
+	}
+	serv.serve(serv.listener, &wg)
+	wg.Wait()
+
+	// Info.Printf("closing all registered objects")
 
-forLoop:
+	serv.clientsM.Lock()
+	for _, client := range serv.clients {
+		client.Close()
+	}
+	serv.clientsM.Unlock()
+
+	// only a running PrintStatsLoop reads this
+	select {
+	case serv.statsCloseChan <- true:
+	default:
+	}
+}
+
+// serve accepts connections from listener until it is closed. Connection setup is
+// tracked by wg so Run doesn't return while a connection is still being added.
+func (serv *Service) serve(listener net.Listener, wg *sync.WaitGroup) {
 	for {
-		netConn, err := serv.listener.Accept()
+		netConn, err := listener.Accept()
 		if err != nil {
 			// Info.Printf("exiting service Run(): `%s`", err)
-			break forLoop
+			return
 		}
 		// Trace.Printf("accepted new connection...")
 
-		//var tlsConn (*tls.Conn) = (netConn).(*tls.Conn)
-		tlsConn := (netConn).(*tls.Conn)
-		if tlsConn == nil {
-			Error.Fatalf("could not create tlsConn")
-			break forLoop
-		}
-
-		conn := NewConnection(tlsConn, "service")
-		client := NewClient(conn, "service")
-
-		serv.clientsM.Lock()
-		serv.clients = append(serv.clients, client)
-		serv.clientsM.Unlock()
-
-		go serv.Handle(client)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serv.accept(netConn)
+		}()
+	}
+}
 
-		atomic.AddUint64(&serv.connectionsAccepted, 1)
+// accept finishes the TLS handshake, so the caller's certificate is known, and starts
+// handling the connection
+func (serv *Service) accept(netConn net.Conn) {
+	if tlsConn, ok := netConn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+		err := tlsConn.Handshake()
+		if err != nil {
+			Error.Printf("TLS handshake with %s failed: `%s`", netConn.RemoteAddr(), err)
+			netConn.Close()
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
 	}
 
-	// Info.Printf("closing all registered objects")
+	conn := NewConnection(netConn, "service")
+	client := NewClient(conn, "service")
 
 	serv.clientsM.Lock()
-	for _, client := range serv.clients {
-		client.Close()
-	}
+	serv.clients = append(serv.clients, client)
 	serv.clientsM.Unlock()
 
-	serv.statsCloseChan <- true
+	go serv.Handle(client)
+
+	atomic.AddUint64(&serv.connectionsAccepted, 1)
 }
 
-//Handle handles incoming client messages received via the cient MessageChan
+// Handle handles incoming client messages received via the cient MessageChan
 func (serv *Service) Handle(client *Client) {
 	var action *ServiceAction
 	//Info.Printf("handling client for remote connection: %s\n", client.conn.conn.RemoteAddr())
@@ -217,18 +522,33 @@ HandlerLoop:
 				break HandlerLoop
 			}
 			action = serv.actions[msg.Action]
+			authorized := serv.authorizedCallers == nil || serv.authorizedCallers.AuthorizedClient(client, serv.sector, msg.Action)
 
-			if action != nil {
+			if action != nil && action.acceptsEnvelope(msg.Envelope) && authorized && msg.bodyErr == nil {
 				// Info.Printf("handling action %s\n", action.crudTags)
 				action.callback(msg, client)
 			} else {
-				Error.Printf("do not know how to handle action `%s`", msg.Action)
-
 				reply := NewMessage()
 				reply.SetMessageType(MessageTypeReply)
 				reply.SetEnvelope(EnvelopeJSON)
 				reply.SetRequestID(msg.RequestID)
-				reply.Write([]byte(`{"error": "no such action"}`))
+				if action == nil {
+					Error.Printf("do not know how to handle action `%s`", msg.Action)
+					reply.Write([]byte(`{"error": "no such action"}`))
+				} else if !authorized {
+					Error.Printf("caller `%s` is not authorized for action `%s`", client.Fingerprint(), msg.Action)
+					reply.SetError(fmt.Sprintf("caller is not authorized for `%s`", msg.Action))
+					reply.SetErrorCode("unauthorized")
+				} else if msg.bodyErr != nil {
+					// the action would see an empty body
+					Error.Printf("could not read request for action `%s`: %s", msg.Action, msg.bodyErr)
+					reply.SetError(fmt.Sprintf("could not decompress body: %s", msg.bodyErr))
+					reply.SetErrorCode(defaultErrorCode)
+				} else {
+					Error.Printf("action `%s` does not accept envelope `%s`", msg.Action, msg.Envelope)
+					reply.SetError(fmt.Sprintf("action does not accept envelope `%s`", msg.Envelope))
+					reply.SetErrorCode(defaultErrorCode)
+				}
 				_, err := client.Send(reply)
 				if err != nil {
 					client.Close()
@@ -268,26 +588,47 @@ func (serv *Service) RemoveClient(client *Client) (err error) {
 	return nil
 }
 
-// Stop closes the service's net.Listener
+// Stop closes the service's net.Listeners
 func (serv *Service) Stop() {
 	// Sometimes we Stop() before service after service has been init but before it is started
 	// The usual case is a bad config in another plugin
 	if serv.listener != nil {
 		serv.listener.Close()
 	}
+	for _, listener := range serv.extraListeners {
+		listener.Close()
+	}
 }
 
 // MarshalText serializes a scamp service
 func (serv *Service) MarshalText() (b []byte, err error) {
+	return serv.marshalAnnouncement(false, false)
+}
+
+// marshalAnnouncement signs the service's announcement. With extensionOnly every
+// action is announced in the more compact v4 discovery extension. final announces
+// weight 0, for a service going away.
+func (serv *Service) marshalAnnouncement(extensionOnly bool, final bool) (b []byte, err error) {
 	var buf bytes.Buffer
 
 	serviceProxy := serviceAsServiceProxy(serv)
+	if final {
+		serviceProxy.weight = 0
+	}
+	if extensionOnly {
+		serviceProxy.extendActions()
+	}
 
 	classRecord, err := serviceProxy.MarshalJSON() //json.Marshal(&serviceProxy) //Marshal is mangling service actions
 	if err != nil {
 		return
 	}
-	sig, err := signSHA256(classRecord, serv.cert.PrivateKey.(*rsa.PrivateKey))
+	privateKey, ok := serv.cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		err = fmt.Errorf("service `%s` has no private key to sign its announcement", serv.name)
+		return
+	}
+	sig, err := signPayload(classRecord, privateKey)
 	if err != nil {
 		return
 	}
@@ -7,6 +7,8 @@ import "encoding/json"
 import "net"
 import "crypto/tls"
 import "io/ioutil"
+import "strings"
+import "bufio"
 
 // TODO: fix Session API (aka, simplify design by dropping it)
 func TestServiceHandlesRequest(t *testing.T) {
@@ -92,6 +94,7 @@ func TestServiceToProxyMarshal(t *testing.T) {
 		listenerIP:   net.ParseIP("174.10.10.10"),
 		listenerPort: 30100,
 		actions:      make(map[string]*ServiceAction),
+		weight:       1,
 	}
 	s.Register("Logging.info", func(_ *Message, _ *Client) {
 	})
@@ -102,7 +105,7 @@ func TestServiceToProxyMarshal(t *testing.T) {
 	if err != nil {
 		t.Fatalf("could not serialize service proxy")
 	}
-	expected := []byte(`[3,"a-cool-name-1234","main",1,2500,"beepish+tls://174.10.10.10:30100",["json"],[["Logging",["info","",1]]],10.000000]`)
+	expected := []byte(`[3,"a-cool-name-1234","main",1,5000,"beepish+tls://174.10.10.10:30100",["json"],[["Logging",["info","",1]]],10.000000]`)
 	if !bytes.Equal(b, expected) {
 		t.Fatalf("expected: `%s`,\n             got:      `%s`", expected, b)
 	}
@@ -146,3 +149,206 @@ func TestFullServiceMarshal(t *testing.T) {
 	t.Fatalf("b: `%s`", b)
 
 }
+
+// newEchoService serves an `Echo.echo` action, which replies with the request body, on listener
+func newEchoService(t *testing.T, listener net.Listener) (serv *Service) {
+	serv, err := NewServiceWithListener("main", "echo", listener)
+	if err != nil {
+		t.Fatalf("could not create service: `%s`", err)
+	}
+	serv.Register("Echo.echo", func(msg *Message, client *Client) {
+		reply := NewResponseMessage()
+		reply.SetEnvelope(EnvelopeJSON)
+		reply.SetRequestID(msg.RequestID)
+		reply.Write(msg.Bytes())
+		client.Send(reply)
+	})
+
+	return
+}
+
+func expectEcho(t *testing.T, connspec string) {
+	client, err := dialConnspec(connspec, nil)
+	if err != nil {
+		t.Fatalf("could not dial `%s`: `%s`", connspec, err)
+	}
+	defer client.Close()
+
+	request := NewRequestMessage()
+	request.SetAction("Echo.echo")
+	request.SetEnvelope(EnvelopeJSON)
+	request.Write([]byte(`"ping"`))
+
+	replies, err := client.Send(request)
+	if err != nil {
+		t.Fatalf("could not send request: `%s`", err)
+	}
+
+	select {
+	case reply := <-replies:
+		if string(reply.Bytes()) != `"ping"` {
+			t.Fatalf("unexpected reply `%s` from `%s`", reply.Bytes(), connspec)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for `%s`", connspec)
+	}
+}
+
+func TestServiceConnspec(t *testing.T) {
+	s := Service{
+		listenerIP:   net.ParseIP("174.10.10.10"),
+		listenerPort: 30100,
+	}
+	if s.connspec() != "beepish+tls://174.10.10.10:30100" {
+		t.Fatalf("unexpected IPv4 connspec `%s`", s.connspec())
+	}
+
+	s.listenerIP = net.ParseIP("2001:db8::10")
+	if s.connspec() != "beepish+tls://[2001:db8::10]:30100" {
+		t.Fatalf("IPv6 hosts should be bracketed, got `%s`", s.connspec())
+	}
+
+	s.SetAdvertisedHost("svc.example.com")
+	if s.connspec() != "beepish+tls://svc.example.com:30100" {
+		t.Fatalf("expected the advertised host, got `%s`", s.connspec())
+	}
+
+	sp := ServiceInstance{connspec: "beepish+tls://[2001:db8::10]:30100"}
+	if host := sp.shortHostname(); strings.Contains(host, ":30100") {
+		t.Fatalf("port leaked into short hostname `%s`", host)
+	}
+}
+
+func TestServiceServesMultipleListeners(t *testing.T) {
+	first, err := NewPipeListener("echo-first")
+	if err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+	second, err := NewPipeListener("echo-second")
+	if err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+
+	serv := newEchoService(t, first)
+	serv.AddListener(second)
+	stopped := make(chan bool)
+	go func() {
+		serv.Run()
+		stopped <- true
+	}()
+
+	if serv.connspec() != first.Connspec() {
+		t.Fatalf("expected the main listener to be announced, got `%s`", serv.connspec())
+	}
+	expectEcho(t, first.Connspec())
+	expectEcho(t, second.Connspec())
+
+	serv.Stop()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run did not return after Stop")
+	}
+}
+
+func TestServiceOverIPv6(t *testing.T) {
+	cert, err := GenerateServiceCert("echo", CertOptions{KeyBits: 1024})
+	if err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+
+	listener, err := tls.Listen("tcp", "[::1]:0", &tls.Config{Certificates: []tls.Certificate{cert.Keypair}})
+	if err != nil {
+		t.Skipf("no IPv6 loopback: `%s`", err)
+	}
+
+	serv := newEchoService(t, listener)
+	serv.SetCertificate(cert.Keypair, cert.PEMCert)
+	go serv.Run()
+	defer serv.Stop()
+
+	if !strings.HasPrefix(serv.connspec(), "beepish+tls://[::1]:") {
+		t.Fatalf("unexpected connspec `%s`", serv.connspec())
+	}
+	expectEcho(t, serv.connspec())
+
+	_, err = serv.MarshalText()
+	if err != nil {
+		t.Fatalf("could not sign announcement: `%s`", err)
+	}
+}
+
+func TestServiceRequiresClientCerts(t *testing.T) {
+	initSCAMPLogger()
+
+	var certs []*ServiceCert
+	for _, name := range []string{"echo", "caller", "stranger"} {
+		cert, err := GenerateServiceCert(name, CertOptions{KeyBits: 1024})
+		if err != nil {
+			t.Fatalf("unexpected error: `%s`", err)
+		}
+		certs = append(certs, cert)
+	}
+	serviceCert, callerCert, strangerCert := certs[0], certs[1], certs[2]
+	callerFingerprint := sha1FingerPrint(callerCert.Keypair.Leaf)
+
+	serv, err := NewServiceExplicitCert("main", "127.0.0.1:0", "echo", serviceCert.Keypair, serviceCert.PEMCert)
+	if err != nil {
+		t.Fatalf("could not create service: `%s`", err)
+	}
+	serv.Register("Echo.whoami", func(msg *Message, client *Client) {
+		reply := NewResponseMessage()
+		reply.SetRequestID(msg.RequestID)
+		reply.Write([]byte(client.Fingerprint()))
+		client.Send(reply)
+	})
+	err = serv.RequireClientCerts()
+	if err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+	authorized := NewAuthorizedServicesCache()
+	// the caller is listed by its SHA256 fingerprint, the handler sees its SHA1 one
+	authorized.LoadAuthorizedServices(bufio.NewScanner(strings.NewReader(sha256FingerPrint(callerCert.Keypair.Leaf) + " echo")))
+	serv.AuthorizeCallers(authorized)
+	go serv.Run()
+	defer serv.Stop()
+
+	whoami := func(cert *tls.Certificate) (reply *Message) {
+		client, err := DialWithCert(serv.listener.Addr().String(), cert)
+		if err != nil {
+			return nil
+		}
+		defer client.Close()
+
+		request := NewRequestMessage()
+		request.SetAction("Echo.whoami")
+		request.SetEnvelope(EnvelopeJSON)
+		replies, err := client.Send(request)
+		if err != nil {
+			return nil
+		}
+
+		select {
+		case reply = <-replies:
+			return
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for reply")
+			return
+		}
+	}
+
+	reply := whoami(&callerCert.Keypair)
+	if reply == nil || string(reply.Bytes()) != callerFingerprint {
+		t.Fatalf("expected the handler to see the caller's fingerprint `%s`", callerFingerprint)
+	}
+
+	reply = whoami(&strangerCert.Keypair)
+	if reply == nil || reply.ErrorCode != "unauthorized" {
+		t.Fatalf("expected an unauthorized caller to be refused, got `%v`", reply)
+	}
+
+	reply = whoami(nil)
+	if reply != nil {
+		t.Fatalf("expected callers without a certificate to be disconnected, got `%s`", reply.Bytes())
+	}
+}
@@ -3,34 +3,183 @@ package scamp
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// ServiceCache indexes the service instances found in the discovery cache. Lookups
+// read an immutable snapshot of the indexes without locking; changes build a new
+// snapshot under cacheM and publish it atomically.
 type ServiceCache struct {
 	path          string
 	cacheM        sync.Mutex
-	identIndex    map[string]*serviceProxy
-	actionIndex   map[string][]*serviceProxy
+	snapshot      atomic.Pointer[cacheSnapshot]
 	verifyRecords bool
+	expiryPolicy  CertExpiryPolicy
+	expiryWarned  map[string]bool
+	now           func() time.Time
+	revocations   *RevocationList
+	revokeHooks   []*revokeHook
+	subscriptions []*cacheSubscription
+	// sources are the instances fed by each provider, see AddProvider
+	sources []*providerSource
+	// records are the instances read by the last DoScan, by recordKey. Records that
+	// failed verification are kept as nil.
+	records map[string]*ServiceInstance
+	scanM   sync.Mutex
+	modTime time.Time
+	size    int64
+	// stopWatching ends the watchers and providers started by loadServiceCache
+	stopWatching context.CancelFunc
 }
 
 func NewServiceCache(path string) (cache *ServiceCache, err error) {
+	cache, err = newServiceCache(path)
+	if err != nil {
+		return
+	}
+
+	//moving this here for now
+	err = cache.Refresh()
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+// newServiceCache allocates an empty cache for path without reading it
+func newServiceCache(path string) (cache *ServiceCache, err error) {
 	cache = new(ServiceCache)
 	cache.path = path
 
-	cache.identIndex = make(map[string]*serviceProxy)
-	cache.actionIndex = make(map[string][]*serviceProxy)
+	cache.snapshot.Store(newCacheSnapshot())
 	cache.verifyRecords = true
+	cache.expiryWarned = make(map[string]bool)
+	cache.now = time.Now
+
+	return
+}
+
+// loadServiceCache reads the discovery cache described by conf: `discovery.cache_path`,
+// the optional `discovery.cert_expiry` policy and the optional
+// `discovery.revoked_fingerprints` file, which is watched for changes. The cache file
+// itself is watched when `discovery.cache_reload_interval` is set.
+//
+// Instances are also found live on the multicast group with
+// `discovery.listen_multicast = true`, and read from the unsigned manifest named by
+// `discovery.static_manifest` when static discovery is allowed. Either makes
+// `discovery.cache_path` optional.
+//
+// Close the cache to stop watching its files and providers.
+func loadServiceCache(conf *Config) (cache *ServiceCache, err error) {
+	listenMulticast, err := configBool(conf, "discovery.listen_multicast")
+	if err != nil {
+		return
+	}
+	manifestPath, hasManifest := conf.Get("discovery.static_manifest")
+
+	cachePath, found := conf.Get("discovery.cache_path")
+	if !found && !listenMulticast && !hasManifest {
+		err = fmt.Errorf("no such config param `discovery.cache_path`. must be set to use scamp-go")
+		return
+	}
+
+	cache, err = newServiceCache(cachePath)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cache.stopWatching = cancel
+	defer func() {
+		if err != nil {
+			cancel()
+		}
+	}()
+
+	if value, ok := conf.Get("discovery.cert_expiry"); ok {
+		cache.expiryPolicy, err = ParseCertExpiryPolicy(value)
+		if err != nil {
+			return
+		}
+	}
+
+	if path, ok := conf.Get("discovery.revoked_fingerprints"); ok {
+		var revocations *RevocationList
+		revocations, err = LoadRevocationList(path)
+		if err != nil {
+			return
+		}
+		cache.SetRevocationList(revocations)
+		go revocations.Watch(RevocationReloadInterval, ctx.Done())
+	}
 
-	//moving this here for now
 	err = cache.Refresh()
 	if err != nil {
 		return
 	}
 
+	if value, ok := conf.Get("discovery.cache_reload_interval"); ok {
+		var interval time.Duration
+		interval, err = time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			err = fmt.Errorf("bad `discovery.cache_reload_interval` `%s`: expected a positive duration like 5s", value)
+			return
+		}
+		go cache.Watch(interval, ctx.Done())
+	}
+
+	if hasManifest {
+		var provider *StaticProvider
+		provider, err = NewStaticProvider(conf)
+		if err != nil {
+			return
+		}
+		err = provider.LoadManifest(manifestPath)
+		if err != nil {
+			return
+		}
+		cache.AddProvider(ctx, provider)
+	}
+
+	if listenMulticast {
+		var listener *DiscoveryListener
+		listener, err = ListenDiscovery(conf)
+		if err != nil {
+			return
+		}
+		cache.AddProvider(ctx, NewMulticastProvider(listener))
+	}
+
+	return
+}
+
+// Close stops watching the cache file and revocation list and stops the providers
+// of a cache loaded from a config; their instances are removed. Closing a cache
+// created otherwise does nothing.
+func (cache *ServiceCache) Close() {
+	cache.cacheM.Lock()
+	stop := cache.stopWatching
+	cache.stopWatching = nil
+	cache.cacheM.Unlock()
+
+	if stop != nil {
+		stop()
+	}
+}
+
+// NewMemoryServiceCache creates a cache that is not backed by a discovery file. It is
+// only populated through Store, StoreService and StoreStatic; Refresh leaves it alone.
+func NewMemoryServiceCache() (cache *ServiceCache) {
+	cache, _ = newServiceCache("")
 	return
 }
 
@@ -42,71 +191,200 @@ func (cache *ServiceCache) EnableRecordVerification() {
 	cache.verifyRecords = false
 }
 
-func (cache *ServiceCache) Store(instance *serviceProxy) {
+// Store adds instance to the cache, replacing any instance with the same ident
+func (cache *ServiceCache) Store(instance *ServiceInstance) {
 	cache.cacheM.Lock()
 	defer cache.cacheM.Unlock()
 
+	if cache.revokedNoLock(instance) {
+		Warning.Printf("not storing `%s`: its certificate is revoked", instance.ident)
+		return
+	}
+
 	cache.storeNoLock(instance)
 
 	return
 }
 
-func (cache *ServiceCache) storeNoLock(instance *serviceProxy) {
-	_, ok := cache.identIndex[instance.ident]
-	if !ok {
-		cache.identIndex[instance.ident] = instance
-	} else {
-		// Not sure if this is a hard error yet
-		// Error.Printf("tried to store instance that was already tracked")
-		// Override existing version. Correct logic?
-		cache.identIndex[instance.ident] = instance
+// StoreService adds serv to the cache as if it had been announced. Its actions are
+// reachable at serv's connspec, without any signature check.
+func (cache *ServiceCache) StoreService(serv *Service) (err error) {
+	instance := serviceAsServiceProxy(serv)
+	if instance == nil {
+		err = fmt.Errorf("could not describe service `%s`", serv.name)
+		return
 	}
 
-	for _, class := range instance.classes {
-		for _, action := range class.actions {
-			for _, protocol := range instance.protocols {
-				mungedName := fmt.Sprintf("%s:%s.%s~%d#%s", instance.sector, class.className, action.actionName, action.version, protocol)
+	cache.Store(instance)
+	return
+}
 
-				serviceProxies, ok := cache.actionIndex[mungedName]
-				if ok {
-					serviceProxies = append(serviceProxies, instance)
-				} else {
-					serviceProxies = []*serviceProxy{instance}
-				}
+// StoreStatic adds an instance described by hand. actions are `Class.action` names,
+// optionally suffixed with `~version` (default 1), and are offered in every envelope
+// of protocols.
+func (cache *ServiceCache) StoreStatic(ident, sector, connspec string, protocols []string, actions ...string) (err error) {
+	instance, err := newStaticInstance(ident, sector, connspec, protocols, actions...)
+	if err != nil {
+		return
+	}
+
+	cache.Store(instance)
+	return
+}
 
-				cache.actionIndex[mungedName] = serviceProxies
+// newStaticInstance describes an unsigned instance, see StoreStatic
+func newStaticInstance(ident, sector, connspec string, protocols []string, actions ...string) (instance *ServiceInstance, err error) {
+	instance = new(ServiceInstance)
+	instance.version = 3
+	instance.ident = ident
+	instance.sector = sector
+	instance.weight = 1
+	instance.connspec = connspec
+	instance.protocols = protocols
+
+	classIndex := make(map[string]int)
+	for _, action := range actions {
+		version := 1
+		if tilde := strings.LastIndex(action, "~"); tilde != -1 {
+			version, err = strconv.Atoi(action[tilde+1:])
+			if err != nil {
+				err = fmt.Errorf("bad version in action `%s`: %s", action, err)
+				return
 			}
+			action = action[:tilde]
+		}
+
+		dot := strings.LastIndex(action, ".")
+		if dot == -1 {
+			err = fmt.Errorf("bad action name: `%s` (no dot found)", action)
+			return
+		}
+
+		className := action[:dot]
+		i, ok := classIndex[className]
+		if !ok {
+			i = len(instance.classes)
+			classIndex[className] = i
+			instance.classes = append(instance.classes, InstanceClass{className: className})
 		}
+		instance.classes[i].actions = append(instance.classes[i].actions, InstanceAction{
+			actionName: action[dot+1:],
+			version:    version,
+		})
 	}
 
 	return
 }
 
-func (cache *ServiceCache) removeNoLock(instance *serviceProxy) (err error) {
-	_, ok := cache.identIndex[instance.ident]
+// Remove drops the instance with the given ident from the cache
+func (cache *ServiceCache) Remove(ident string) (err error) {
+	cache.cacheM.Lock()
+	defer cache.cacheM.Unlock()
+
+	instance, ok := cache.load().identIndex[ident]
 	if !ok {
-		err = fmt.Errorf("tried removing an ident which was not being tracked: %s", instance.ident)
+		err = fmt.Errorf("tried removing an ident which was not being tracked: %s", ident)
 		return
 	}
 
-	delete(cache.identIndex, instance.ident)
+	snapshot := cache.load().clone()
+	snapshot.purge(instance)
+	cache.publishNoLock(snapshot)
+	return
+}
+
+func (cache *ServiceCache) storeNoLock(instance *ServiceInstance) {
+	snapshot := cache.load().clone()
+	snapshot.index(instance)
+	cache.publishNoLock(snapshot)
+}
+
+// load returns the current snapshot. It must not be modified.
+func (cache *ServiceCache) load() *cacheSnapshot {
+	return cache.snapshot.Load()
+}
+
+// cacheSnapshot is one version of the cache's indexes. Published snapshots are never
+// modified: writers clone the current one, change the clone and publish it.
+type cacheSnapshot struct {
+	identIndex  map[string]*ServiceInstance
+	actionIndex map[string][]*ServiceInstance
+}
+
+func newCacheSnapshot() (snapshot *cacheSnapshot) {
+	snapshot = new(cacheSnapshot)
+	snapshot.identIndex = make(map[string]*ServiceInstance)
+	snapshot.actionIndex = make(map[string][]*ServiceInstance)
 
 	return
 }
 
-// TODO: in a perfect world we'd do upserts to the cache
-// and sweep for stale proxy definitions.
-func (cache *ServiceCache) clearNoLock() (err error) {
-	cache.identIndex = make(map[string]*serviceProxy)
+// clone copies the index maps. The instance slices are shared: index and purge
+// replace them rather than modifying them.
+func (snapshot *cacheSnapshot) clone() (cloned *cacheSnapshot) {
+	cloned = new(cacheSnapshot)
+	cloned.identIndex = make(map[string]*ServiceInstance, len(snapshot.identIndex))
+	for ident, instance := range snapshot.identIndex {
+		cloned.identIndex[ident] = instance
+	}
+	cloned.actionIndex = make(map[string][]*ServiceInstance, len(snapshot.actionIndex))
+	for mungedName, instances := range snapshot.actionIndex {
+		cloned.actionIndex[mungedName] = instances
+	}
 
 	return
 }
 
-func (cache *ServiceCache) Retrieve(ident string) (instance *serviceProxy) {
-	cache.cacheM.Lock()
-	defer cache.cacheM.Unlock()
+// index adds instance to the ident index and to the action index under each of its
+// actions, replacing any instance indexed under the same ident
+func (snapshot *cacheSnapshot) index(instance *ServiceInstance) {
+	if old, ok := snapshot.identIndex[instance.ident]; ok {
+		snapshot.purge(old)
+	}
+	snapshot.identIndex[instance.ident] = instance
+
+	for _, class := range instance.classes {
+		for _, action := range class.actions {
+			sector := instance.actionSector(action)
+			for _, protocol := range instance.actionEnvelopes(action) {
+				mungedName := fmt.Sprintf("%s:%s.%s~%d#%s", sector, class.className, action.actionName, action.version, protocol)
+				// capped so append never writes to an array an older snapshot shares
+				instances := snapshot.actionIndex[mungedName]
+				snapshot.actionIndex[mungedName] = append(instances[:len(instances):len(instances)], instance)
+			}
+		}
+	}
+}
+
+// purge drops instances from both the ident and the action index
+func (snapshot *cacheSnapshot) purge(instances ...*ServiceInstance) {
+	purged := make(map[*ServiceInstance]bool, len(instances))
+	for _, instance := range instances {
+		if snapshot.identIndex[instance.ident] == instance {
+			delete(snapshot.identIndex, instance.ident)
+		}
+		purged[instance] = true
+	}
+
+	for mungedName, indexed := range snapshot.actionIndex {
+		kept := make([]*ServiceInstance, 0, len(indexed))
+		for _, candidate := range indexed {
+			if !purged[candidate] {
+				kept = append(kept, candidate)
+			}
+		}
+
+		if len(kept) == 0 {
+			delete(snapshot.actionIndex, mungedName)
+		} else if len(kept) != len(indexed) {
+			snapshot.actionIndex[mungedName] = kept
+		}
+	}
+}
 
-	instance, ok := cache.identIndex[ident]
+// Retrieve returns the instance with the given ident, or nil if there is none
+func (cache *ServiceCache) Retrieve(ident string) (instance *ServiceInstance) {
+	instance, ok := cache.load().identIndex[ident]
 	if !ok {
 		instance = nil
 		return
@@ -115,9 +393,11 @@ func (cache *ServiceCache) Retrieve(ident string) (instance *serviceProxy) {
 	return
 }
 
-func (cache *ServiceCache) SearchByAction(sector, action string, version int, envelope string) (instances []*serviceProxy, err error) {
+// SearchByAction returns the instances offering sector:action~version in envelope. The
+// returned slice is shared with the cache and must not be modified.
+func (cache *ServiceCache) SearchByAction(sector, action string, version int, envelope string) (instances []*ServiceInstance, err error) {
 	mungedName := fmt.Sprintf("%s:%s~%d#%s", sector, action, version, envelope)
-	instances = cache.actionIndex[mungedName]
+	instances = cache.load().actionIndex[mungedName]
 	if len(instances) == 0 {
 		err = fmt.Errorf("no instances found")
 		return
@@ -125,22 +405,18 @@ func (cache *ServiceCache) SearchByAction(sector, action string, version int, en
 	return
 }
 
+// Size is the number of instances in the cache
 func (cache *ServiceCache) Size() int {
-	cache.cacheM.Lock()
-	defer cache.cacheM.Unlock()
-
-	return len(cache.identIndex)
+	return len(cache.load().identIndex)
 }
 
-func (cache *ServiceCache) All() (proxies []*serviceProxy) {
-	cache.cacheM.Lock()
-	defer cache.cacheM.Unlock()
-
-	size := len(cache.identIndex)
-	proxies = make([]*serviceProxy, size)
+// All lists every instance in the cache
+func (cache *ServiceCache) All() (proxies []*ServiceInstance) {
+	identIndex := cache.load().identIndex
+	proxies = make([]*ServiceInstance, len(identIndex))
 
 	index := 0
-	for _, proxy := range cache.identIndex {
+	for _, proxy := range identIndex {
 		proxies[index] = proxy
 		index++
 	}
@@ -151,9 +427,24 @@ func (cache *ServiceCache) All() (proxies []*serviceProxy) {
 var sep = []byte(`%%%`)
 var newline = []byte("\n")
 
+// Refresh reads the cache file again. Records that did not change since the previous
+// read are not parsed or verified again.
 func (cache *ServiceCache) Refresh() (err error) {
-	cache.cacheM.Lock()
-	defer cache.cacheM.Unlock()
+	_, err = cache.refresh(false)
+	return
+}
+
+// RefreshIfChanged reads the cache file again if its modification time or size
+// changed since it was last read
+func (cache *ServiceCache) RefreshIfChanged() (refreshed bool, err error) {
+	return cache.refresh(true)
+}
+
+func (cache *ServiceCache) refresh(onlyIfChanged bool) (refreshed bool, err error) {
+	// memory caches have nothing to read
+	if len(cache.path) == 0 {
+		return
+	}
 
 	stat, err := os.Stat(cache.path)
 	if err != nil {
@@ -162,12 +453,19 @@ func (cache *ServiceCache) Refresh() (err error) {
 		err = fmt.Errorf("cannot use cache path: `%s` is a directory", cache.path)
 		return
 	}
-	// Trace.Printf("mtime: %s\n", stat.ModTime())
+
+	cache.cacheM.Lock()
+	unchanged := stat.ModTime().Equal(cache.modTime) && stat.Size() == cache.size
+	cache.cacheM.Unlock()
+	if onlyIfChanged && unchanged {
+		return
+	}
 
 	cacheHandle, err := os.Open(cache.path)
 	if err != nil {
 		return
 	}
+	defer cacheHandle.Close()
 
 	s := bufio.NewScanner(cacheHandle)
 	err = cache.DoScan(s)
@@ -175,11 +473,88 @@ func (cache *ServiceCache) Refresh() (err error) {
 		return
 	}
 
+	cache.cacheM.Lock()
+	cache.modTime = stat.ModTime()
+	cache.size = stat.Size()
+	cache.cacheM.Unlock()
+
+	refreshed = true
 	return
 }
 
+// Watch calls RefreshIfChanged every interval until stop is closed. Failed refreshes
+// leave the cache as it was and are logged.
+func (cache *ServiceCache) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			_, err := cache.RefreshIfChanged()
+			if err != nil {
+				Error.Printf("could not refresh discovery cache: %s", err)
+			}
+		}
+	}
+}
+
+// DoScan replaces the cache's instances with the records read from s, keeping those
+// fed by its providers. The new indexes are built on the side and swapped in at once,
+// so readers see either the old or the new records. Records whose bytes are
+// identical to one read by the previous scan reuse its instance instead of being
+// parsed and verified again.
 func (cache *ServiceCache) DoScan(s *bufio.Scanner) (err error) {
-	cache.clearNoLock()
+	cache.scanM.Lock()
+	defer cache.scanM.Unlock()
+
+	cache.cacheM.Lock()
+	previous := cache.records
+	verifyRecords := cache.verifyRecords
+	cache.cacheM.Unlock()
+
+	records, order, err := scanRecords(s, previous, verifyRecords)
+	if err != nil {
+		return
+	}
+
+	cache.cacheM.Lock()
+	defer cache.cacheM.Unlock()
+
+	snapshot := newCacheSnapshot()
+	for _, serviceProxy := range order {
+		if verifyRecords {
+			err = cache.checkCertExpiry(serviceProxy)
+			if err != nil {
+				Warning.Printf("dropping announcement of `%s`: %s", serviceProxy.ident, err)
+				err = nil
+				continue
+			}
+		}
+
+		if cache.revokedNoLock(serviceProxy) {
+			Warning.Printf("dropping announcement of `%s`: its certificate is revoked", serviceProxy.ident)
+			continue
+		}
+
+		snapshot.index(serviceProxy)
+	}
+	cache.indexProvidedNoLock(snapshot)
+
+	cache.publishNoLock(snapshot)
+	cache.records = records
+
+	return
+}
+
+// scanRecords reads the records of a discovery cache file from s, in order, and
+// returns them by recordKey. Records whose bytes are identical to one in previous
+// reuse its instance instead of being parsed and verified again. With verifyRecords,
+// records failing verification are logged and kept as nil.
+func scanRecords(s *bufio.Scanner, previous map[string]*ServiceInstance, verifyRecords bool) (records map[string]*ServiceInstance, order []*ServiceInstance, err error) {
+	records = make(map[string]*ServiceInstance)
 
 	// var entries int = 0
 	// Scan through buf by lines according to this basic ABNF
@@ -237,25 +612,35 @@ func (cache *ServiceCache) DoScan(s *bufio.Scanner) (err error) {
 
 		// Error.Printf("`%s`", sigRaw)
 
+		key := recordKey(classRecordsRaw, certRaw, sigRaw)
+		if serviceProxy, ok := previous[key]; ok {
+			// a nil instance is a record that failed verification
+			records[key] = serviceProxy
+			if serviceProxy != nil {
+				order = append(order, serviceProxy)
+			}
+			continue
+		}
+
 		// Use those extracted value to make an instance
-		serviceProxy, err := newServiceProxy(classRecordsRaw, certRaw, sigRaw)
-		if err != nil {
-			return fmt.Errorf("newServiceProxy: %s", err)
+		serviceProxy, parseErr := newServiceProxy(classRecordsRaw, certRaw, sigRaw)
+		if parseErr != nil {
+			err = fmt.Errorf("newServiceProxy: %s", parseErr)
+			return
 		}
 
 		// Validating is a very expensive operation in the benchmarks
-		if cache.verifyRecords {
-			err = serviceProxy.Validate()
-			if err != nil {
-				err = cache.removeNoLock(serviceProxy)
-				if err != nil {
-					Error.Printf("could not remove service proxy (benign on first pass, otherwise it means the service has gone to a bad state): `%s`", err)
-				}
+		if verifyRecords {
+			verifyErr := serviceProxy.Validate()
+			if verifyErr != nil {
+				Warning.Printf("dropping announcement of `%s`: %s", serviceProxy.ident, verifyErr)
+				records[key] = nil
 				continue
 			}
 		}
 
-		cache.storeNoLock(serviceProxy)
+		records[key] = serviceProxy
+		order = append(order, serviceProxy)
 	}
 
 	// fmt.Println("entries:", entries)
@@ -263,6 +648,16 @@ func (cache *ServiceCache) DoScan(s *bufio.Scanner) (err error) {
 	return
 }
 
+// recordKey identifies a discovery record by its raw bytes
+func recordKey(classRecordsRaw, certRaw, sigRaw []byte) string {
+	h := sha256.New()
+	for _, part := range [][]byte{classRecordsRaw, certRaw, sigRaw} {
+		h.Write(part)
+		h.Write([]byte{0})
+	}
+	return string(h.Sum(nil))
+}
+
 var startCert = []byte(`-----BEGIN CERTIFICATE-----`)
 var endCert = []byte(`-----END CERTIFICATE-----`)
 
@@ -4,6 +4,10 @@ import "testing"
 import "bytes"
 import "bufio"
 import "os"
+import "io/ioutil"
+import "path/filepath"
+import "time"
+import "sync"
 
 func TestScanCertificate(t *testing.T) {
 	reader := bytes.NewReader(testCertificateToScan)
@@ -88,7 +92,7 @@ func TestRegisterOnServiceCache(t *testing.T) {
 	if err != nil {
 		t.Fatalf("could not create new service cache")
 	}
-	serviceInstance := new(serviceProxy)
+	serviceInstance := new(ServiceInstance)
 	serviceInstance.ident = "bob"
 
 	cache.Store(serviceInstance)
@@ -219,19 +223,147 @@ DzZqcZjWY5gs9UaTHBBMAwp5G3tr1uQ6Fgi3mFlo1tA9J5Vex8CEaw+U0YklidTKMVDN3y8OLZsICLwT
 func TestSearchByAction(t *testing.T) {
 	cache, err := newServiceCache("/Users/xavierlange/code/gudtech/workspace/src/github.com/gudtech/scamp-go/fixtures/sample_discovery_cache")
 	if err != nil {
-		t.Fatalf(err.Error())
+		t.Fatalf("%s", err)
 	}
 
 	cache.DisableRecordVerification()
 	err = cache.Refresh()
 	if err != nil {
-		t.Fatalf(err.Error())
+		t.Fatalf("%s", err)
 	}
 
 	// t.Fatalf("%s", cache.actionIndex)
 
-	serviceProxy := cache.SearchByAction("main", "Logger.info", 1, "json")
-	if serviceProxy == nil {
+	serviceProxies, err := cache.SearchByAction("main", "Logger.info", 1, "json")
+	if err != nil || len(serviceProxies) == 0 {
 		t.Fatalf("hmm, no hit!")
 	}
 }
+
+func TestIncrementalRefresh(t *testing.T) {
+	initSCAMPLogger()
+
+	now := time.Now()
+	first, firstIdent := announceWithValidity(t, "first", now, time.Hour)
+	second, secondIdent := announceWithValidity(t, "second", now, time.Hour)
+
+	path := filepath.Join(t.TempDir(), "discovery.cache")
+	err := ioutil.WriteFile(path, first, 0644)
+	if err != nil {
+		t.Fatalf("could not write cache: `%s`", err)
+	}
+
+	cache, err := NewServiceCache(path)
+	if err != nil {
+		t.Fatalf("could not load cache: `%s`", err)
+	}
+	instance := cache.Retrieve(firstIdent)
+	if instance == nil {
+		t.Fatalf("expected `%s` to be cached", firstIdent)
+	}
+
+	refreshed, err := cache.RefreshIfChanged()
+	if err != nil || refreshed {
+		t.Fatalf("expected an unchanged file not to be read again (%v)", err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go cache.Watch(5*time.Millisecond, stop)
+
+	err = ioutil.WriteFile(path, append(append([]byte{}, first...), second...), 0644)
+	if err != nil {
+		t.Fatalf("could not write cache: `%s`", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for cache.Size() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the watcher did not pick up the new record")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if cache.Retrieve(firstIdent) != instance {
+		t.Fatalf("expected the unchanged record to keep its instance")
+	}
+	if cache.Retrieve(secondIdent) == nil {
+		t.Fatalf("expected `%s` to be cached", secondIdent)
+	}
+	if _, err = cache.SearchByAction("main", "Expiry.check", 1, "json"); err != nil {
+		t.Fatalf("expected the actions to be indexed: `%s`", err)
+	}
+}
+
+// Run with -race: searches must never see a cache being rebuilt
+func TestConcurrentSearchDuringRefresh(t *testing.T) {
+	initSCAMPLogger()
+
+	now := time.Now()
+	first, firstIdent := announceWithValidity(t, "first", now, time.Hour)
+	second, _ := announceWithValidity(t, "second", now, time.Hour)
+	both := append(append([]byte{}, first...), second...)
+
+	cache := NewMemoryServiceCache()
+	err := cache.DoScan(bufio.NewScanner(bytes.NewReader(both)))
+	if err != nil {
+		t.Fatalf("could not scan: `%s`", err)
+	}
+
+	stop := make(chan struct{})
+	refresherDone := make(chan struct{})
+	go func() {
+		defer close(refresherDone)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			records := both
+			if i%2 == 1 {
+				records = first
+			}
+			err := cache.DoScan(bufio.NewScanner(bytes.NewReader(records)))
+			if err != nil {
+				t.Errorf("could not scan: `%s`", err)
+				return
+			}
+			cache.StoreStatic("static", "main", "beepish+tls://127.0.0.1:30100", []string{"json"}, "Expiry.check")
+			cache.Remove("static")
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2000; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				instances, err := cache.SearchByAction("main", "Expiry.check", 1, "json")
+				if err != nil || len(instances) == 0 || len(instances) > 3 {
+					t.Errorf("unexpected search result %d instances (%v)", len(instances), err)
+					return
+				}
+				for _, instance := range instances {
+					if instance == nil {
+						t.Errorf("found a nil instance")
+						return
+					}
+				}
+				if cache.Retrieve(firstIdent) == nil {
+					t.Errorf("`%s` went missing", firstIdent)
+					return
+				}
+				if size := cache.Size(); size < 1 || size > 3 {
+					t.Errorf("unexpected size %d", size)
+					return
+				}
+				cache.All()
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	<-refresherDone
+}
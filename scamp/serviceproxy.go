@@ -1,11 +1,11 @@
 package scamp
 
 import (
-	"crypto/rsa"
+	"bytes"
 	"crypto/x509"
 	"encoding/json"
-	"encoding/pem"
 	"log"
+	"sort"
 
 	"strconv"
 
@@ -13,6 +13,8 @@ import (
 	"strings"
 
 	"sync"
+	"time"
+	"unicode"
 
 	"net"
 	u "net/url"
@@ -31,7 +33,9 @@ type ServiceProxyDiscoveryExtension struct {
 	AcNs   []interface{} `json:"acns"`
 }
 
-type serviceProxy struct {
+// ServiceInstance is a service instance found through discovery. It is read-only:
+// use its accessors to inspect it.
+type ServiceInstance struct {
 	version          int
 	ident            string
 	sector           string
@@ -39,46 +43,71 @@ type serviceProxy struct {
 	announceInterval int
 	connspec         string
 	protocols        []string
-	classes          []serviceProxyClass
+	classes          []InstanceClass
 	extension        *ServiceProxyDiscoveryExtension
 	rawClassRecords  []byte
 	rawCert          []byte
 	rawSig           []byte
+	certOnce         sync.Once
+	cert             *x509.Certificate
+	certErr          error
 	timestamp        highResTimestamp
 	clientM          sync.Mutex
 	client           *Client
 }
 
-func (sp *serviceProxy) GetClient() (client *Client, err error) {
+func (sp *ServiceInstance) GetClient() (client *Client, err error) {
 	sp.clientM.Lock()
 
-	//TODO: what really needs to happen is the removal of closed client from sp.client. Checking `sp.client.isClosed` is a bandaid
-	if sp.client == nil || sp.client.isClosed {
-		var url *u.URL
-		url, err = u.Parse(sp.connspec)
-		if err != nil {
-			return nil, err
-		}
+	//TODO: what really needs to happen is the removal of closed client from sp.client. Checking `sp.client.isClosed()` is a bandaid
+	if sp.client != nil && !sp.client.isClosed() {
+		client = sp.client
+		sp.clientM.Unlock()
+		return
+	}
 
-		sp.client, err = Dial(url.Host)
-		if err != nil {
-			return
-		}
+	client, err = dialConnspec(sp.connspec, nil)
+	if err != nil {
+		sp.clientM.Unlock()
+		return nil, err
 	}
+	sp.client = client
+	sp.clientM.Unlock()
 
-	client = sp.client
-	//using ident so that we can set the service proxy's client to nil in client.Close()
-	client.spIdent = sp.ident
+	// registered outside the lock: the hook runs right away if the client already died
+	client.OnClose(sp.forgetClient)
 
-	sp.clientM.Unlock()
 	return
 }
 
-func (sp *serviceProxy) Ident() string {
+// forgetClient is the close hook for sp.client so a new one is dialed on demand
+func (sp *ServiceInstance) forgetClient(client *Client) {
+	sp.clientM.Lock()
+	defer sp.clientM.Unlock()
+
+	if sp.client == client {
+		sp.client = nil
+	}
+}
+
+// closeClient closes the client GetClient dialed, if any
+func (sp *ServiceInstance) closeClient() {
+	sp.clientM.Lock()
+	client := sp.client
+	sp.clientM.Unlock()
+
+	// outside the lock: closing runs forgetClient
+	if client != nil {
+		client.Close()
+	}
+}
+
+// Ident uniquely identifies the instance
+func (sp *ServiceInstance) Ident() string {
 	return sp.ident
 }
 
-func (sp *serviceProxy) baseIdent() string {
+func (sp *ServiceInstance) baseIdent() string {
 	baseAndRest := strings.SplitN(sp.ident, ":", 2)
 	if len(baseAndRest) != 2 {
 		return sp.ident
@@ -86,17 +115,16 @@ func (sp *serviceProxy) baseIdent() string {
 	return baseAndRest[0]
 }
 
-func (sp *serviceProxy) shortHostname() string {
+func (sp *ServiceInstance) shortHostname() string {
 	url, err := u.Parse(sp.connspec)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	hostParts := strings.Split(url.Host, ":")
-	if len(hostParts) != 2 {
+	host, _, err := net.SplitHostPort(url.Host)
+	if err != nil {
 		return sp.connspec
 	}
-	host := hostParts[0]
 
 	names, err := net.LookupAddr(host)
 	if err != nil {
@@ -108,62 +136,199 @@ func (sp *serviceProxy) shortHostname() string {
 	return names[0]
 }
 
-func (sp *serviceProxy) ConnSpec() string {
+// ConnSpec is the address the instance accepts connections on
+func (sp *ServiceInstance) ConnSpec() string {
 	return sp.connspec
 }
 
-func (sp *serviceProxy) Sector() string {
+// Sector is the sector the instance's actions are in
+func (sp *ServiceInstance) Sector() string {
+	return sp.sector
+}
+
+// Weight is the announced share of requests the instance wants, relative to the other
+// instances of its actions
+func (sp *ServiceInstance) Weight() int {
+	return sp.weight
+}
+
+// AnnounceInterval is how often the instance said it announces itself
+func (sp *ServiceInstance) AnnounceInterval() time.Duration {
+	return time.Duration(sp.announceInterval) * time.Millisecond
+}
+
+// Protocols are the envelopes the instance accepts
+func (sp *ServiceInstance) Protocols() []string {
+	return append([]string(nil), sp.protocols...)
+}
+
+// Classes are the announced classes and their actions, including those announced in
+// the v4 discovery extension. Every action's Sector and Envelopes are filled in.
+func (sp *ServiceInstance) Classes() (classes []InstanceClass) {
+	classes = make([]InstanceClass, len(sp.classes))
+	for i, class := range sp.classes {
+		classes[i].className = class.className
+		classes[i].actions = make([]InstanceAction, len(class.actions))
+		for j, action := range class.actions {
+			action.sector = sp.actionSector(action)
+			action.envelopes = sp.actionEnvelopes(action)
+			classes[i].actions[j] = action
+		}
+	}
+	return
+}
+
+// actionSector is the sector action is in: its own, or else the instance's
+func (sp *ServiceInstance) actionSector(action InstanceAction) string {
+	if len(action.sector) > 0 {
+		return action.sector
+	}
 	return sp.sector
 }
 
-func (sp *serviceProxy) Classes() []serviceProxyClass {
-	return sp.classes
+// actionEnvelopes are the envelopes action accepts: its own, or else the instance's
+func (sp *ServiceInstance) actionEnvelopes(action InstanceAction) []string {
+	if len(action.envelopes) > 0 {
+		return action.envelopes
+	}
+	return sp.protocols
+}
+
+// Fingerprint is the SHA1 fingerprint of the certificate the instance announced
+// with, or an empty string if it has none
+func (sp *ServiceInstance) Fingerprint() string {
+	cert, err := sp.certificate()
+	if err != nil {
+		return ""
+	}
+	return sha1FingerPrint(cert)
+}
+
+// FingerprintSHA256 is the SHA256 fingerprint of the same certificate as Fingerprint
+func (sp *ServiceInstance) FingerprintSHA256() string {
+	cert, err := sp.certificate()
+	if err != nil {
+		return ""
+	}
+	return sha256FingerPrint(cert)
+}
+
+// AnnounceTime is when the instance's announcement was made, or the zero time if it
+// carried no timestamp
+func (sp *ServiceInstance) AnnounceTime() time.Time {
+	return sp.timestamp.Time()
 }
 
-type serviceProxyClass struct {
+// InstanceClass is a class announced by a ServiceInstance
+type InstanceClass struct {
 	className string
-	actions   []actionDescription
+	actions   []InstanceAction
 }
 
-func (spc serviceProxyClass) Name() string {
+// Name is the class name, like `Logger` in `Logger.info`
+func (spc InstanceClass) Name() string {
 	return spc.className
 }
 
-func (spc serviceProxyClass) Actions() []actionDescription {
-	return spc.actions
+// Actions are the class's announced actions
+func (spc InstanceClass) Actions() []InstanceAction {
+	return append([]InstanceAction(nil), spc.actions...)
 }
 
-type actionDescription struct {
+// InstanceAction is an action announced by a ServiceInstance
+type InstanceAction struct {
 	actionName string
 	crudTags   string
 	version    int
+	// sector and envelopes are only set for actions announced in the v4 discovery
+	// extension, or in it when announcing
+	sector    string
+	envelopes []string
 }
 
-func (ad actionDescription) Name() string {
+// crudTagNames are the tags CrudTags picks out of an action's tags
+var crudTagNames = map[string]bool{"create": true, "read": true, "update": true, "destroy": true}
+
+// Name is the action name, like `info` in `Logger.info`
+func (ad InstanceAction) Name() string {
 	return ad.actionName
 }
 
-func (ad actionDescription) Version() int {
+// Version is the announced action version
+func (ad InstanceAction) Version() int {
 	return ad.version
 }
 
-func serviceAsServiceProxy(serv *Service) (sp *serviceProxy) {
-	sp = new(serviceProxy)
+// Sector is the sector the action is in
+func (ad InstanceAction) Sector() string {
+	return ad.sector
+}
+
+// Envelopes are the envelopes the action accepts
+func (ad InstanceAction) Envelopes() []string {
+	return append([]string(nil), ad.envelopes...)
+}
+
+// extended reports whether the action needs the v4 discovery extension to be announced
+func (ad InstanceAction) extended() bool {
+	return len(ad.sector) > 0 || len(ad.envelopes) > 0
+}
+
+// CrudTags are the create, read, update and destroy tags of the action
+func (ad InstanceAction) CrudTags() (tags []string) {
+	for _, tag := range ad.tags() {
+		if crudTagNames[tag] {
+			tags = append(tags, tag)
+		}
+	}
+	return
+}
+
+// Flags are the action's tags other than its CrudTags, like `noauth`
+func (ad InstanceAction) Flags() (flags []string) {
+	for _, tag := range ad.tags() {
+		if !crudTagNames[tag] {
+			flags = append(flags, tag)
+		}
+	}
+	return
+}
+
+// tags splits the announced tag string, which is comma or space separated
+func (ad InstanceAction) tags() []string {
+	return strings.FieldsFunc(ad.crudTags, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+}
+
+func serviceAsServiceProxy(serv *Service) (sp *ServiceInstance) {
+	sp = new(ServiceInstance)
 	sp.version = 3
 	sp.ident = serv.name
 	sp.sector = serv.sector
-	sp.weight = 1
-	sp.announceInterval = defaultAnnounceInterval * 500
-	sp.connspec = fmt.Sprintf("beepish+tls://%s:%d", serv.listenerIP.To4().String(), serv.listenerPort)
-	sp.protocols = make([]string, 1, 1)
-	sp.protocols[0] = "json"
-	sp.classes = make([]serviceProxyClass, 0)
+	interval, _ := serv.AnnounceInterval()
+	if interval <= 0 {
+		interval = time.Duration(defaultAnnounceInterval) * time.Second
+	}
+	sp.weight = serv.Weight()
+	sp.announceInterval = int(interval / time.Millisecond)
+	sp.connspec = serv.connspec()
+	sp.protocols = serviceEnvelopes(serv)
+	sp.classes = make([]InstanceClass, 0)
 	sp.rawClassRecords = []byte("rawClassRecords")
 	sp.rawCert = []byte("rawCert")
 	sp.rawSig = []byte("rawSig")
 
 	// { "Logger.info": [{ "name": "blah", "callback": foo() }] }
-	for classAndActionName, serviceAction := range serv.actions {
+	names := make([]string, 0, len(serv.actions))
+	for classAndActionName := range serv.actions {
+		names = append(names, classAndActionName)
+	}
+	sort.Strings(names)
+
+	classIndex := make(map[string]int)
+	for _, classAndActionName := range names {
+		serviceAction := serv.actions[classAndActionName]
 		actionDotIndex := strings.LastIndex(classAndActionName, ".")
 		// TODO: this is the only spot that could fail? shouldn't happen in any usage...
 		if actionDotIndex == -1 {
@@ -173,19 +338,26 @@ func serviceAsServiceProxy(serv *Service) (sp *serviceProxy) {
 
 		actionName := classAndActionName[actionDotIndex+1 : len(classAndActionName)]
 
-		newServiceProxyClass := serviceProxyClass{
-			className: className,
-			actions:   make([]actionDescription, 0),
-		}
-
-		newServiceProxyClass.actions = append(newServiceProxyClass.actions, actionDescription{
+		action := InstanceAction{
 			actionName: actionName,
 			crudTags:   serviceAction.crudTags,
 			version:    serviceAction.version,
-		})
-
-		sp.classes = append(sp.classes, newServiceProxyClass)
+		}
+		// actions accepting fewer envelopes than the service go in the v4 extension
+		if len(serviceAction.envelopes) != len(sp.protocols) {
+			action.sector = serv.sector
+			for _, envelope := range serviceAction.envelopes {
+				action.envelopes = append(action.envelopes, envelope.String())
+			}
+		}
 
+		i, ok := classIndex[className]
+		if !ok {
+			i = len(sp.classes)
+			classIndex[className] = i
+			sp.classes = append(sp.classes, InstanceClass{className: className})
+		}
+		sp.classes[i].actions = append(sp.classes[i].actions, action)
 	}
 
 	timestamp, err := getTimeOfDay()
@@ -198,8 +370,31 @@ func serviceAsServiceProxy(serv *Service) (sp *serviceProxy) {
 	return
 }
 
-func newServiceProxy(classRecordsRaw []byte, certRaw []byte, sigRaw []byte) (sp *serviceProxy, err error) {
-	sp = new(serviceProxy)
+// serviceEnvelopes lists every envelope accepted by at least one of the service's actions
+func serviceEnvelopes(serv *Service) (protocols []string) {
+	accepted := make(map[envelopeFormat]bool)
+	for _, serviceAction := range serv.actions {
+		for _, envelope := range serviceAction.envelopes {
+			accepted[envelope] = true
+		}
+	}
+
+	formats := make([]int, 0, len(accepted))
+	for envelope := range accepted {
+		formats = append(formats, int(envelope))
+	}
+	sort.Ints(formats)
+
+	protocols = make([]string, 0, len(formats))
+	for _, format := range formats {
+		protocols = append(protocols, envelopeFormat(format).String())
+	}
+
+	return
+}
+
+func newServiceProxy(classRecordsRaw []byte, certRaw []byte, sigRaw []byte) (sp *ServiceInstance, err error) {
+	sp = new(ServiceInstance)
 	sp.rawClassRecords = classRecordsRaw
 	sp.rawCert = certRaw
 	sp.rawSig = sigRaw
@@ -212,6 +407,7 @@ func newServiceProxy(classRecordsRaw []byte, certRaw []byte, sigRaw []byte) (sp
 	}
 	if len(classRecords) != 9 {
 		err = fmt.Errorf("expected 9 entries in class record, got %d", len(classRecords))
+		return
 	}
 
 	// OMG, position-based, heterogenously typed values in an array suck to deal with.
@@ -253,6 +449,9 @@ func newServiceProxy(classRecordsRaw []byte, certRaw []byte, sigRaw []byte) (sp
 
 	// Skip object-looking stuff. We only care about strings for now
 	for _, rawProtocol := range rawProtocols {
+		if rawProtocol == nil {
+			continue
+		}
 		var tempStr string
 		err := json.Unmarshal(*rawProtocol, &tempStr)
 		if err != nil {
@@ -277,7 +476,7 @@ func newServiceProxy(classRecordsRaw []byte, certRaw []byte, sigRaw []byte) (sp
 	if err != nil {
 		return
 	}
-	classes := make([]serviceProxyClass, len(rawClasses), len(rawClasses))
+	classes := make([]InstanceClass, len(rawClasses), len(rawClasses))
 	sp.classes = classes
 
 	for i, rawClass := range rawClasses {
@@ -292,7 +491,7 @@ func newServiceProxy(classRecordsRaw []byte, certRaw []byte, sigRaw []byte) (sp
 		}
 
 		rawActionsSlice := rawClass[1:]
-		classes[i].actions = make([]actionDescription, len(rawActionsSlice), len(rawActionsSlice))
+		classes[i].actions = make([]InstanceAction, len(rawActionsSlice), len(rawActionsSlice))
 
 		for j, rawActionSpec := range rawActionsSlice {
 			var actionsRawMessages []json.RawMessage
@@ -302,6 +501,7 @@ func newServiceProxy(classRecordsRaw []byte, certRaw []byte, sigRaw []byte) (sp
 				return nil, err
 			} else if len(actionsRawMessages) != 2 && len(actionsRawMessages) != 3 {
 				err = fmt.Errorf("expected action spec to have 2 or 3 entries. got `%s` (%d)", actionsRawMessages, len(actionsRawMessages))
+				return nil, err
 			}
 
 			err = json.Unmarshal(actionsRawMessages[0], &classes[i].actions[j].actionName)
@@ -339,14 +539,97 @@ func newServiceProxy(classRecordsRaw []byte, certRaw []byte, sigRaw []byte) (sp
 		}
 	}
 
+	if sp.extension != nil {
+		extensionClasses, extensionErr := sp.extension.classes()
+		if extensionErr != nil {
+			Error.Printf("ignoring discovery extension of `%s`: %s", sp.ident, extensionErr)
+		} else {
+			sp.classes = mergeClasses(sp.classes, extensionClasses)
+		}
+	}
+
+	// older announcers may not send a usable timestamp; it is informational only
+	var timestamp float64
+	if len(classRecords) > 8 && json.Unmarshal(classRecords[8], &timestamp) == nil {
+		sp.timestamp = highResTimestamp(timestamp)
+	}
+
 	sp.client = nil // we connect on demand
 	return
 }
 
+// mergeClasses adds the actions of extra to classes, appending them to the class of the
+// same name if there is one
+func mergeClasses(classes, extra []InstanceClass) []InstanceClass {
+	classIndex := make(map[string]int)
+	for i, class := range classes {
+		classIndex[class.className] = i
+	}
+
+	for _, class := range extra {
+		i, ok := classIndex[class.className]
+		if !ok {
+			classIndex[class.className] = len(classes)
+			classes = append(classes, class)
+			continue
+		}
+		classes[i].actions = append(classes[i].actions, class.actions...)
+	}
+
+	return classes
+}
+
+// MarshalText returns the instance's announcement as received: its class records,
+// certificate and signature, in the record format of the discovery cache file
+func (sp *ServiceInstance) MarshalText() (b []byte, err error) {
+	var buf bytes.Buffer
+	buf.Write(sp.rawClassRecords)
+	buf.WriteString("\n\n")
+	buf.Write(sp.rawCert)
+	buf.WriteString("\n\n")
+	buf.Write(sp.rawSig)
+	buf.WriteString("\n\n")
+
+	b = buf.Bytes()
+	return
+}
+
+// SameAnnouncement reports whether other announces the same thing as sp: the same
+// class records apart from the announce timestamp, and the same certificate. The
+// periodic announcements of an unchanged instance are the same announcement.
+// Instances that were not announced (stored directly, or static) are only the same
+// as themselves.
+func (sp *ServiceInstance) SameAnnouncement(other *ServiceInstance) bool {
+	if sp == other {
+		return true
+	}
+	if sp == nil || other == nil || len(sp.rawClassRecords) == 0 || len(other.rawClassRecords) == 0 {
+		return false
+	}
+	if !bytes.Equal(sp.rawCert, other.rawCert) {
+		return false
+	}
+
+	var records, otherRecords []json.RawMessage
+	if json.Unmarshal(sp.rawClassRecords, &records) != nil || json.Unmarshal(other.rawClassRecords, &otherRecords) != nil {
+		return bytes.Equal(sp.rawClassRecords, other.rawClassRecords)
+	}
+	if len(records) != len(otherRecords) {
+		return false
+	}
+	// the timestamp is the last entry
+	for i := 0; i < len(records)-1; i++ {
+		if !bytes.Equal(records[i], otherRecords[i]) {
+			return false
+		}
+	}
+	return true
+}
+
 // 1) Verify signature of classRecords
 // 2) Make sure the fingerprint is in authorized_services
 // 3) Filter announced actions against authorized actions
-func (sp *serviceProxy) Validate() (err error) {
+func (sp *ServiceInstance) Validate() (err error) {
 	_, err = sp.validateSignature()
 	if err != nil {
 		return
@@ -358,28 +641,13 @@ func (sp *serviceProxy) Validate() (err error) {
 	return
 }
 
-func (sp *serviceProxy) validateSignature() (hexSha1 string, err error) {
-	decoded, _ := pem.Decode(sp.rawCert)
-	if decoded == nil {
-		err = fmt.Errorf("could not find valid cert in `%s`", sp.rawCert)
-		return
-	}
-
-	// Put pem in form useful for fingerprinting
-	cert, err := x509.ParseCertificate(decoded.Bytes)
+func (sp *ServiceInstance) validateSignature() (hexSha1 string, err error) {
+	cert, err := sp.certificate()
 	if err != nil {
-		err = fmt.Errorf("failed to parse certificate: `%s`", err)
-		return
-	}
-
-	pkixInterface := cert.PublicKey
-	rsaPubKey, ok := pkixInterface.(*rsa.PublicKey)
-	if !ok {
-		err = fmt.Errorf("could not cast parsed value to rsa.PublicKey")
 		return
 	}
 
-	err = verifySHA256(sp.rawClassRecords, rsaPubKey, sp.rawSig, false)
+	err = verifySignature(sp.rawClassRecords, cert.PublicKey, sp.rawSig, false)
 	if err != nil {
 		return
 	}
@@ -403,7 +671,7 @@ func (sp *serviceProxy) validateSignature() (hexSha1 string, err error) {
 // 	return
 // }
 
-func (sp *serviceProxy) MarshalJSON() (b []byte, err error) {
+func (sp *ServiceInstance) MarshalJSON() (b []byte, err error) {
 	arr := make([]interface{}, 9)
 	arr[0] = &sp.version
 	arr[1] = &sp.ident
@@ -411,29 +679,42 @@ func (sp *serviceProxy) MarshalJSON() (b []byte, err error) {
 	arr[3] = &sp.weight
 	arr[4] = &sp.announceInterval
 	arr[5] = &sp.connspec
-	arr[6] = &sp.protocols
+	protocols := make([]interface{}, 0, len(sp.protocols)+1)
+	for _, protocol := range sp.protocols {
+		protocols = append(protocols, protocol)
+	}
+	if extension := newDiscoveryExtension(sp); extension != nil {
+		protocols = append(protocols, extension)
+	}
+	arr[6] = protocols
 
 	// TODO: move this to two MarshalJSON interfaces for `ServiceProxyClass` and `ActionDescription`
 	// doing so should remove manual copies and separate concerns
 	//
 	// Serialize actions in this format:
 	// 	["bgdispatcher",["poll","",1],["reboot","",1],["report","",1]]
-	classSpecs := make([][]interface{}, len(sp.classes), len(sp.classes))
-	for i, class := range sp.classes {
-		entry := make([]interface{}, 1+len(class.actions), 1+len(class.actions))
+	// Actions announced in the v4 extension are left out.
+	classSpecs := make([][]interface{}, 0, len(sp.classes))
+	for _, class := range sp.classes {
+		entry := make([]interface{}, 1, 1+len(class.actions))
 		entry[0] = class.className
-		for j, action := range class.actions {
+		for _, action := range class.actions {
+			if action.extended() {
+				continue
+			}
 			actions := make([]interface{}, 3, 3)
 
 			actionNameCopy := make([]byte, len(action.actionName))
 			copy(actionNameCopy, action.actionName)
 			actions[0] = string(actionNameCopy)
-			actions[1] = &action.crudTags
-			actions[2] = &action.version
-			entry[j+1] = &actions
+			actions[1] = action.crudTags
+			actions[2] = action.version
+			entry = append(entry, &actions)
 		}
 
-		classSpecs[i] = entry
+		if len(entry) > 1 {
+			classSpecs = append(classSpecs, entry)
+		}
 	}
 	arr[7] = &classSpecs
 	arr[8] = &sp.timestamp
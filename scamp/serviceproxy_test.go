@@ -3,6 +3,8 @@ package scamp
 import "testing"
 import "encoding/json"
 import "bytes"
+import "reflect"
+import "time"
 
 var serviceProxyClassRecordsRaw = []byte(`[3,"bgapi/proc01-HP4m32uuoVLTNXcLrKc3vd75","main",1,5,"beepish+tls://10.8.1.158:30359",["json"],[["bgdispatcher",["poll","",1],["reboot","",1],["report","",1]]],1440001142628.000000]`)
 var serviceProxySigRaw = []byte(`CPuxVvNppUNVIGSlaNUW6fpXp2h31/AKX/rAdzyRRsUks8qsjq5/9X5ZUsz85JlPhknxazjlX81U
@@ -76,7 +78,7 @@ func TestServiceProxySerialize(t *testing.T) {
 	// [["bgdispatcher",["poll","",1],["reboot","",1],["report","",1]]]
 	// ,1440001142628
 	// ]
-	serviceProxy := serviceProxy{
+	serviceProxy := ServiceInstance{
 		version:          3,
 		ident:            "bgapi/proc01-HP4m32uuoVLTNXcLrKc3vd75",
 		sector:           "main",
@@ -86,21 +88,21 @@ func TestServiceProxySerialize(t *testing.T) {
 		protocols:        []string{"json"},
 		timestamp:        1440001142628,
 		// ["reboot","",1],["report","",1]
-		classes: []serviceProxyClass{
-			serviceProxyClass{
+		classes: []InstanceClass{
+			InstanceClass{
 				className: "bgdispatcher",
-				actions: []actionDescription{
-					actionDescription{
+				actions: []InstanceAction{
+					InstanceAction{
 						actionName: "poll",
 						crudTags:   "",
 						version:    1,
 					},
-					actionDescription{
+					InstanceAction{
 						actionName: "reboot",
 						crudTags:   "",
 						version:    1,
 					},
-					actionDescription{
+					InstanceAction{
 						actionName: "report",
 						crudTags:   "",
 						version:    1,
@@ -118,3 +120,50 @@ func TestServiceProxySerialize(t *testing.T) {
 		t.Fatalf("serialized service record did not match expected.\nexpected: `%s`\ngot:      `%s`\n", serviceProxyClassRecordsRaw, b)
 	}
 }
+
+func TestServiceInstanceAccessors(t *testing.T) {
+	classRecords := []byte(`[3,"logger-1","main",2,5,"beepish+tls://10.8.1.158:30359",["json","jsonstore"],[["Logger",["info","read,noauth",1],["purge","destroy secret",2]]],1440001142628.000000]`)
+	instance, err := newServiceProxy(classRecords, serviceProxyCertRaw, serviceProxySigRaw)
+	if err != nil {
+		t.Fatalf("failed to parse record: `%s`", err)
+	}
+
+	if instance.Ident() != "logger-1" || instance.Sector() != "main" || instance.Weight() != 2 || instance.ConnSpec() != "beepish+tls://10.8.1.158:30359" {
+		t.Fatalf("unexpected instance %s/%s/%d/%s", instance.Ident(), instance.Sector(), instance.Weight(), instance.ConnSpec())
+	}
+	if !reflect.DeepEqual(instance.Protocols(), []string{"json", "jsonstore"}) {
+		t.Fatalf("unexpected protocols %v", instance.Protocols())
+	}
+	if !instance.AnnounceTime().Equal(time.Unix(1440001142, 628000000)) {
+		t.Fatalf("unexpected announce time %s", instance.AnnounceTime())
+	}
+	cert, err := instance.certificate()
+	if err != nil {
+		t.Fatalf("could not parse certificate: `%s`", err)
+	}
+	if instance.Fingerprint() != GetSHA1FingerPrint(cert) || instance.FingerprintSHA256() != GetSHA256FingerPrint(cert) {
+		t.Fatalf("unexpected fingerprints `%s` / `%s`", instance.Fingerprint(), instance.FingerprintSHA256())
+	}
+
+	classes := instance.Classes()
+	if len(classes) != 1 || classes[0].Name() != "Logger" {
+		t.Fatalf("unexpected classes %v", classes)
+	}
+	actions := classes[0].Actions()
+	if len(actions) != 2 {
+		t.Fatalf("expected 2 actions, got %d", len(actions))
+	}
+	info, purge := actions[0], actions[1]
+	if info.Name() != "info" || info.Version() != 1 || !reflect.DeepEqual(info.CrudTags(), []string{"read"}) || !reflect.DeepEqual(info.Flags(), []string{"noauth"}) {
+		t.Fatalf("unexpected action %s~%d %v %v", info.Name(), info.Version(), info.CrudTags(), info.Flags())
+	}
+	if purge.Version() != 2 || !reflect.DeepEqual(purge.CrudTags(), []string{"destroy"}) || !reflect.DeepEqual(purge.Flags(), []string{"secret"}) {
+		t.Fatalf("unexpected action %s~%d %v %v", purge.Name(), purge.Version(), purge.CrudTags(), purge.Flags())
+	}
+
+	// callers get copies
+	classes[0] = InstanceClass{}
+	if instance.Classes()[0].Name() != "Logger" {
+		t.Fatalf("modifying the returned classes changed the instance")
+	}
+}
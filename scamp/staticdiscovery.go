@@ -0,0 +1,143 @@
+package scamp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+// StaticProvider feeds a ServiceCache with instances described by hand or in a
+// manifest file, for local development and tests. They are not signed and are
+// trusted as is, so static discovery must be allowed explicitly and is always
+// refused in production.
+type StaticProvider struct {
+	instancesM sync.Mutex
+	instances  []*ServiceInstance
+	changed    chan struct{}
+}
+
+// staticManifest is the YAML or JSON file read by LoadManifest:
+//
+//	services:
+//	  - ident: logger-1
+//	    sector: main
+//	    connspec: beepish+tls://127.0.0.1:30100
+//	    protocols: [json]
+//	    actions: [Logger.info, Logger.warn~2]
+type staticManifest struct {
+	Services []struct {
+		Ident     string   `yaml:"ident"`
+		Sector    string   `yaml:"sector"`
+		Connspec  string   `yaml:"connspec"`
+		Protocols []string `yaml:"protocols"`
+		Actions   []string `yaml:"actions"`
+	} `yaml:"services"`
+}
+
+// NewStaticProvider creates an empty StaticProvider. conf must allow static discovery
+// with `discovery.allow_static = true`, and must not set `scamp.production = true`.
+func NewStaticProvider(conf *Config) (provider *StaticProvider, err error) {
+	production, err := configBool(conf, "scamp.production")
+	if err != nil {
+		return
+	}
+	allowed, err := configBool(conf, "discovery.allow_static")
+	if err != nil {
+		return
+	}
+	if production {
+		err = errors.New("static discovery is refused in production (scamp.production is set)")
+		return
+	}
+	if !allowed {
+		err = errors.New("static discovery is disabled: set discovery.allow_static = true to use unsigned instances")
+		return
+	}
+
+	provider = new(StaticProvider)
+	provider.changed = make(chan struct{}, 1)
+	return
+}
+
+// Add describes an instance like ServiceCache.StoreStatic does, replacing any
+// instance with the same ident
+func (provider *StaticProvider) Add(ident, sector, connspec string, protocols []string, actions ...string) (err error) {
+	instance, err := newStaticInstance(ident, sector, connspec, protocols, actions...)
+	if err != nil {
+		return
+	}
+
+	provider.instancesM.Lock()
+	defer provider.instancesM.Unlock()
+
+	for i, existing := range provider.instances {
+		if existing.ident == ident {
+			provider.instances = append(provider.instances[:i:i], provider.instances[i+1:]...)
+			break
+		}
+	}
+	provider.instances = append(provider.instances, instance)
+
+	select {
+	case provider.changed <- struct{}{}:
+	default:
+	}
+	return
+}
+
+// LoadManifest adds the instances described in a YAML or JSON manifest file. Sectors
+// default to `main` and protocols to `json`.
+func (provider *StaticProvider) LoadManifest(path string) (err error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	var manifest staticManifest
+	err = yaml.UnmarshalStrict(raw, &manifest)
+	if err != nil {
+		err = fmt.Errorf("could not read static manifest `%s`: %s", path, err)
+		return
+	}
+
+	for i, service := range manifest.Services {
+		if len(service.Ident) == 0 || len(service.Connspec) == 0 {
+			err = fmt.Errorf("static manifest `%s`: service %d needs an ident and a connspec", path, i)
+			return
+		}
+		if len(service.Sector) == 0 {
+			service.Sector = "main"
+		}
+		if len(service.Protocols) == 0 {
+			service.Protocols = []string{"json"}
+		}
+
+		err = provider.Add(service.Ident, service.Sector, service.Connspec, service.Protocols, service.Actions...)
+		if err != nil {
+			err = fmt.Errorf("static manifest `%s`: service `%s`: %s", path, service.Ident, err)
+			return
+		}
+	}
+	return
+}
+
+// Run passes the described instances to update, and again after every Add, until ctx
+// is done
+func (provider *StaticProvider) Run(ctx context.Context, update func([]*ServiceInstance)) error {
+	for {
+		provider.instancesM.Lock()
+		instances := append([]*ServiceInstance(nil), provider.instances...)
+		provider.instancesM.Unlock()
+		update(instances)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-provider.changed:
+		}
+	}
+}
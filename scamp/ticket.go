@@ -5,7 +5,7 @@ import "errors"
 import "strconv"
 
 import "encoding/pem"
-import "crypto/rsa"
+import "crypto"
 import "crypto/x509"
 
 // Ticket represents a scamp auth ticket
@@ -22,15 +22,17 @@ type Ticket struct {
 var separator = []byte(",")
 var supportedVersion = []byte("1")
 
+// readTicket verifies incoming with signingPubKey, a PEM encoded RSA, ECDSA P-256 or
+// Ed25519 public key, and parses it
 func readTicket(incoming []byte, signingPubKey []byte) (ticket Ticket, err error) {
-	rsaPubKey, err := parseRsaPubKey(signingPubKey)
+	pubKey, err := parsePubKey(signingPubKey)
 	if err != nil {
 		return
 	}
 
 	ticketBytes, signature := splitTicketPayload(incoming)
 
-	err = verifySHA256(ticketBytes, rsaPubKey, signature, true)
+	err = verifySignature(ticketBytes, pubKey, signature, true)
 	if err != nil {
 		return
 	}
@@ -55,24 +57,15 @@ func splitTicketPayload(incoming []byte) (ticketBytes []byte, ticketSig []byte)
 	return
 }
 
-func parseRsaPubKey(signingPubKey []byte) (rsaPubKey *rsa.PublicKey, err error) {
+// parsePubKey reads a PEM encoded PKIX public key of any supported type
+func parsePubKey(signingPubKey []byte) (pubKey crypto.PublicKey, err error) {
 	block, _ := pem.Decode(signingPubKey)
 	if block == nil {
 		err = errors.New("expected valid block")
-	}
-
-	key, err := x509.ParsePKIXPublicKey(block.Bytes)
-	if err != nil {
 		return
 	}
 
-	rsaPubKey, ok := key.(*rsa.PublicKey)
-	if !ok {
-		err = errors.New("could not cast parsed value to rsa.PublicKey")
-		return
-	}
-
-	return
+	return x509.ParsePKIXPublicKey(block.Bytes)
 }
 
 func parseTicketBytes(ticketBytes []byte) (ticket Ticket, err error) {
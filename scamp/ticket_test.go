@@ -2,6 +2,10 @@ package scamp
 
 import "testing"
 import "bytes"
+import "crypto"
+import "crypto/x509"
+import "encoding/pem"
+import "strings"
 
 var signingPubKey = []byte(`-----BEGIN PUBLIC KEY-----
 MIICIDANBgkqhkiG9w0BAQEFAAOCAg0AMIICCAKCAgEApSmU3y4DzPhjnpOrdpPs
@@ -65,3 +69,40 @@ func TestSigVerification(t *testing.T) {
 		t.Errorf("succeeded in parsing ticket. that's unexpected.")
 	}
 }
+
+func TestTicketVerificationAcrossKeyTypes(t *testing.T) {
+	ticketBytes := []byte(`1,3063,21,1438783424,660,1+20+31`)
+
+	for _, keyType := range []string{KeyTypeRSA, KeyTypeECDSA, KeyTypeEd25519} {
+		cert, err := GenerateServiceCert("auth", CertOptions{KeyType: keyType, KeyBits: 1024})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: `%s`", keyType, err)
+		}
+
+		sig, err := signPayload(ticketBytes, cert.Keypair.PrivateKey.(crypto.Signer))
+		if err != nil {
+			t.Fatalf("%s: could not sign: `%s`", keyType, err)
+		}
+		// tickets carry unpadded URL-safe base64 signatures
+		urlSig := strings.TrimRight(strings.NewReplacer("+", "-", "/", "_").Replace(sig), "=")
+
+		der, err := x509.MarshalPKIXPublicKey(cert.Keypair.Leaf.PublicKey)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: `%s`", keyType, err)
+		}
+		pubKey := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+		ticket, err := readTicket([]byte(string(ticketBytes)+","+urlSig), pubKey)
+		if err != nil {
+			t.Fatalf("%s: ticket did not verify: `%s`", keyType, err)
+		}
+		if ticket.UserID != 3063 {
+			t.Fatalf("%s: wrong UserID %d", keyType, ticket.UserID)
+		}
+
+		_, err = readTicket([]byte(string(ticketBytes)+","+urlSig), signingPubKey)
+		if err == nil {
+			t.Fatalf("%s: ticket verified with the wrong key", keyType)
+		}
+	}
+}
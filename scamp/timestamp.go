@@ -1,8 +1,10 @@
 package scamp
 
 import "fmt"
+import "math"
 import "strconv"
 import "syscall"
+import "time"
 
 type highResTimestamp float64
 
@@ -10,11 +12,26 @@ func (ts highResTimestamp) MarshalJSON() ([]byte, error) {
 	return []byte(fmt.Sprintf("%f", ts)), nil
 }
 
+// Time converts the timestamp to a time.Time. Announcers send either seconds (like
+// getTimeOfDay) or milliseconds since the epoch; values too large to be seconds are
+// read as milliseconds. The zero timestamp is the zero time.
+func (ts highResTimestamp) Time() time.Time {
+	if ts == 0 {
+		return time.Time{}
+	}
+
+	micros := float64(ts) * 1e6
+	if ts > 1e11 {
+		micros = float64(ts) * 1e3
+	}
+	return time.UnixMicro(int64(math.Round(micros)))
+}
+
 func getTimeOfDay() (ts highResTimestamp, err error) {
 	var tval syscall.Timeval
 	syscall.Gettimeofday(&tval)
 
-	f, err := strconv.ParseFloat(fmt.Sprintf("%d.%d", tval.Sec, tval.Usec), 64)
+	f, err := strconv.ParseFloat(fmt.Sprintf("%d.%06d", tval.Sec, tval.Usec), 64)
 	if err != nil {
 		fmt.Printf("error creating timestamp: `%s`", err)
 		return
@@ -0,0 +1,138 @@
+package scamp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// UnixConnspecScheme is the connspec scheme of services reachable only over a Unix
+// socket, e.g. `scamp+unix://host.example.com/run/scamp/logger.sock`. The host is
+// the one the service runs on; only requesters on that host can dial it.
+//
+// Services that also listen on TCP announce their TLS connspec with the socket path
+// in a `unix` query parameter instead, e.g.
+// `beepish+tls://10.0.0.5:30100?unix=%2Frun%2Fscamp%2Flogger.sock`, so remote
+// requesters keep using TCP while co-located ones use the socket.
+//
+// Unix socket connections are not wrapped in TLS: the socket's file permissions
+// control who can connect, and connections have no Fingerprint.
+const UnixConnspecScheme = "scamp+unix"
+
+// ListenUnix makes the service accept plain connections on a Unix socket at path,
+// alongside its main listener. A stale socket file at path is replaced.
+func (serv *Service) ListenUnix(path string) (err error) {
+	listener, err := listenUnix(path)
+	if err != nil {
+		return
+	}
+
+	err = serv.AddListener(listener)
+	if err != nil {
+		listener.Close()
+		return
+	}
+	serv.unixSocketPath = listener.Addr().String()
+
+	return
+}
+
+// NewServiceUnix intializes a scamp service that listens only on a Unix socket at path
+func NewServiceUnix(sector string, humanName string, path string) (serv *Service, err error) {
+	listener, err := listenUnix(path)
+	if err != nil {
+		return
+	}
+
+	serv, err = NewServiceWithListener(sector, humanName, listener)
+	if err != nil {
+		listener.Close()
+		return
+	}
+
+	return
+}
+
+func listenUnix(path string) (listener net.Listener, err error) {
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return
+	}
+
+	// a socket left behind by a crashed process would make Listen fail
+	if stat, statErr := os.Lstat(path); statErr == nil && stat.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	Info.Printf("starting service on unix socket %s", path)
+	return net.Listen("unix", path)
+}
+
+// unixHost is the host announced alongside the service's socket path
+func (serv *Service) unixHost() (host string) {
+	if len(serv.advertisedHost) > 0 {
+		return serv.advertisedHost
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		return "localhost"
+	}
+	return
+}
+
+func dialUnix(path string) (client *Client, err error) {
+	if len(path) == 0 {
+		err = errors.New("empty unix socket path")
+		return
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return
+	}
+	client = NewClient(NewConnection(conn, "client"), "service-proxy")
+
+	return
+}
+
+// isLocalHost reports whether host (a name or IP from a connspec) refers to this machine
+func isLocalHost(host string) bool {
+	if len(host) == 0 {
+		return false
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.IsLoopback() {
+			return true
+		}
+
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return false
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(host, hostname)
+}
+
+// unixConnspec is the connspec of a service whose main listener is a Unix socket
+func unixConnspec(host, path string) string {
+	return fmt.Sprintf("%s://%s%s", UnixConnspecScheme, host, path)
+}
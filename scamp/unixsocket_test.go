@@ -0,0 +1,103 @@
+package scamp
+
+import (
+	"crypto/tls"
+	"net"
+	u "net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnixOnlyService(t *testing.T) {
+	initSCAMPLogger()
+
+	path := filepath.Join(t.TempDir(), "echo.sock")
+	serv, err := NewServiceUnix("main", "echo", path)
+	if err != nil {
+		t.Fatalf("could not create service: `%s`", err)
+	}
+	serv.SetAdvertisedHost("localhost")
+	serv.Register("Echo.echo", func(msg *Message, client *Client) {
+		reply := NewResponseMessage()
+		reply.SetRequestID(msg.RequestID)
+		reply.Write(msg.Bytes())
+		client.Send(reply)
+	})
+	go serv.Run()
+	defer serv.Stop()
+
+	if serv.connspec() != "scamp+unix://localhost"+path {
+		t.Fatalf("unexpected connspec `%s`", serv.connspec())
+	}
+	expectEcho(t, serv.connspec())
+
+	_, err = dialConnspec("scamp+unix://elsewhere.invalid"+path, nil)
+	if err == nil {
+		t.Fatalf("expected an error dialing a socket on another host")
+	}
+}
+
+func TestLocalRequestersPreferUnixSocket(t *testing.T) {
+	cert, err := GenerateServiceCert("echo", CertOptions{KeyBits: 1024})
+	if err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert.Keypair}})
+	if err != nil {
+		t.Fatalf("could not listen: `%s`", err)
+	}
+
+	serv := newEchoService(t, listener)
+	path := filepath.Join(t.TempDir(), "echo.sock")
+	err = serv.ListenUnix(path)
+	if err != nil {
+		t.Fatalf("could not listen on unix socket: `%s`", err)
+	}
+	go serv.Run()
+	defer serv.Stop()
+
+	connspec := serv.connspec()
+	url, err := u.Parse(connspec)
+	if err != nil {
+		t.Fatalf("could not parse `%s`: `%s`", connspec, err)
+	}
+	if url.Scheme != "beepish+tls" || url.Query().Get("unix") != path {
+		t.Fatalf("expected a TLS connspec naming the socket, got `%s`", connspec)
+	}
+
+	client, err := dialConnspec(connspec, nil)
+	if err != nil {
+		t.Fatalf("could not dial `%s`: `%s`", connspec, err)
+	}
+	if _, ok := client.conn.conn.(*net.UnixConn); !ok {
+		t.Fatalf("expected a local requester to use the socket, got %T", client.conn.conn)
+	}
+	client.Close()
+	expectEcho(t, connspec)
+
+	// without the socket the TLS address still works
+	os.Remove(path)
+	client, err = dialConnspec(connspec, nil)
+	if err != nil {
+		t.Fatalf("could not fall back to TLS: `%s`", err)
+	}
+	if _, ok := client.conn.conn.(*tls.Conn); !ok {
+		t.Fatalf("expected a TLS fallback, got %T", client.conn.conn)
+	}
+	client.Close()
+}
+
+func TestIsLocalHost(t *testing.T) {
+	hostname, _ := os.Hostname()
+	for _, host := range []string{"localhost", "127.0.0.1", "::1", hostname} {
+		if !isLocalHost(host) {
+			t.Fatalf("expected `%s` to be local", host)
+		}
+	}
+	for _, host := range []string{"", "192.0.2.1", "elsewhere.invalid"} {
+		if isLocalHost(host) {
+			t.Fatalf("expected `%s` not to be local", host)
+		}
+	}
+}
@@ -5,19 +5,35 @@ package scamp
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 
 	"encoding/base64"
+	"encoding/pem"
 
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/x509"
 )
 
 var padding = []byte("=")
 
-func verifySHA256(rawPayload []byte, rsaPubKey *rsa.PublicKey, encodedSignature []byte, isURLEncoded bool) (err error) {
+// Announcements and tickets are signed with the key of the signer's certificate:
+//
+//   - RSA keys sign the SHA256 digest of the payload with PKCS#1 v1.5
+//   - ECDSA P-256 keys sign the SHA256 digest of the payload, as an ASN.1 signature
+//   - Ed25519 keys sign the payload itself
+//
+// Signatures are base64 encoded.
+
+// verifySignature checks encodedSignature of rawPayload with pubKey, using the scheme
+// that matches the key's type
+func verifySignature(rawPayload []byte, pubKey crypto.PublicKey, encodedSignature []byte, isURLEncoded bool) (err error) {
 	expectedSig, err := decodeUnpaddedBase64(encodedSignature, isURLEncoded)
 	if err != nil {
 		err = fmt.Errorf("failed to decode base64: `%s`/`%s`", err, encodedSignature)
@@ -28,34 +44,103 @@ func verifySHA256(rawPayload []byte, rsaPubKey *rsa.PublicKey, encodedSignature
 	h.Write(rawPayload)
 	digest := h.Sum(nil)
 
-	err = rsa.VerifyPKCS1v15(rsaPubKey, crypto.SHA256, digest, expectedSig)
-	if err != nil {
-		err = fmt.Errorf("failed to verify PKCS1v15: `%s`", err)
+	switch key := pubKey.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, expectedSig)
+		if err != nil {
+			err = fmt.Errorf("failed to verify PKCS1v15: `%s`", err)
+			return
+		}
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			err = fmt.Errorf("unsupported ECDSA curve %s", key.Curve.Params().Name)
+			return
+		}
+		if !ecdsa.VerifyASN1(key, digest, expectedSig) {
+			err = errors.New("failed to verify ECDSA signature")
+			return
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, rawPayload, expectedSig) {
+			err = errors.New("failed to verify Ed25519 signature")
+			return
+		}
+	default:
+		err = fmt.Errorf("unsupported public key type %T", pubKey)
 		return
 	}
 
 	return
 }
 
-func signSHA256(rawPayload []byte, priv *rsa.PrivateKey) (base64signature string, err error) {
+// signPayload signs rawPayload with priv, using the scheme that matches the key's type
+func signPayload(rawPayload []byte, priv crypto.Signer) (base64signature string, err error) {
 	h := sha256.New()
 	h.Write(rawPayload)
 	digest := h.Sum(nil)
-	sig, err := rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, digest)
+
+	var sig []byte
+	switch key := priv.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest)
+	case *ecdsa.PrivateKey:
+		if key.Curve != elliptic.P256() {
+			err = fmt.Errorf("unsupported ECDSA curve %s", key.Curve.Params().Name)
+			return
+		}
+		sig, err = ecdsa.SignASN1(rand.Reader, key, digest)
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(key, rawPayload)
+	default:
+		err = fmt.Errorf("unsupported private key type %T", priv)
+	}
 	if err != nil {
 		return
 	}
+
 	base64signature = base64.StdEncoding.EncodeToString(sig)
 	return
 }
 
+// parsePrivateKeyPEM reads a PKCS#1 RSA, SEC 1 EC or PKCS#8 private key
+func parsePrivateKeyPEM(keyPEM []byte) (priv crypto.Signer, err error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		err = errors.New("could not find a PEM block in key data")
+		return
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		err = fmt.Errorf("unsupported key type '%s'", block.Type)
+	}
+	if err != nil {
+		return
+	}
+
+	priv, ok := key.(crypto.Signer)
+	if !ok {
+		err = fmt.Errorf("unsupported private key type %T", key)
+		return
+	}
+
+	return
+}
+
 func decodeUnpaddedBase64(incoming []byte, isURLEncoded bool) (decoded []byte, err error) {
 	if isURLEncoded {
 		if m := len(incoming) % 4; m != 0 {
 			paddingBytes := bytes.Repeat(padding, 4-m)
-			incoming = append(incoming, paddingBytes[:]...)
+			incoming = append(incoming[:len(incoming):len(incoming)], paddingBytes[:]...)
 		}
-		_, err = base64.URLEncoding.Decode(decoded, incoming)
+		decoded, err = base64.URLEncoding.DecodeString(string(incoming))
 	} else {
 		decoded, err = base64.StdEncoding.DecodeString(string(incoming))
 	}
@@ -1,6 +1,10 @@
 package scamp
 
 import "testing"
+import "crypto"
+import "crypto/ecdsa"
+import "crypto/elliptic"
+import "crypto/rand"
 
 var suspiciousBase64 = []byte(`OSEeu8fWTcq+AliFG3PlZ0eYR8zFWWAdkCwb3XbPE96wvAsiF1W6v2Udg5KoDe7M2d0oQMmpoNeC
 ZQWRMBHarz5vHzfTSXXCjvoLfZJVA1FLiJ9RYk8ulFyEJF19nxd2GLArnWjiqsP9RslhFB3BvYnZ
@@ -11,4 +15,57 @@ func TestBase64Decode(t *testing.T) {
 	if err != nil {
 		t.Errorf("could not decode: `%s`", err)
 	}
-}
\ No newline at end of file
+}
+func TestSignaturesAcrossKeyTypes(t *testing.T) {
+	payload := []byte(`[3,"logger-1234","main",1,2500,"beepish+tls://127.0.0.1:30100",["json"],[["Logger",["info","",1]]],10.000000]`)
+
+	var certs []*ServiceCert
+	for _, keyType := range []string{KeyTypeRSA, KeyTypeECDSA, KeyTypeEd25519} {
+		cert, err := GenerateServiceCert("signer", CertOptions{KeyType: keyType, KeyBits: 1024})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: `%s`", keyType, err)
+		}
+		certs = append(certs, cert)
+	}
+
+	for i, signer := range certs {
+		sig, err := signPayload(payload, signer.Keypair.PrivateKey.(crypto.Signer))
+		if err != nil {
+			t.Fatalf("%T: could not sign: `%s`", signer.Keypair.PrivateKey, err)
+		}
+
+		for j, verifier := range certs {
+			err = verifySignature(payload, verifier.Keypair.Leaf.PublicKey, []byte(sig), false)
+			if i == j && err != nil {
+				t.Fatalf("%T: signature did not verify: `%s`", signer.Keypair.PrivateKey, err)
+			} else if i != j && err == nil {
+				t.Fatalf("%T signature verified with a %T key", signer.Keypair.PrivateKey, verifier.Keypair.Leaf.PublicKey)
+			}
+		}
+
+		err = verifySignature(append(payload, ' '), signer.Keypair.Leaf.PublicKey, []byte(sig), false)
+		if err == nil {
+			t.Fatalf("%T: signature verified for a modified payload", signer.Keypair.PrivateKey)
+		}
+
+		parsed, err := parsePrivateKeyPEM(signer.PEMKey)
+		if err != nil {
+			t.Fatalf("could not parse `%s`: `%s`", signer.PEMKey, err)
+		}
+		if _, err = signPayload(payload, parsed); err != nil {
+			t.Fatalf("could not sign with parsed key: `%s`", err)
+		}
+	}
+}
+
+func TestUnsupportedCurve(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: `%s`", err)
+	}
+
+	_, err = signPayload([]byte("payload"), key)
+	if err == nil {
+		t.Fatalf("expected P-384 keys to be refused")
+	}
+}